@@ -0,0 +1,180 @@
+// Package attest holds what the server and the client both need to check a
+// tag against its attestation: the manifest of a tag, the Merkle root over
+// it and the signed attestation itself.
+package attest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An attestation vouches for the entries of a tag. It holds a Merkle root over
+// the tag's (request key, digest) pairs in key order, signed with the
+// server's ed25519 key. Anyone with a manifest of the tag and the public key
+// can rebuild the root and check the signature without trusting whoever
+// handed them the tag.
+
+// ErrTampered is wrapped by errors about tags that no longer match their
+// attestation, or attestations that were not signed by the expected key.
+var ErrTampered = errors.New("does not match its attestation")
+
+// attestationContext is signed along with the tag and its root, so the
+// signature cannot be passed off as one over anything else.
+const attestationContext = "btrfly attestation v1"
+
+type Attestation struct {
+	// Tag is the tag that was signed, which stays in the signature when the
+	// tag is copied, renamed or imported under another name
+	Tag     string
+	Root    string
+	Entries int
+	// SignedAt is only informational, it is not signed
+	SignedAt time.Time
+	// PublicKey and Signature are hex encoded
+	PublicKey string
+	Signature string
+}
+
+// Manifest is a lockfile for a tag: what every entry was recorded from and
+// the digest of its body. It leaves out anything that changes between
+// recordings of the same bytes, like timestamps, so it can be committed next
+// to the source and only changes when the recording does.
+type Manifest struct {
+	Tag     string
+	Entries []ManifestEntry
+}
+
+// ManifestEntry describes a single key. Digest is the hash of the body
+// prefixed with its algorithm, e.g. "sha256:9f86...".
+type ManifestEntry struct {
+	Key    string
+	Method string
+	URL    string
+	Digest string
+	Size   int64
+	// From names the tag the entry is inherited from, it is empty for the
+	// tag's own entries
+	From string `json:",omitempty"`
+}
+
+// Own leaves out the entries inherited from other tags. Those are covered by
+// the attestations of the tags they come from, not by this one.
+func (m Manifest) Own() Manifest {
+	own := Manifest{Tag: m.Tag, Entries: make([]ManifestEntry, 0, len(m.Entries))}
+	for _, entry := range m.Entries {
+		if entry.From == "" {
+			own.Entries = append(own.Entries, entry)
+		}
+	}
+	return own
+}
+
+// Leaves and nodes are hashed with different prefixes, so a node can never be
+// passed off as a leaf.
+const (
+	merkleLeaf byte = 0
+	merkleNode byte = 1
+)
+
+// MerkleRoot hashes the key and digest of every entry, in key order, into a
+// binary tree and returns the hex encoded root. A node without a sibling is
+// carried up a level unchanged, and a tag without entries has the hash of
+// nothing as its root.
+func MerkleRoot(entries []ManifestEntry) string {
+	sorted := append([]ManifestEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	if len(sorted) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+	level := make([][]byte, 0, len(sorted))
+	for _, entry := range sorted {
+		h := sha256.New()
+		h.Write([]byte{merkleLeaf})
+		h.Write([]byte(entry.Key))
+		h.Write([]byte{0})
+		h.Write([]byte(entry.Digest))
+		level = append(level, h.Sum(nil))
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{merkleNode})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+func attestationMessage(tag string, root string) []byte {
+	return []byte(attestationContext + "\x00" + tag + "\x00" + root)
+}
+
+// Attest signs the entries of manifest with key, leaving out inherited ones.
+func Attest(manifest Manifest, key ed25519.PrivateKey, now time.Time) Attestation {
+	manifest = manifest.Own()
+	root := MerkleRoot(manifest.Entries)
+	return Attestation{
+		Tag:       manifest.Tag,
+		Root:      root,
+		Entries:   len(manifest.Entries),
+		SignedAt:  now.UTC(),
+		PublicKey: hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+		Signature: hex.EncodeToString(ed25519.Sign(key, attestationMessage(manifest.Tag, root))),
+	}
+}
+
+// Check verifies that a signed the entries of manifest, inherited ones aside.
+// When trusted is nil the key in the attestation is taken at its word, which
+// only shows that the tag was not changed after it was signed, not who signed
+// it.
+func (a Attestation) Check(manifest Manifest, trusted ed25519.PublicKey) (err error) {
+	key, err := hex.DecodeString(a.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("attestation of %s has a malformed public key: %w", a.Tag, ErrTampered)
+	}
+	if trusted != nil && !trusted.Equal(ed25519.PublicKey(key)) {
+		return fmt.Errorf("attestation of %s was signed by %s: %w", a.Tag, a.PublicKey, ErrTampered)
+	}
+	signature, err := hex.DecodeString(a.Signature)
+	if err != nil || !ed25519.Verify(key, attestationMessage(a.Tag, a.Root), signature) {
+		return fmt.Errorf("attestation of %s has a bad signature: %w", a.Tag, ErrTampered)
+	}
+	if root := MerkleRoot(manifest.Own().Entries); root != a.Root {
+		return fmt.Errorf("tag %s has root %s, attested %s: %w", manifest.Tag, root, a.Root, ErrTampered)
+	}
+	return nil
+}
+
+// LoadPublicKey reads an ed25519 public key from path, either as 32 raw bytes
+// or as 64 hex digits.
+func LoadPublicKey(path string) (key ed25519.PublicKey, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %s", err)
+	}
+	if text := strings.TrimSpace(string(data)); len(text) == 2*ed25519.PublicKeySize {
+		if key, err := hex.DecodeString(text); err == nil {
+			return ed25519.PublicKey(key), nil
+		}
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key in %s has to be %d bytes or %d hex digits", path, ed25519.PublicKeySize, 2*ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(data), nil
+}
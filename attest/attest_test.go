@@ -0,0 +1,33 @@
+package attest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	a := ManifestEntry{Key: "GET example.com/a", Digest: "sha256:aa"}
+	b := ManifestEntry{Key: "GET example.com/b", Digest: "sha256:bb"}
+	c := ManifestEntry{Key: "GET example.com/c", Digest: "sha256:cc"}
+	leaf := sha256.Sum256([]byte("\x00GET example.com/a\x00sha256:aa"))
+	if got := MerkleRoot([]ManifestEntry{a}); got != hex.EncodeToString(leaf[:]) {
+		t.Errorf("single entry: got %s, want its leaf", got)
+	}
+	if MerkleRoot([]ManifestEntry{a, b, c}) != MerkleRoot([]ManifestEntry{c, a, b}) {
+		t.Errorf("root depends on the order of the entries")
+	}
+	changed := b
+	changed.Digest = "sha256:bc"
+	for name, entries := range map[string][]ManifestEntry{
+		"missing":    {a, b},
+		"changed":    {a, changed, c},
+		"extra":      {a, b, c, {Key: "GET example.com/d", Digest: "sha256:dd"}},
+		"swapped":    {{Key: a.Key, Digest: b.Digest}, {Key: b.Key, Digest: a.Digest}, c},
+		"no entries": nil,
+	} {
+		if MerkleRoot(entries) == MerkleRoot([]ManifestEntry{a, b, c}) {
+			t.Errorf("%s: root did not change", name)
+		}
+	}
+}
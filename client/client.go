@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/emmettmcdow/btrfly/attest"
 	"github.com/emmettmcdow/btrfly/client/dns"
 	"io"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 var client *http.Client
@@ -93,6 +98,91 @@ func _main(dns DNSConfig, ctrlEndpoint string, arglen int, args []string) int {
 			fmt.Fprintf(os.Stderr, "Failed to set the tag: %s\n\n", err)
 			return 1
 		}
+	case "export":
+		if arglen != 2 && arglen != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: btrfly export tag_name [file]\n")
+			return 1
+		}
+		file := args[1] + ".tar"
+		if arglen == 3 {
+			file = args[2]
+		}
+		if err := export(args[1], file, ctrlEndpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export %s: %s\n\n", args[1], err)
+			return 1
+		}
+	case "import":
+		if arglen != 2 && arglen != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: btrfly import file [tag_name]\n")
+			return 1
+		}
+		tagName := ""
+		if arglen == 3 {
+			tagName = args[2]
+		}
+		if err := importBundle(args[1], tagName, ctrlEndpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to import %s: %s\n\n", args[1], err)
+			return 1
+		}
+	case "diff":
+		asJSON := false
+		if arglen == 4 && (args[3] == "--json" || args[3] == "-json") {
+			asJSON = true
+		} else if arglen != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: btrfly diff tag_a tag_b [--json]\n")
+			return 1
+		}
+		if err := diff(args[1], args[2], asJSON, ctrlEndpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to diff %s and %s: %s\n\n", args[1], args[2], err)
+			return 1
+		}
+	case "manifest":
+		if arglen != 2 && arglen != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: btrfly manifest tag_name [file]\n")
+			return 1
+		}
+		file := ""
+		if arglen == 3 {
+			file = args[2]
+		}
+		if err := manifest(args[1], file, ctrlEndpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get the manifest of %s: %s\n\n", args[1], err)
+			return 1
+		}
+	case "verify":
+		if arglen != 2 && arglen != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: btrfly verify file [tag_name]\n")
+			return 1
+		}
+		tagName := ""
+		if arglen == 3 {
+			tagName = args[2]
+		}
+		ok, err := verify(args[1], tagName, ctrlEndpoint)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to verify %s: %s\n\n", args[1], err)
+			return 1
+		}
+		if !ok {
+			return 1
+		}
+	case "attestation":
+		if arglen != 2 && arglen != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: btrfly attestation tag_name [public_key_file]\n")
+			return 1
+		}
+		keyFile := ""
+		if arglen == 3 {
+			keyFile = args[2]
+		}
+		ok, err := checkAttestation(args[1], keyFile, ctrlEndpoint)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check the attestation of %s: %s\n\n", args[1], err)
+			return 1
+		}
+		if !ok {
+			return 1
+		}
 	// case "login":
 	// 	if arglen != 2 {
 	// 		fmt.Fprintf(os.Stderr, "No login id given.\n")
@@ -131,6 +221,38 @@ func _main(dns DNSConfig, ctrlEndpoint string, arglen int, args []string) int {
 				fmt.Printf("    mode - change the mode of operation of the btrfly service\n")
 				fmt.Printf("    mode_verb is required and passed as an argument.\n")
 				fmt.Printf("    mode_verb is one of: record, playback, standby.\n")
+			case "export":
+				fmt.Printf("Help: btrfly export tag_name [file]\n")
+				fmt.Printf("    export - save a recorded tag as a self-contained bundle\n")
+				fmt.Printf("    file defaults to tag_name.tar. A file ending in .har is written as\n")
+				fmt.Printf("    a HAR 1.2 log instead, one ending in .warc or .warc.gz as a WARC file.\n")
+			case "import":
+				fmt.Printf("Help: btrfly import file [tag_name]\n")
+				fmt.Printf("    import - load a bundle made by export into the btrfly service\n")
+				fmt.Printf("    tag_name defaults to the tag the bundle was exported from.\n")
+				fmt.Printf("    A file ending in .har is read as a HAR 1.2 log and one ending in .warc or\n")
+				fmt.Printf("    .warc.gz as a WARC file, tag_name is then required.\n")
+			case "diff":
+				fmt.Printf("Help: btrfly diff tag_a tag_b [--json]\n")
+				fmt.Printf("    diff - show which URLs were added, removed or changed going from tag_a\n")
+				fmt.Printf("    to tag_b. --json prints the report as JSON instead.\n")
+			case "manifest":
+				fmt.Printf("Help: btrfly manifest tag_name [file]\n")
+				fmt.Printf("    manifest - write the URL, method, digest and size of every entry of\n")
+				fmt.Printf("    tag_name as a sorted JSON manifest that can be committed next to the\n")
+				fmt.Printf("    source. It is printed unless file is given.\n")
+			case "verify":
+				fmt.Printf("Help: btrfly verify file [tag_name]\n")
+				fmt.Printf("    verify - check a tag against a manifest written by manifest and list\n")
+				fmt.Printf("    what is missing, unexpected or changed. tag_name defaults to the tag\n")
+				fmt.Printf("    the manifest was written from. Exits with 1 on any mismatch.\n")
+			case "attestation":
+				fmt.Printf("Help: btrfly attestation tag_name [public_key_file]\n")
+				fmt.Printf("    attestation - check that tag_name still matches the attestation the\n")
+				fmt.Printf("    server signed it with. The Merkle root is rebuilt here from the tag's\n")
+				fmt.Printf("    manifest, and the signature checked against the ed25519 public key in\n")
+				fmt.Printf("    public_key_file. Without one it is only checked against the key the\n")
+				fmt.Printf("    attestation names. Exits with 1 when anything does not match.\n")
 			// case "login":
 			// 	fmt.Printf("Help: btrfly login id\n")
 			// 	fmt.Printf("    login - set your credentials so that you can use the btrfly service.\n")
@@ -161,6 +283,12 @@ func defaultHelp() {
 	fmt.Printf("    tag      - set the tag to identify this current build\n")
 	// fmt.Printf("    login    - set your credentials so that you can use the btrfly service\n")
 	fmt.Printf("    mode     - change the mode of operation of the btrfly service\n")
+	fmt.Printf("    export   - save a recorded tag as a self-contained bundle\n")
+	fmt.Printf("    import   - load a bundle into the btrfly service\n")
+	fmt.Printf("    diff     - compare two recorded tags\n")
+	fmt.Printf("    manifest - write a lockfile-style manifest of a tag\n")
+	fmt.Printf("    verify   - check a tag against a manifest\n")
+	fmt.Printf("    attestation - check a tag against its signed attestation\n")
 	fmt.Printf("    help     - pass another subcommand to get info about that subcommand\n")
 }
 
@@ -234,3 +362,287 @@ func mode(mode string, ctrlEndpoint string) (err error) {
 	}
 	return nil
 }
+
+func export(tag string, file string, ctrlEndpoint string) (err error) {
+	req, err := http.NewRequest("GET", "http://"+ctrlEndpoint+"/export", http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Tag", tag)
+	if format := formatOf(file); format != "" {
+		req.Header.Add("Format", format)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform http request: %s", err)
+	}
+	defer resp.Body.Close()
+	if err = responseError(resp); err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(file)
+		return fmt.Errorf("failed to download bundle: %s", err)
+	}
+	return f.Close()
+}
+
+func importBundle(file string, tag string, ctrlEndpoint string) (err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequest("POST", "http://"+ctrlEndpoint+"/import", f)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		req.Header.Add("Tag", tag)
+	}
+	if format := formatOf(file); format != "" {
+		req.Header.Add("Format", format)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform http request: %s", err)
+	}
+	defer resp.Body.Close()
+	if err = responseError(resp); err != nil {
+		return err
+	}
+	imported := ""
+	if err = json.NewDecoder(resp.Body).Decode(&imported); err != nil {
+		return fmt.Errorf("failed to decode response: %s", err)
+	}
+	fmt.Printf("Imported %s\n", imported)
+	return nil
+}
+
+type diffEntry struct {
+	Key     string
+	OldHash string `json:",omitempty"`
+	OldSize int64
+	NewHash string `json:",omitempty"`
+	NewSize int64
+}
+
+type tagDiff struct {
+	Added   []diffEntry
+	Removed []diffEntry
+	Changed []diffEntry
+}
+
+func diff(a string, b string, asJSON bool, ctrlEndpoint string) (err error) {
+	req, err := http.NewRequest("GET", "http://"+ctrlEndpoint+"/tags/diff", http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Tag", a)
+	req.Header.Add("Other", b)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform http request: %s", err)
+	}
+	defer resp.Body.Close()
+	if err = responseError(resp); err != nil {
+		return err
+	}
+	if asJSON {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	report := tagDiff{}
+	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("failed to decode response: %s", err)
+	}
+	for _, entry := range report.Added {
+		fmt.Printf("+ %s (%d bytes)\n", entry.Key, entry.NewSize)
+	}
+	for _, entry := range report.Removed {
+		fmt.Printf("- %s (%d bytes)\n", entry.Key, entry.OldSize)
+	}
+	for _, entry := range report.Changed {
+		fmt.Printf("~ %s (%d -> %d bytes)\n", entry.Key, entry.OldSize, entry.NewSize)
+	}
+	fmt.Printf("%d added, %d removed, %d changed\n", len(report.Added), len(report.Removed), len(report.Changed))
+	return nil
+}
+
+func manifest(tag string, file string, ctrlEndpoint string) (err error) {
+	req, err := http.NewRequest("GET", "http://"+ctrlEndpoint+"/tags/manifest", http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Tag", tag)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform http request: %s", err)
+	}
+	defer resp.Body.Close()
+	if err = responseError(resp); err != nil {
+		return err
+	}
+	if file == "" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download manifest: %s", err)
+	}
+	return os.WriteFile(file, data, 0o644)
+}
+
+type manifestEntry struct {
+	Key    string
+	Digest string
+	Size   int64
+}
+
+type manifestChange struct {
+	Key        string
+	WantDigest string
+	WantSize   int64
+	GotDigest  string
+	GotSize    int64
+}
+
+type manifestReport struct {
+	Missing    []manifestEntry
+	Unexpected []manifestEntry
+	Changed    []manifestChange
+}
+
+// verify prints where the tag differs from the manifest in file and reports
+// whether it matched.
+func verify(file string, tag string, ctrlEndpoint string) (ok bool, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	req, err := http.NewRequest("POST", "http://"+ctrlEndpoint+"/tags/verify", f)
+	if err != nil {
+		return false, err
+	}
+	if tag != "" {
+		req.Header.Add("Tag", tag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to perform http request: %s", err)
+	}
+	defer resp.Body.Close()
+	if err = responseError(resp); err != nil {
+		return false, err
+	}
+
+	report := manifestReport{}
+	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return false, fmt.Errorf("failed to decode response: %s", err)
+	}
+	for _, entry := range report.Missing {
+		fmt.Printf("missing    %s %s\n", entry.Key, entry.Digest)
+	}
+	for _, entry := range report.Unexpected {
+		fmt.Printf("unexpected %s %s\n", entry.Key, entry.Digest)
+	}
+	for _, change := range report.Changed {
+		fmt.Printf("changed    %s %s (%d bytes) -> %s (%d bytes)\n",
+			change.Key, change.WantDigest, change.WantSize, change.GotDigest, change.GotSize)
+	}
+	mismatches := len(report.Missing) + len(report.Unexpected) + len(report.Changed)
+	if mismatches > 0 {
+		fmt.Printf("%d mismatches\n", mismatches)
+		return false, nil
+	}
+	fmt.Printf("OK\n")
+	return true, nil
+}
+
+// checkAttestation rebuilds the Merkle root of tag from its manifest and
+// checks it and the signature of the tag's attestation, against the public key
+// in keyFile when there is one. It reports whether the tag checked out.
+func checkAttestation(tag string, keyFile string, ctrlEndpoint string) (ok bool, err error) {
+	var trusted ed25519.PublicKey
+	if keyFile != "" {
+		if trusted, err = attest.LoadPublicKey(keyFile); err != nil {
+			return false, err
+		}
+	}
+	attestation := attest.Attestation{}
+	if err = getTagJSON("/tags/attestation", tag, ctrlEndpoint, &attestation); err != nil {
+		return false, err
+	}
+	manifest := attest.Manifest{}
+	if err = getTagJSON("/tags/manifest", tag, ctrlEndpoint, &manifest); err != nil {
+		return false, err
+	}
+	if err = attestation.Check(manifest, trusted); err != nil {
+		fmt.Printf("MISMATCH: %s\n", err)
+		return false, nil
+	}
+	fmt.Printf("OK: %d entries, root %s, signed by %s at %s\n",
+		attestation.Entries, attestation.Root, attestation.PublicKey, attestation.SignedAt.Format(time.RFC3339))
+	if trusted == nil {
+		fmt.Fprintf(os.Stderr, "No public key given, the signer was not checked\n")
+	}
+	return true, nil
+}
+
+// getTagJSON decodes what the controller answers on path for tag into v.
+func getTagJSON(path string, tag string, ctrlEndpoint string, v interface{}) (err error) {
+	req, err := http.NewRequest("GET", "http://"+ctrlEndpoint+path, http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Tag", tag)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform http request: %s", err)
+	}
+	defer resp.Body.Close()
+	if err = responseError(resp); err != nil {
+		return err
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %s", err)
+	}
+	return nil
+}
+
+// formatOf picks the export format from a file's extension. Anything
+// unrecognised is a btrfly bundle.
+func formatOf(file string) (format string) {
+	file = strings.ToLower(file)
+	switch {
+	case strings.HasSuffix(file, ".har"):
+		return "har"
+	case strings.HasSuffix(file, ".warc"):
+		return "warc"
+	case strings.HasSuffix(file, ".warc.gz"):
+		return "warc.gz"
+	default:
+		return ""
+	}
+}
+
+// responseError turns a non-200 response into an error carrying its body.
+func responseError(resp *http.Response) (err error) {
+	if resp.StatusCode == 200 {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("got response code %d, and failed to read body", resp.StatusCode)
+	}
+	return fmt.Errorf("got response code %d with body:\n%s", resp.StatusCode, body)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -29,6 +30,14 @@ func fakeController(wg *sync.WaitGroup, talkback chan<- string, port int) (s *ht
 		if ok {
 			headers += fmt.Sprintf("Mode: '%s',", mode)
 		}
+		other, ok := r.Header["Other"]
+		if ok {
+			headers += fmt.Sprintf("Other: '%s',", other)
+		}
+		format, ok := r.Header["Format"]
+		if ok {
+			headers += fmt.Sprintf("Format: '%s',", format)
+		}
 		headers += "]"
 		method := r.Method
 		path := r.URL.String()
@@ -93,6 +102,10 @@ func TestClient(t *testing.T) {
 			fmt.Printf("failed to shutdown controllerServer: %s", err)
 		}
 	}()
+	bundle := filepath.Join(t.TempDir(), "bundle.tar")
+	har := filepath.Join(t.TempDir(), "capture.HAR")
+	warc := filepath.Join(t.TempDir(), "crawl.warc.gz")
+	lock := filepath.Join(t.TempDir(), "btrfly.lock.json")
 	// TODO: add login back
 	subtests := []struct {
 		command   []string
@@ -115,6 +128,27 @@ func TestClient(t *testing.T) {
 		{[]string{"mode", "standby"}, 0, "<GET> /mode - Headers: [Mode: '[2]',]", 0, 0, 0},
 		{[]string{"mode"}, 1, "", 0, 0, 0},
 		{[]string{"mode", "standby", "uhoh"}, 1, "", 0, 0, 0},
+		{[]string{"export", "tag-working", bundle}, 0, "<GET> /export - Headers: [Tag: '[tag-working]',]", 0, 0, 0},
+		{[]string{"export"}, 1, "", 0, 0, 0},
+		{[]string{"import", bundle, "tag-imported"}, 1, "<POST> /import - Headers: [Tag: '[tag-imported]',]", 0, 0, 0},
+		{[]string{"import", bundle}, 1, "<POST> /import - Headers: []", 0, 0, 0},
+		{[]string{"import"}, 1, "", 0, 0, 0},
+		{[]string{"export", "tag-working", har}, 0, "<GET> /export - Headers: [Tag: '[tag-working]',Format: '[har]',]", 0, 0, 0},
+		{[]string{"import", har, "tag-imported"}, 1, "<POST> /import - Headers: [Tag: '[tag-imported]',Format: '[har]',]", 0, 0, 0},
+		{[]string{"export", "tag-working", warc}, 0, "<GET> /export - Headers: [Tag: '[tag-working]',Format: '[warc.gz]',]", 0, 0, 0},
+		{[]string{"import", warc, "tag-imported"}, 1, "<POST> /import - Headers: [Tag: '[tag-imported]',Format: '[warc.gz]',]", 0, 0, 0},
+		{[]string{"diff", "tag-a", "tag-b"}, 1, "<GET> /tags/diff - Headers: [Tag: '[tag-a]',Other: '[tag-b]',]", 0, 0, 0},
+		{[]string{"diff", "tag-a", "tag-b", "--json"}, 0, "<GET> /tags/diff - Headers: [Tag: '[tag-a]',Other: '[tag-b]',]", 0, 0, 0},
+		{[]string{"diff", "tag-a"}, 1, "", 0, 0, 0},
+		{[]string{"diff", "tag-a", "tag-b", "--yaml"}, 1, "", 0, 0, 0},
+		{[]string{"manifest", "tag-working", lock}, 0, "<GET> /tags/manifest - Headers: [Tag: '[tag-working]',]", 0, 0, 0},
+		{[]string{"manifest"}, 1, "", 0, 0, 0},
+		{[]string{"verify", lock, "tag-working"}, 1, "<POST> /tags/verify - Headers: [Tag: '[tag-working]',]", 0, 0, 0},
+		{[]string{"verify", lock}, 1, "<POST> /tags/verify - Headers: []", 0, 0, 0},
+		{[]string{"verify"}, 1, "", 0, 0, 0},
+		{[]string{"attestation", "tag-working"}, 1, "<GET> /tags/attestation - Headers: [Tag: '[tag-working]',]", 0, 0, 0},
+		{[]string{"attestation", "tag-working", lock}, 1, "", 0, 0, 0},
+		{[]string{"attestation"}, 1, "", 0, 0, 0},
 		// {[]string{"login", "420"}, 0, "<GET> /login - Headers: [ID: '[420]',]", 0, 0, 0},
 		// {[]string{"login", "690000"}, 0, "<GET> /login - Headers: [ID: '[690000]',]", 0, 0, 0},
 		// {[]string{"login", "abc"}, 1, "", 0, 0, 0},
@@ -127,6 +161,12 @@ func TestClient(t *testing.T) {
 		{[]string{"help", "deconfig"}, 0, "", 0, 0, 0},
 		{[]string{"help", "tag"}, 0, "", 0, 0, 0},
 		{[]string{"help", "mode"}, 0, "", 0, 0, 0},
+		{[]string{"help", "export"}, 0, "", 0, 0, 0},
+		{[]string{"help", "import"}, 0, "", 0, 0, 0},
+		{[]string{"help", "diff"}, 0, "", 0, 0, 0},
+		{[]string{"help", "manifest"}, 0, "", 0, 0, 0},
+		{[]string{"help", "verify"}, 0, "", 0, 0, 0},
+		{[]string{"help", "attestation"}, 0, "", 0, 0, 0},
 		// {[]string{"help", "login"}, 0, "", 0, 0, 0},
 		{[]string{"help", "gobbledygook"}, 0, "", 0, 0, 0},
 		{[]string{"help", "gobbledygook", "g2"}, 0, "", 0, 0, 0},
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"github.com/emmettmcdow/btrfly/attest"
+	"github.com/emmettmcdow/btrfly/server/cache"
+	"log"
+	"sync"
+)
+
+// signingKey signs tags on /tags/sign and whenever recording stops. In strict
+// mode playback refuses any tag that is not attested by trustedKey, which
+// defaults to the public half of signingKey. All three are set from the flags
+// before the controller and proxies start.
+var (
+	signingKey     ed25519.PrivateKey
+	trustedKey     ed25519.PublicKey
+	strictPlayback bool
+)
+
+// verifiedMu guards verified, which holds the version of every tag strict
+// playback found to match its attestation. A tag is checked again once its
+// version moves on.
+var (
+	verifiedMu sync.Mutex
+	verified   = make(map[verifiedTag]uint64)
+)
+
+type verifiedTag struct {
+	tag  string
+	user uint64
+}
+
+// verifyPlayback checks that tag may be played back in strict mode.
+func verifyPlayback(k cache.Handler, tag string, userID uint64) (err error) {
+	version, err := k.Version(tag, userID)
+	if err != nil {
+		return err
+	}
+	key := verifiedTag{tag: tag, user: userID}
+	verifiedMu.Lock()
+	checked, ok := verified[key]
+	verifiedMu.Unlock()
+	if ok && checked == version {
+		return nil
+	}
+	// A change while verifying leaves the old version behind, which only
+	// means checking once more
+	if err = cache.VerifyTag(k, tag, userID, trustedKey); err != nil {
+		return err
+	}
+	verifiedMu.Lock()
+	verified[key] = version
+	verifiedMu.Unlock()
+	return nil
+}
+
+// setupSigning loads the keys from keyPath and trustedPath.
+func setupSigning(keyPath string, trustedPath string, strict bool) (err error) {
+	if keyPath != "" {
+		if signingKey, err = cache.LoadSigningKey(keyPath); err != nil {
+			return err
+		}
+		trustedKey = signingKey.Public().(ed25519.PublicKey)
+		log.Printf("Signing tags with public key %x", trustedKey)
+	}
+	if trustedPath != "" {
+		if trustedKey, err = attest.LoadPublicKey(trustedPath); err != nil {
+			return err
+		}
+	}
+	if strict && trustedKey == nil {
+		return fmt.Errorf("strict playback needs -signing-key or -trusted-key")
+	}
+	strictPlayback = strict
+	return nil
+}
+
+// endRecording signs the tag previous was recording into, if the mode or tag
+// changed since. Call it with the state from before every change.
+func endRecording(k cache.Handler, previous proxyState) {
+	current := currentState()
+	if previous.mode != MODE_R {
+		return
+	}
+	if current.mode == MODE_R && current.tag == previous.tag && current.user == previous.user {
+		return
+	}
+	signRecording(k, previous.tag, previous.user)
+}
+
+// signRecording attests tag once recording into it is over. Nothing is
+// signed without a signing key, or when nothing was recorded.
+func signRecording(k cache.Handler, tag string, userID uint64) {
+	if signingKey == nil {
+		return
+	}
+	attestation, err := cache.SignTag(k, tag, userID, signingKey)
+	if errors.Is(err, cache.ErrNotFound) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to sign %s: %s", tag, err)
+		return
+	}
+	log.Printf("Signed %s: %d entries, root %s", tag, attestation.Entries, attestation.Root)
+}
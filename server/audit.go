@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/emmettmcdow/btrfly/server/cache"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditWorkers = 4
+	maxAuditWorkers     = 32
+	auditTimeout        = 30 * time.Second
+)
+
+// auditReport sorts the entries of a tag by what upstream serves for them
+// today. Only GET and HEAD are fetched again, anything else could have side
+// effects upstream and is Skipped.
+type auditReport struct {
+	Tag         string
+	Unchanged   []auditEntry
+	Changed     []auditEntry
+	Gone        []auditEntry
+	Unreachable []auditEntry
+	Skipped     []auditEntry
+}
+
+type auditOutcome uint8
+
+const (
+	auditUnchanged auditOutcome = iota
+	auditChanged
+	auditGone
+	auditUnreachable
+	auditSkipped
+)
+
+// list returns the list of the report that entries with outcome go in.
+func (r *auditReport) list(outcome auditOutcome) *[]auditEntry {
+	switch outcome {
+	case auditUnchanged:
+		return &r.Unchanged
+	case auditChanged:
+		return &r.Changed
+	case auditGone:
+		return &r.Gone
+	case auditUnreachable:
+		return &r.Unreachable
+	default:
+		return &r.Skipped
+	}
+}
+
+type auditEntry struct {
+	Key string
+	// StatusCode is what upstream answered with now
+	StatusCode int    `json:",omitempty"`
+	Hash       string `json:",omitempty"`
+	Size       int64
+	// UpstreamHash and UpstreamSize describe the body upstream sent now when
+	// it differs from the recording
+	UpstreamHash string `json:",omitempty"`
+	UpstreamSize int64  `json:",omitempty"`
+	Error        string `json:",omitempty"`
+}
+
+// auditTag fetches every entry of tag from upstream again, at most workers at
+// a time, and compares what comes back with the recording. The tag is left
+// as it is.
+func auditTag(k cache.Handler, tag string, userID uint64, httpClient clientSender, workers int) (report auditReport, err error) {
+	artifacts, err := k.ListArtifacts(tag, userID)
+	if err != nil {
+		return report, err
+	}
+	report = auditReport{
+		Tag:         tag,
+		Unchanged:   []auditEntry{},
+		Changed:     []auditEntry{},
+		Gone:        []auditEntry{},
+		Unreachable: []auditEntry{},
+		Skipped:     []auditEntry{},
+	}
+
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	slots := make(chan struct{}, workers)
+	for key, artifact := range artifacts {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(key string, artifact *cache.Artifact) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			outcome, entry := auditEntryOf(key, artifact, httpClient)
+			mu.Lock()
+			defer mu.Unlock()
+			list := report.list(outcome)
+			*list = append(*list, entry)
+		}(key, artifact)
+	}
+	wg.Wait()
+
+	for outcome := auditUnchanged; outcome <= auditSkipped; outcome++ {
+		list := *report.list(outcome)
+		sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	}
+	log.Printf("Audited %s: %d unchanged, %d changed, %d gone, %d unreachable, %d skipped", tag,
+		len(report.Unchanged), len(report.Changed), len(report.Gone), len(report.Unreachable), len(report.Skipped))
+	return report, nil
+}
+
+// auditEntryOf fetches a single entry and compares it with the recording.
+func auditEntryOf(key string, artifact *cache.Artifact, httpClient clientSender) (outcome auditOutcome, entry auditEntry) {
+	entry = auditEntry{Key: key, Hash: artifact.Hash, Size: artifact.Size}
+	upstreamRequest, err := auditRequest(key, artifact)
+	if err != nil {
+		entry.Error = err.Error()
+		return auditSkipped, entry
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	response, err := relayRequest(upstreamRequest.WithContext(ctx), httpClient)
+	if err != nil {
+		entry.Error = err.Error()
+		return auditUnreachable, entry
+	}
+	defer response.Body.Close()
+	entry.StatusCode = response.StatusCode
+
+	recorded := artifact.StatusCode
+	if recorded == 0 {
+		recorded = http.StatusOK
+	}
+	if response.StatusCode >= 400 && recorded < 400 {
+		return auditGone, entry
+	}
+	hash, size, err := cache.Digest(artifact.Algorithm, response.Body)
+	if err != nil {
+		entry.Error = fmt.Sprintf("failed to read body: %s", err)
+		return auditUnreachable, entry
+	}
+	if response.StatusCode == recorded && hash == artifact.Hash && size == artifact.Size {
+		return auditUnchanged, entry
+	}
+	entry.UpstreamHash = hash
+	entry.UpstreamSize = size
+	return auditChanged, entry
+}
+
+// auditRequest rebuilds the upstream request an entry was recorded from.
+func auditRequest(key string, artifact *cache.Artifact) (upstreamRequest *http.Request, err error) {
+	method, URL := cache.SplitKey(key)
+	if method != http.MethodGet && method != http.MethodHead {
+		return nil, fmt.Errorf("%s requests are not fetched again", method)
+	}
+	scheme := "http"
+	if artifact.Metadata != nil && artifact.Metadata.Scheme != "" {
+		scheme = artifact.Metadata.Scheme
+	}
+	upstreamRequest, err = http.NewRequest(method, scheme+"://"+URL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	upstreamRequest.Header = cache.KeyHeaders(key)
+	return upstreamRequest, nil
+}
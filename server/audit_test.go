@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/emmettmcdow/btrfly/server/cache"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuditTag(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		switch r.URL.Path {
+		case "/same", "/same-0", "/same-1", "/same-2", "/same-3":
+			w.Write([]byte("same"))
+		case "/changed":
+			w.Write([]byte("changed upstream"))
+		case "/negotiated":
+			w.Write([]byte(r.Header.Get("Accept")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	// Nothing listens on a closed listener's address
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	k := cache.CreateMemory()
+	k.AddUser(cache.CreateUser())
+	record := func(key string, body string) {
+		artifact := &cache.Artifact{StatusCode: 200, Metadata: &cache.Metadata{Scheme: "http"}}
+		if err := k.AddArtifact(artifact, strings.NewReader(body), key, "audited", 0); err != nil {
+			t.Fatalf("Failed to add artifact: %s", err)
+		}
+	}
+	record("GET "+host+"/same", "same")
+	for _, path := range []string{"/same-0", "/same-1", "/same-2", "/same-3"} {
+		record("GET "+host+path, "same")
+	}
+	record("GET "+host+"/changed", "recorded")
+	record("GET "+host+"/negotiated Accept=text%2Fplain", "text/plain")
+	record("GET "+host+"/gone", "gone")
+	record("GET "+unreachable+"/down", "down")
+	record("POST "+host+"/same body=abc", "same")
+	before, _ := k.ListArtifacts("audited", 0)
+
+	report, err := auditTag(k, "audited", 0, &http.Client{}, 2)
+	if err != nil {
+		t.Fatalf("Failed to audit: %s", err)
+	}
+	keys := func(entries []auditEntry) (keys []string) {
+		keys = []string{}
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		return keys
+	}
+	want := map[string][]string{
+		"unchanged": {
+			"GET " + host + "/negotiated Accept=text%2Fplain",
+			"GET " + host + "/same",
+			"GET " + host + "/same-0",
+			"GET " + host + "/same-1",
+			"GET " + host + "/same-2",
+			"GET " + host + "/same-3",
+		},
+		"changed":     {"GET " + host + "/changed"},
+		"gone":        {"GET " + host + "/gone"},
+		"unreachable": {"GET " + unreachable + "/down"},
+		"skipped":     {"POST " + host + "/same body=abc"},
+	}
+	got := map[string][]string{
+		"unchanged":   keys(report.Unchanged),
+		"changed":     keys(report.Changed),
+		"gone":        keys(report.Gone),
+		"unreachable": keys(report.Unreachable),
+		"skipped":     keys(report.Skipped),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("report:\n    got: %v\n    want: %v", got, want)
+	}
+
+	if len(report.Changed) == 1 {
+		changed := report.Changed[0]
+		if changed.StatusCode != 200 || changed.UpstreamSize != int64(len("changed upstream")) || changed.UpstreamHash == changed.Hash {
+			t.Errorf("changed entry: got %+v", changed)
+		}
+	}
+	if len(report.Gone) == 1 && report.Gone[0].StatusCode != 404 {
+		t.Errorf("gone entry: got status %d, want 404", report.Gone[0].StatusCode)
+	}
+	if len(report.Unreachable) == 1 && report.Unreachable[0].Error == "" {
+		t.Errorf("unreachable entry has no error")
+	}
+	if maxInFlight > 2 {
+		t.Errorf("concurrency: got %d requests at once, want at most 2", maxInFlight)
+	}
+
+	after, _ := k.ListArtifacts("audited", 0)
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("audit modified the tag")
+	}
+	if _, err = auditTag(k, "DNE", 0, &http.Client{}, 2); err == nil {
+		t.Errorf("audit of a missing tag: got no error")
+	}
+}
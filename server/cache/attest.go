@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"github.com/emmettmcdow/btrfly/attest"
+	"os"
+	"strings"
+	"time"
+)
+
+// Attestations themselves are shared with the client, see the attest
+// package.
+type Attestation = attest.Attestation
+
+// ErrTampered is wrapped by errors about tags that no longer match their
+// attestation, or attestations that were not signed by the expected key.
+var ErrTampered = attest.ErrTampered
+
+// SignTag attests the current entries of tag with key, replacing any earlier
+// attestation.
+func SignTag(k Handler, tag string, userID uint64, key ed25519.PrivateKey) (attestation Attestation, err error) {
+	manifest, err := BuildManifest(k, tag, userID)
+	if err != nil {
+		return attestation, err
+	}
+	attestation = attest.Attest(manifest, key, time.Now())
+	if err = k.SetAttestation(tag, &attestation, userID); err != nil {
+		return attestation, err
+	}
+	return attestation, nil
+}
+
+// VerifyTag checks tag, and every tag it inherits from, against its
+// attestation. Tags without one fail with ErrNotFound.
+func VerifyTag(k Handler, tag string, userID uint64, trusted ed25519.PublicKey) (err error) {
+	visited := make(map[string]bool)
+	var verify func(tag string) error
+	verify = func(tag string) (err error) {
+		if visited[tag] {
+			return nil
+		}
+		visited[tag] = true
+		attestation, err := k.Attestation(tag, userID)
+		if err != nil {
+			return err
+		}
+		if attestation == nil {
+			return fmt.Errorf("tag %s has no attestation: %w", tag, ErrNotFound)
+		}
+		manifest, err := BuildManifest(k, tag, userID)
+		if err != nil {
+			return err
+		}
+		if err = attestation.Check(manifest, trusted); err != nil {
+			return err
+		}
+		parents, err := k.Parents(tag, userID)
+		if err != nil {
+			return err
+		}
+		for _, parent := range parents {
+			if err = verify(parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return verify(tag)
+}
+
+// LoadSigningKey reads an ed25519 key from path, either as its 32 byte seed,
+// raw or in 64 hex digits, or as the 64 byte private key.
+func LoadSigningKey(path string) (key ed25519.PrivateKey, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %s", err)
+	}
+	if text := strings.TrimSpace(string(data)); len(text) == 2*ed25519.SeedSize {
+		if seed, err := hex.DecodeString(text); err == nil {
+			return ed25519.NewKeyFromSeed(seed), nil
+		}
+	}
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(data), nil
+	}
+	return nil, fmt.Errorf("signing key in %s has to be a %d byte seed, %d hex digits or a %d byte key",
+		path, ed25519.SeedSize, 2*ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+func (u *User) setAttestation(name string, attestation *Attestation) (err error) {
+	tag, err := u.getTag(name)
+	if err != nil {
+		return err
+	}
+	tag.Attestation = attestation
+	tag.touch()
+	return nil
+}
+
+func (u *User) attestation(name string) (attestation *Attestation, err error) {
+	tag, err := u.getTag(name)
+	if err != nil {
+		return nil, err
+	}
+	return tag.Attestation, nil
+}
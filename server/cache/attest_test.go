@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"github.com/emmettmcdow/btrfly/attest"
+	"testing"
+	"time"
+)
+
+func TestAttestation(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	trusted := key.Public().(ed25519.PublicKey)
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		addArtifact(t, k, "base body", "GET example.com/base", "base")
+		addArtifact(t, k, "project body", "GET example.com/project", "project")
+		if err := k.SetParents("project", []string{"base"}, 0); err != nil {
+			t.Fatalf("Failed to set parents: %s", err)
+		}
+		if err := VerifyTag(k, "project", 0, trusted); !errors.Is(err, ErrNotFound) {
+			t.Errorf("unattested tag: got %v, want ErrNotFound", err)
+		}
+		for _, tag := range []string{"base", "project"} {
+			attestation, err := SignTag(k, tag, 0, key)
+			if err != nil {
+				t.Fatalf("Failed to sign %s: %s", tag, err)
+			}
+			if attestation.Entries != 1 || attestation.PublicKey != hex.EncodeToString(trusted) {
+				t.Errorf("%s: got %+v", tag, attestation)
+			}
+		}
+		if err := VerifyTag(k, "project", 0, trusted); err != nil {
+			t.Errorf("signed tags: %s", err)
+		}
+		if err := VerifyTag(k, "project", 0, other.Public().(ed25519.PublicKey)); !errors.Is(err, ErrTampered) {
+			t.Errorf("another key: got %v, want ErrTampered", err)
+		}
+
+		// Attestations travel with copies and bundles
+		if err := k.CopyTag("project", "copied", 0); err != nil {
+			t.Fatalf("Failed to copy: %s", err)
+		}
+		if err := VerifyTag(k, "copied", 0, trusted); err != nil {
+			t.Errorf("copied tag: %s", err)
+		}
+		bundle := &bytes.Buffer{}
+		if err := ExportTag(k, bundle, "base", 0); err != nil {
+			t.Fatalf("Failed to export: %s", err)
+		}
+		if _, err := ImportTag(k, bytes.NewReader(bundle.Bytes()), "imported", 0); err != nil {
+			t.Fatalf("Failed to import: %s", err)
+		}
+		if err := VerifyTag(k, "imported", 0, trusted); err != nil {
+			t.Errorf("imported tag: %s", err)
+		}
+		tampered := bytes.ReplaceAll(bundle.Bytes(), []byte("example.com/base"), []byte("example.com/bass"))
+		if _, err := ImportTag(k, bytes.NewReader(tampered), "tampered", 0); !errors.Is(err, ErrTampered) {
+			t.Errorf("tampered bundle: got %v, want ErrTampered", err)
+		}
+
+		// Anything recorded after signing shows, in the tag or its parents
+		addArtifact(t, k, "sneaky body", "GET example.com/base", "base")
+		if err := VerifyTag(k, "project", 0, trusted); !errors.Is(err, ErrTampered) {
+			t.Errorf("changed parent: got %v, want ErrTampered", err)
+		}
+		if err := VerifyTag(k, "imported", 0, trusted); err != nil {
+			t.Errorf("imported tag changed along with base: %s", err)
+		}
+
+		// A forged attestation fails on the signature
+		forged := attest.Attest(Manifest{Tag: "base"}, other, time.Now())
+		forged.PublicKey = hex.EncodeToString(trusted)
+		if err := k.SetAttestation("base", &forged, 0); err != nil {
+			t.Fatalf("Failed to set attestation: %s", err)
+		}
+		if err := VerifyTag(k, "base", 0, nil); !errors.Is(err, ErrTampered) {
+			t.Errorf("forged attestation: got %v, want ErrTampered", err)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package cache
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+// A bundle is a tar archive holding a manifest.json describing every entry of
+// a tag, followed by one blobs/<hash> file per distinct body.
+const (
+	bundleManifest = "manifest.json"
+	bundleBlobDir  = "blobs"
+)
+
+type BundleManifest struct {
+	Tag     string
+	Entries []BundleEntry
+	// Parents is only filled in for syncing, bundles leave them behind
+	Parents []string `json:",omitempty"`
+	// Attestation is the tag's signed attestation, if it has one
+	Attestation *Attestation `json:",omitempty"`
+}
+
+type BundleEntry struct {
+	Key        string
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Hash       string
+	Algorithm  string
+	Size       int64
+	Metadata   *Metadata `json:",omitempty"`
+}
+
+// bundleEntry describes the artifact recorded under key.
+func bundleEntry(key string, artifact *Artifact) BundleEntry {
+	method, URL := SplitKey(key)
+	return BundleEntry{
+		Key:        key,
+		Method:     method,
+		URL:        URL,
+		StatusCode: artifact.StatusCode,
+		Header:     artifact.Header,
+		Hash:       artifact.Hash,
+		Algorithm:  artifact.Algorithm,
+		Size:       artifact.Size,
+		Metadata:   artifact.Metadata,
+	}
+}
+
+// Manifest describes the same entries as a Manifest, which is what an
+// attestation is checked against.
+func (b BundleManifest) Manifest() Manifest {
+	manifest := Manifest{Tag: b.Tag, Entries: make([]ManifestEntry, 0, len(b.Entries))}
+	for _, entry := range b.Entries {
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Key:    entry.Key,
+			Method: entry.Method,
+			URL:    entry.URL,
+			Digest: digest(&Artifact{Hash: entry.Hash, Algorithm: entry.Algorithm}),
+			Size:   entry.Size,
+		})
+	}
+	return manifest
+}
+
+// InspectEntry describes what tag plays back for key, including where and
+// when it was recorded.
+func InspectEntry(k Handler, tag string, key string, userID uint64) (entry BundleEntry, err error) {
+	artifact, err := k.GetArtifact(key, tag, userID)
+	if err != nil {
+		return entry, err
+	}
+	return bundleEntry(key, artifact), nil
+}
+
+// sortedKeys returns the keys of a tag's artifacts in order.
+func sortedKeys(artifacts map[string]*Artifact) (keys []string) {
+	keys = make([]string, 0, len(artifacts))
+	for key := range artifacts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ExportTag writes tag as a self-contained bundle to w. Every body is
+// verified against its digest on the way out.
+func ExportTag(k Handler, w io.Writer, tag string, userID uint64) (err error) {
+	artifacts, err := k.ListArtifacts(tag, userID)
+	if err != nil {
+		return err
+	}
+
+	attestation, err := k.Attestation(tag, userID)
+	if err != nil {
+		return err
+	}
+
+	manifest := BundleManifest{Tag: tag, Entries: make([]BundleEntry, 0, len(artifacts)), Attestation: attestation}
+	blobs := make([]*Artifact, 0, len(artifacts))
+	seen := make(map[string]bool)
+	for _, key := range sortedKeys(artifacts) {
+		artifact := artifacts[key]
+		manifest.Entries = append(manifest.Entries, bundleEntry(key, artifact))
+		if !seen[artifact.Hash] {
+			seen[artifact.Hash] = true
+			blobs = append(blobs, artifact)
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{Name: bundleManifest, Mode: 0o644, Size: int64(len(data)), ModTime: now})
+	if err != nil {
+		return fmt.Errorf("failed to write manifest header: %s", err)
+	}
+	if _, err = tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write manifest: %s", err)
+	}
+	for _, artifact := range blobs {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    path.Join(bundleBlobDir, artifact.Hash),
+			Mode:    0o644,
+			Size:    artifact.Size,
+			ModTime: now,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write header for %s: %s", artifact.Hash, err)
+		}
+		if _, err = artifact.WriteTo(tw); err != nil {
+			return fmt.Errorf("failed to write blob %s: %s", artifact.Hash, err)
+		}
+	}
+	return tw.Close()
+}
+
+// ImportTag loads a bundle written by ExportTag into k. The entries go into
+// tag, or into the tag named by the bundle when tag is empty, which must not
+// exist yet. Nothing is left behind when the import fails.
+func ImportTag(k Handler, r io.Reader, tag string, userID uint64) (imported string, err error) {
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return "", fmt.Errorf("failed to read bundle: %s", err)
+	}
+	if header.Name != bundleManifest {
+		return "", fmt.Errorf("bundle starts with %s, want %s", header.Name, bundleManifest)
+	}
+	manifest := BundleManifest{}
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return "", fmt.Errorf("failed to decode manifest: %s", err)
+	}
+	if tag == "" {
+		tag = manifest.Tag
+	}
+	if err = checkNewTag(k, tag, userID); err != nil {
+		return "", err
+	}
+	// A bundle whose entries were changed after signing is refused outright,
+	// the blobs are checked against the entries below
+	if manifest.Attestation != nil {
+		if err = manifest.Attestation.Check(manifest.Manifest(), nil); err != nil {
+			return "", err
+		}
+	}
+
+	// Entries are staged out of sight and only show up in tag once all of
+	// them are in
+	staging := scratchTag("importing", tag)
+	defer func() {
+		if err != nil {
+			if cleanupErr := k.DeleteTag(staging, userID); cleanupErr != nil && !errors.Is(cleanupErr, ErrNotFound) {
+				err = fmt.Errorf("%s (and failed to clean up: %s)", err, cleanupErr)
+			}
+		}
+	}()
+
+	byHash := make(map[string][]BundleEntry)
+	for _, entry := range manifest.Entries {
+		byHash[entry.Hash] = append(byHash[entry.Hash], entry)
+	}
+	for {
+		header, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("failed to read bundle: %s", err)
+		}
+		hash := path.Base(header.Name)
+		entries, ok := byHash[hash]
+		if !ok || path.Dir(header.Name) != bundleBlobDir {
+			return "", fmt.Errorf("bundle holds %s which no entry references", header.Name)
+		}
+		delete(byHash, hash)
+		if err = importBlob(k, tr, entries, staging, userID); err != nil {
+			return "", err
+		}
+	}
+	if len(byHash) > 0 {
+		missing := make([]string, 0, len(byHash))
+		for hash := range byHash {
+			missing = append(missing, hash)
+		}
+		sort.Strings(missing)
+		return "", fmt.Errorf("bundle is missing blobs %v", missing)
+	}
+	if err = publishStaged(k, staging, tag, nil, manifest.Attestation, userID); err != nil {
+		return "", err
+	}
+	return tag, nil
+}
+
+// publishStaged gives the staged entries parents and attestation and swaps
+// them in for those of tag. It also creates staged when nothing was staged.
+// An attestation the staged entries do not match is dropped, which happens
+// when bodies exported with an older hash were hashed again.
+func publishStaged(k Handler, staged string, tag string, parents []string, attestation *Attestation, userID uint64) (err error) {
+	if err = k.SetParents(staged, parents, userID); err != nil {
+		return err
+	}
+	if attestation != nil {
+		manifest, err := BuildManifest(k, staged, userID)
+		if err != nil {
+			return err
+		}
+		if err = attestation.Check(manifest, nil); err != nil {
+			log.Printf("Not keeping the attestation of %s: %s", tag, err)
+			attestation = nil
+		}
+	}
+	if err = k.SetAttestation(staged, attestation, userID); err != nil {
+		return err
+	}
+	return k.ReplaceTag(staged, tag, userID)
+}
+
+func checkNewTag(k Handler, tag string, userID uint64) (err error) {
+	if tag == "" {
+		return errors.New("no tag to import into")
+	}
+	tags, err := k.ListTags(userID)
+	if err != nil {
+		return err
+	}
+	for _, existing := range tags {
+		if existing == tag {
+			return fmt.Errorf("tag %s: %w", tag, ErrExists)
+		}
+	}
+	return nil
+}
+
+// importBlob stores body once and points every entry sharing it at the result.
+func importBlob(k Handler, body io.Reader, entries []BundleEntry, tag string, userID uint64) (err error) {
+	first := entries[0]
+	stored := &Artifact{StatusCode: first.StatusCode, Header: first.Header, Metadata: first.Metadata}
+	if err = k.AddArtifact(stored, body, first.Key, tag, userID); err != nil {
+		return err
+	}
+	if err = checkDigest(stored, first.Hash, first.Algorithm, first.Size); err != nil {
+		return err
+	}
+	for _, entry := range entries[1:] {
+		artifact := *stored
+		artifact.StatusCode = entry.StatusCode
+		artifact.Header = entry.Header
+		artifact.Metadata = entry.Metadata
+		if err = k.TagArtifact(&artifact, tag, entry.Key, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDigest compares a freshly stored artifact with the digest it was
+// exported under. Digests in a different algorithm can only be size checked.
+func checkDigest(stored *Artifact, hash string, algorithm string, size int64) (err error) {
+	if stored.Size != size {
+		return fmt.Errorf("%w: %s is %d bytes, want %d", ErrCorrupt, hash, stored.Size, size)
+	}
+	if algorithm == stored.Algorithm && hash != stored.Hash {
+		return fmt.Errorf("%w: %s hashes to %s", ErrCorrupt, hash, stored.Hash)
+	}
+	return nil
+}
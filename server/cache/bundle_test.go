@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	src := CreateMemory()
+	src.AddUser(CreateUser())
+	index := &Artifact{StatusCode: 200, Header: http.Header{"Content-Type": {"text/html"}}}
+	index.Metadata = NewMetadata(index.Header)
+	index.Metadata.Session = "nightly"
+	if err := src.AddArtifact(index, bytes.NewReader([]byte("<a href=pkg.tgz>")), "GET example.com/", "build", 0); err != nil {
+		t.Fatalf("Failed to add artifact: %s", err)
+	}
+	addArtifact(t, src, "tarball", "GET example.com/pkg.tgz", "build")
+	addArtifact(t, src, "tarball", "GET mirror.example.com/pkg.tgz", "build")
+	want, err := src.ListArtifacts("build", 0)
+	if err != nil {
+		t.Fatalf("Failed to list artifacts: %s", err)
+	}
+
+	bundle := &bytes.Buffer{}
+	if err = ExportTag(src, bundle, "build", 0); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+
+	forEachHandler(t, func(t *testing.T, dst Handler) {
+		for _, tc := range []struct{ tag, want string }{{"", "build"}, {"air-gapped", "air-gapped"}} {
+			imported, err := ImportTag(dst, bytes.NewReader(bundle.Bytes()), tc.tag, 0)
+			if err != nil {
+				t.Fatalf("Failed to import: %s", err)
+			}
+			if imported != tc.want {
+				t.Errorf("imported: got %s, want %s", imported, tc.want)
+			}
+			got, err := dst.ListArtifacts(imported, 0)
+			if err != nil {
+				t.Fatalf("Failed to list artifacts: %s", err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("entries: got %d, want %d", len(got), len(want))
+			}
+			for key, artifact := range want {
+				g, ok := got[key]
+				if !ok {
+					t.Errorf("Missing %s", key)
+					continue
+				}
+				if !g.Equal(artifact) || g.StatusCode != artifact.StatusCode || !reflect.DeepEqual(g.Header, artifact.Header) ||
+					!reflect.DeepEqual(g.Metadata, artifact.Metadata) {
+					t.Errorf("%s: got %+v, want %+v", key, g, artifact)
+				}
+				if readArtifact(t, g) != readArtifact(t, artifact) {
+					t.Errorf("%s: bodies differ", key)
+				}
+			}
+		}
+
+		if _, err := ImportTag(dst, bytes.NewReader(bundle.Bytes()), "", 0); !errors.Is(err, ErrExists) {
+			t.Errorf("Importing over an existing tag: got %v, want %v", err, ErrExists)
+		}
+	})
+}
+
+func TestBundleRejectsTampering(t *testing.T) {
+	src := CreateMemory()
+	src.AddUser(CreateUser())
+	addArtifact(t, src, "genuine", "GET example.com/a", "build")
+	addArtifact(t, src, "also genuine", "GET example.com/b", "build")
+	bundle := &bytes.Buffer{}
+	if err := ExportTag(src, bundle, "build", 0); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+
+	// Rewrite the bundle with the same layout but different bytes
+	tampered := &bytes.Buffer{}
+	tr := tar.NewReader(bytes.NewReader(bundle.Bytes()))
+	tw := tar.NewWriter(tampered)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read bundle: %s", err)
+		}
+		data, _ := io.ReadAll(tr)
+		data = bytes.Replace(data, []byte("genuine"), []byte("GENUINE"), 1)
+		if err = tw.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write bundle: %s", err)
+		}
+		tw.Write(data)
+	}
+	tw.Close()
+
+	forEachHandler(t, func(t *testing.T, dst Handler) {
+		if _, err := ImportTag(dst, bytes.NewReader(tampered.Bytes()), "", 0); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("err: got %v, want %v", err, ErrCorrupt)
+		}
+		tags, _ := dst.ListTags(0)
+		if len(tags) != 0 {
+			t.Errorf("tags: got %v after a failed import, want none", tags)
+		}
+	})
+}
+
+func TestBundleRehashedAttestation(t *testing.T) {
+	// A store from before sha256 recorded with md5
+	src := CreateMemory()
+	src.AddUser(CreateUser())
+	addArtifact(t, src, "old body", "GET example.com/old", "old")
+	artifacts := src.Users[0].Tags["old"].Artifacts
+	legacy := *artifacts["GET example.com/old"]
+	sum := md5.Sum([]byte("old body"))
+	legacy.Hash, legacy.Algorithm = hex.EncodeToString(sum[:]), ""
+	artifacts["GET example.com/old"] = &legacy
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	if _, err := SignTag(src, "old", 0, key); err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+	bundle := &bytes.Buffer{}
+	if err := ExportTag(src, bundle, "old", 0); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+
+	forEachHandler(t, func(t *testing.T, dst Handler) {
+		if _, err := ImportTag(dst, bytes.NewReader(bundle.Bytes()), "", 0); err != nil {
+			t.Fatalf("Failed to import: %s", err)
+		}
+		// The body is hashed with sha256 now, which the md5 attestation
+		// cannot vouch for
+		if attestation, err := dst.Attestation("old", 0); err != nil || attestation != nil {
+			t.Errorf("attestation: got %+v (%v), want none", attestation, err)
+		}
+		if artifact, err := dst.GetArtifact("GET example.com/old", "old", 0); err != nil || readArtifact(t, artifact) != "old body" {
+			t.Errorf("imported entry: %v", err)
+		}
+	})
+}
@@ -1,55 +1,330 @@
 package cache
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"time"
 )
 
+// Artifact describes a recorded response. The bytes of the body stay in the
+// Handler's storage and are streamed out through Open or WriteTo.
 type Artifact struct {
 	Hash string
-	Data []byte
+	// Algorithm is the hash function Hash was computed with. Artifacts
+	// recorded before it existed leave it empty and use md5.
+	Algorithm string `json:",omitempty"`
+	Size      int64
+
+	// StatusCode and Header are what upstream answered with when the artifact
+	// was recorded. A zero StatusCode means 200.
+	StatusCode int
+	Header     http.Header
+
+	// Metadata says where and when the artifact was recorded. Artifacts
+	// recorded before it existed have none.
+	Metadata *Metadata `json:",omitempty"`
+
+	open func() (io.ReadCloser, error)
+}
+
+type Metadata struct {
+	RecordedAt time.Time
+	// RevalidatedAt is the last time upstream confirmed the body had not
+	// changed while recording
+	RevalidatedAt *time.Time `json:",omitempty"`
+	// User recorded the artifact while Session was the active tag
+	User    uint64
+	Session string
+	// Scheme and Host are the upstream it was fetched from, FinalURL is where
+	// that ended up after following redirects
+	Scheme   string
+	Host     string
+	FinalURL string
+	// ContentType, ETag and LastModified are copied from the response
+	ContentType  string `json:",omitempty"`
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+}
+
+// NewMetadata starts the metadata of a response recorded now.
+func NewMetadata(header http.Header) (meta *Metadata) {
+	return &Metadata{
+		RecordedAt:   time.Now().UTC(),
+		ContentType:  header.Get("Content-Type"),
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+}
+
+func (m *Metadata) clone() *Metadata {
+	if m == nil {
+		return nil
+	}
+	copied := *m
+	return &copied
 }
 
 type Tag struct {
 	// Name string
 	Artifacts map[string]*Artifact
+	// Parents are searched in order, each with its own parents, when a key
+	// is not in Artifacts. Recording only ever writes to Artifacts.
+	Parents []string `json:",omitempty"`
+	// Pinned tags are never reaped, see retention.go
+	Pinned bool `json:",omitempty"`
+	// RecordedAt and PlayedAt are the last time the tag was recorded into and
+	// played back from. Tags from before they existed have neither.
+	RecordedAt time.Time
+	PlayedAt   time.Time
+	// Attestation vouches for the entries, see attest.go
+	Attestation *Attestation `json:",omitempty"`
+
+	// version is the value of tagChanges when the tag last changed
+	version uint64
 }
 
 type User struct {
 	ID   uint64
 	Tags map[string]*Tag
+
+	// latest remembers which tag has the most recent recording of a request
+	// key, see revalidate.go. It is rebuilt as needed and never persisted.
+	latest map[string]string
 }
 
+// Handler is a store of artifacts. Proxy handlers and the controller share
+// one, so every implementation has to be safe for concurrent use.
 type Handler interface {
+	// GetArtifact falls back through the tag's parents when the tag itself
+	// has no entry for url.
 	GetArtifact(url string, id string, userID uint64) (artifact *Artifact, err error)
-	AddArtifact(artifact *Artifact, url string, id string, userID uint64) (err error)
-	TagArtifact(artifact *Artifact, tag string, URL string, userID uint64)
+	// LatestArtifact returns the most recently recorded entry for url in any
+	// of the user's tags.
+	LatestArtifact(url string, userID uint64) (artifact *Artifact, err error)
+	// AddArtifact consumes body, stores it as the content of artifact and fills
+	// in the artifact's Hash and Size.
+	AddArtifact(artifact *Artifact, body io.Reader, url string, id string, userID uint64) (err error)
+	TagArtifact(artifact *Artifact, tag string, URL string, userID uint64) (err error)
 	AddUser(user *User)
+
+	// ListTags returns the names of the user's tags in sorted order.
+	ListTags(userID uint64) (tags []string, err error)
+	// ListArtifacts returns the artifacts of a tag keyed by request key,
+	// leaving out whatever it inherits from its parents.
+	ListArtifacts(tag string, userID uint64) (artifacts map[string]*Artifact, err error)
+	DeleteTag(tag string, userID uint64) (err error)
+	// CopyTag and RenameTag refuse to overwrite an existing dst.
+	CopyTag(src string, dst string, userID uint64) (err error)
+	RenameTag(src string, dst string, userID uint64) (err error)
+	// ReplaceTag gives dst the entries, parents and attestation of src in
+	// one step, creating dst if needed, and deletes src. Whether dst is
+	// pinned and when it was played stay.
+	ReplaceTag(src string, dst string, userID uint64) (err error)
+	// SetParents layers tag on top of parents, creating tag if needed. The
+	// parents have to exist and may not lead back to tag.
+	SetParents(tag string, parents []string, userID uint64) (err error)
+	Parents(tag string, userID uint64) (parents []string, err error)
+	// SetPinned pins or unpins tag, pinned tags are exempt from retention.
+	SetPinned(tag string, pinned bool, userID uint64) (err error)
+	Pinned(tag string, userID uint64) (pinned bool, err error)
+	// SetAttestation stores a signed attestation of tag, or drops it when
+	// attestation is nil. Attestation returns nil for unattested tags.
+	SetAttestation(tag string, attestation *Attestation, userID uint64) (err error)
+	Attestation(tag string, userID uint64) (attestation *Attestation, err error)
+	// Version changes whenever the entries, parents or attestation of tag or
+	// any tag it inherits from do, so whatever was worked out from them can
+	// be kept until then.
+	Version(tag string, userID uint64) (version uint64, err error)
+	// Played notes that tag (and whatever it inherits from) was played back
+	// from now.
+	Played(tag string, userID uint64)
+	// Reap deletes the tags of every user that policy no longer keeps.
+	Reap(policy RetentionPolicy, now time.Time) (reaped []Reaped, err error)
+
+	// GC reclaims the storage of artifacts no tag references anymore and
+	// reports how many bytes it freed.
+	GC() (freed int64, err error)
+	Stats() (stats Stats, err error)
+	TagStats(tag string, userID uint64) (stats TagStats, err error)
+}
+
+type Stats struct {
+	// Entries counts the artifacts in every tag of every user
+	Entries int
+	// Blobs counts the bodies actually kept in storage
+	Blobs int
+	// LogicalSize is how much storage the entries would take without
+	// deduplication, UniqueSize how much their distinct bodies take.
+	LogicalSize int64
+	UniqueSize  int64
+	// StoredSize is what the storage really holds, including blobs that are
+	// waiting for GC
+	StoredSize int64
+	// DedupRatio is LogicalSize / UniqueSize
+	DedupRatio float64
+	// CompressedBlobs counts the referenced blobs stored compressed and
+	// CompressionRatio is how many times smaller they got
+	CompressedBlobs  int
+	CompressionRatio float64
+	// Chunks counts the stored chunks of chunked bodies
+	Chunks int
+}
+
+// TagStats reports how much a single tag gains from deduplication down to
+// the level of chunks. A body that is not chunked counts as one chunk.
+type TagStats struct {
+	Entries int
+	// LogicalSize is what the tag's entries add up to
+	LogicalSize int64
+	// Chunks and ChunkedSize describe the distinct chunks the entries are
+	// made of
+	Chunks      int
+	ChunkedSize int64
+	// SharedSize is the part of ChunkedSize other tags are made of as well
+	SharedSize int64
+	// SavedSize is LogicalSize minus what only this tag needs stored
+	SavedSize int64
 }
 
+// ErrCorrupt is wrapped by read errors when stored bytes no longer match the
+// artifact's digest.
+var ErrCorrupt = errors.New("artifact is corrupt")
+
+// DefaultAlgorithm is used to hash every newly stored artifact.
+const DefaultAlgorithm = "sha256"
+
 func (a *Artifact) Equal(b *Artifact) bool {
-	if a.Hash != b.Hash {
-		return false
+	return a.Hash == b.Hash && a.Size == b.Size
+}
+
+// Open returns a reader over the body of the artifact. The body is checked
+// against the artifact's digest as it is read: instead of the final chunk of
+// a corrupt body, the reader returns an error wrapping ErrCorrupt. The caller
+// must close it.
+func (a *Artifact) Open() (body io.ReadCloser, err error) {
+	if a.open == nil {
+		return nil, errors.New("artifact has no stored body")
+	}
+	h, err := newHash(a.Algorithm)
+	if err != nil {
+		return nil, err
 	}
-	return bytes.Equal(a.Data, b.Data)
+	body, err = a.open()
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{body: body, r: bufio.NewReader(body), hash: h, artifact: a}, nil
+}
+
+// WriteTo streams the body of the artifact into w.
+func (a *Artifact) WriteTo(w io.Writer) (n int64, err error) {
+	body, err := a.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	return io.Copy(w, body)
+}
+
+func newHash(algorithm string) (h hash.Hash, err error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "", "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm %s", algorithm)
+	}
+}
+
+// Digest hashes body the way the bodies of artifacts using algorithm are
+// hashed, so it can be compared with their Hash and Size.
+func Digest(algorithm string, body io.Reader) (hash string, size int64, err error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", 0, err
+	}
+	if size, err = io.Copy(h, body); err != nil {
+		return "", size, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// verifyingReader hashes a body as it is read and checks it against the
+// artifact before handing out the last chunk.
+type verifyingReader struct {
+	body     io.Closer
+	r        *bufio.Reader
+	hash     hash.Hash
+	size     int64
+	artifact *Artifact
 }
 
-func (a *Artifact) Write(p []byte) (n int, err error) {
+func (v *verifyingReader) Read(p []byte) (n int, err error) {
+	n, err = v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.size += int64(n)
+	if err == io.EOF {
+		if verr := v.verify(); verr != nil {
+			return n, verr
+		}
+		return n, io.EOF
+	} else if err != nil {
+		return n, err
+	}
+	if _, peekErr := v.r.Peek(1); peekErr == io.EOF {
+		if err = v.verify(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
 
-	n = len(p)
-	if a.Data == nil {
-		a.Data = make([]byte, n)
+func (v *verifyingReader) verify() (err error) {
+	if v.size != v.artifact.Size {
+		return fmt.Errorf("%w: %s is %d bytes, want %d", ErrCorrupt, v.artifact.Hash, v.size, v.artifact.Size)
+	}
+	if got := hex.EncodeToString(v.hash.Sum(nil)); got != v.artifact.Hash {
+		return fmt.Errorf("%w: %s hashes to %s", ErrCorrupt, v.artifact.Hash, got)
 	}
+	return nil
+}
 
-	copy(a.Data, p)
+func (v *verifyingReader) Close() (err error) {
+	return v.body.Close()
+}
+
+// hashingWriter tracks the hash and size of everything written to it.
+type hashingWriter struct {
+	hash hash.Hash
+	size int64
+}
 
-	hash := md5.Sum(a.Data)
-	a.Hash = hex.EncodeToString(hash[:])
+func newHashingWriter() (h *hashingWriter) {
+	// DefaultAlgorithm is always known
+	digest, _ := newHash(DefaultAlgorithm)
+	return &hashingWriter{hash: digest}
+}
 
+func (h *hashingWriter) Write(p []byte) (n int, err error) {
+	n, err = h.hash.Write(p)
+	h.size += int64(n)
 	return n, err
 }
 
+func (h *hashingWriter) sum(artifact *Artifact) {
+	artifact.Hash = hex.EncodeToString(h.hash.Sum(nil))
+	artifact.Algorithm = DefaultAlgorithm
+	artifact.Size = h.size
+}
+
 func CreateUser() (user *User) {
 	// TODO: for now we only have an id of 0
 	id := uint64(0)
@@ -0,0 +1,345 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forEachHandler runs test against a fresh instance of every Handler, each
+// with user 0 already added.
+func forEachHandler(t *testing.T, test func(t *testing.T, k Handler)) {
+	t.Run("memory", func(t *testing.T) {
+		k := CreateMemory()
+		k.AddUser(CreateUser())
+		test(t, k)
+	})
+	t.Run("disk", func(t *testing.T) {
+		k, err := CreateDisk(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create disk store: %s", err)
+		}
+		k.AddUser(CreateUser())
+		test(t, k)
+	})
+}
+
+func addArtifact(t *testing.T, k Handler, body string, key string, tag string) (artifact *Artifact) {
+	artifact = &Artifact{}
+	if err := k.AddArtifact(artifact, strings.NewReader(body), key, tag, 0); err != nil {
+		t.Fatalf("Failed to add artifact: %s", err)
+	}
+	return artifact
+}
+
+func TestGC(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		shared := addArtifact(t, k, "shared", "GET example.com/shared", "tag1")
+		k.TagArtifact(shared, "tag2", "GET example.com/shared", 0)
+		addArtifact(t, k, "only in tag1", "GET example.com/a", "tag1")
+		addArtifact(t, k, "overwritten", "GET example.com/b", "tag2")
+		addArtifact(t, k, "overwriter", "GET example.com/b", "tag2")
+
+		steps := []struct {
+			name      string
+			do        func() error
+			wantFreed int64
+		}{
+			{"nothing to do", func() error { return nil }, int64(len("overwritten"))},
+			{"shared blob survives", func() error { return k.DeleteTag("tag1", 0) }, int64(len("only in tag1"))},
+			{"last reference", func() error { return k.DeleteTag("tag2", 0) }, int64(len("shared") + len("overwriter"))},
+			{"empty", func() error { return nil }, 0},
+		}
+		for _, step := range steps {
+			if err := step.do(); err != nil {
+				t.Fatalf("%s: %s", step.name, err)
+			}
+			freed, err := k.GC()
+			if err != nil {
+				t.Fatalf("%s: failed to GC: %s", step.name, err)
+			}
+			if freed != step.wantFreed {
+				t.Errorf("%s: freed %d, want %d", step.name, freed, step.wantFreed)
+			}
+		}
+	})
+}
+
+func TestDedupStats(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		iso := strings.Repeat("iso", 100)
+		for _, tag := range []string{"mon", "tue", "wed", "thu", "fri"} {
+			addArtifact(t, k, iso, "GET example.com/rocky.iso", tag)
+			addArtifact(t, k, iso, "GET mirror.example.com/rocky.iso", tag)
+			addArtifact(t, k, "index of "+tag, "GET example.com/", tag)
+		}
+
+		stats, err := k.Stats()
+		if err != nil {
+			t.Fatalf("Failed to get stats: %s", err)
+		}
+		want := Stats{
+			Entries:     15,
+			Blobs:       6,
+			LogicalSize: 10*300 + 5*12,
+			UniqueSize:  300 + 5*12,
+			StoredSize:  300 + 5*12,
+			DedupRatio:  float64(10*300+5*12) / float64(300+5*12),
+		}
+		if stats != want {
+			t.Errorf("stats:\n    got: %+v\n    want: %+v", stats, want)
+		}
+	})
+}
+
+func TestLayeredTags(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		addArtifact(t, k, "base glibc", "GET example.com/glibc", "base")
+		addArtifact(t, k, "base openssl", "GET example.com/openssl", "base")
+		addArtifact(t, k, "tools make", "GET example.com/make", "tools")
+		addArtifact(t, k, "tools openssl", "GET example.com/openssl", "tools")
+		if err := k.SetParents("project", []string{"tools", "base"}, 0); err != nil {
+			t.Fatalf("Failed to set parents: %s", err)
+		}
+		// Recording into the child leaves the layers below alone
+		addArtifact(t, k, "project glibc", "GET example.com/glibc", "project")
+
+		lookups := []struct {
+			key  string
+			want string
+		}{
+			{"GET example.com/glibc", "project glibc"},
+			{"GET example.com/openssl", "tools openssl"},
+			{"GET example.com/make", "tools make"},
+		}
+		for _, lookup := range lookups {
+			artifact, err := k.GetArtifact(lookup.key, "project", 0)
+			if err != nil {
+				t.Errorf("Failed to get %s: %s", lookup.key, err)
+				continue
+			}
+			if got := readArtifact(t, artifact); got != lookup.want {
+				t.Errorf("%s: got %q, want %q", lookup.key, got, lookup.want)
+			}
+		}
+		if _, err := k.GetArtifact("GET example.com/DNE", "project", 0); err == nil {
+			t.Errorf("Got an artifact no layer has")
+		}
+		if artifact, _ := k.GetArtifact("GET example.com/glibc", "base", 0); readArtifact(t, artifact) != "base glibc" {
+			t.Errorf("Recording into the child changed its parent")
+		}
+		if artifacts, _ := k.ListArtifacts("project", 0); len(artifacts) != 1 {
+			t.Errorf("ListArtifacts: got %d entries, want only the child's own", len(artifacts))
+		}
+
+		if err := k.SetParents("base", []string{"project"}, 0); !errors.Is(err, ErrCycle) {
+			t.Errorf("tag as its own grandparent: got %v, want ErrCycle", err)
+		}
+		if err := k.SetParents("project", []string{"DNE"}, 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("parent that does not exist: got %v, want ErrNotFound", err)
+		}
+		if err := k.RenameTag("tools", "toolchain", 0); err != nil {
+			t.Fatalf("Failed to rename: %s", err)
+		}
+		// A parent cannot be deleted from under its children
+		if err := k.DeleteTag("base", 0); !errors.Is(err, ErrHasChildren) || !strings.Contains(err.Error(), "project") {
+			t.Errorf("deleting a parent: got %v, want ErrHasChildren naming project", err)
+		}
+		parents, err := k.Parents("project", 0)
+		if err != nil || !reflect.DeepEqual(parents, []string{"toolchain", "base"}) {
+			t.Errorf("parents after rename: got %v (%v), want [toolchain base]", parents, err)
+		}
+		if err = k.SetParents("project", []string{"toolchain"}, 0); err != nil {
+			t.Fatalf("Failed to set parents: %s", err)
+		}
+		if err = k.DeleteTag("base", 0); err != nil {
+			t.Errorf("Failed to delete a tag nothing is layered on: %s", err)
+		}
+	})
+}
+
+func TestTagStats(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		addArtifact(t, k, "shared", "GET example.com/shared", "a")
+		addArtifact(t, k, "only in a", "GET example.com/a", "a")
+		addArtifact(t, k, "only in a", "GET example.com/a-again", "a")
+		addArtifact(t, k, "shared", "GET example.com/shared", "b")
+
+		stats, err := k.TagStats("a", 0)
+		if err != nil {
+			t.Fatalf("Failed to get tag stats: %s", err)
+		}
+		want := TagStats{
+			Entries:     3,
+			LogicalSize: 6 + 9 + 9,
+			Chunks:      2,
+			ChunkedSize: 6 + 9,
+			SharedSize:  6,
+			SavedSize:   6 + 9,
+		}
+		if stats != want {
+			t.Errorf("stats:\n    got: %+v\n    want: %+v", stats, want)
+		}
+		if _, err = k.TagStats("DNE", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("missing tag: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestConcurrentUse(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		const workers = 8
+		const keys = 20
+		body := func(i int) string { return fmt.Sprintf("body of %d", i) }
+		wg := &sync.WaitGroup{}
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				tag := fmt.Sprintf("tag%d", w%2)
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprintf("GET example.com/%d", i)
+					artifact := &Artifact{}
+					if err := k.AddArtifact(artifact, strings.NewReader(body(i)), key, tag, 0); err != nil {
+						t.Errorf("Failed to add %s: %s", key, err)
+						return
+					}
+					k.TagArtifact(artifact, fmt.Sprintf("worker%d", w), key, 0)
+					if got, err := k.GetArtifact(key, tag, 0); err != nil {
+						t.Errorf("Failed to get %s: %s", key, err)
+					} else if data := readArtifact(t, got); data != body(i) {
+						t.Errorf("%s: got %q, want %q", key, data, body(i))
+					}
+					k.ListTags(0)
+					k.ListArtifacts(tag, 0)
+					k.Stats()
+					k.TagStats(tag, 0)
+					k.CopyTag(tag, fmt.Sprintf("copy%d", w), 0)
+					if i%5 == 0 {
+						k.DeleteTag(fmt.Sprintf("copy%d", w), 0)
+						if _, err := k.GC(); err != nil {
+							t.Errorf("Failed to GC: %s", err)
+						}
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for w := 0; w < workers; w++ {
+			artifacts, err := k.ListArtifacts(fmt.Sprintf("worker%d", w), 0)
+			if err != nil || len(artifacts) != keys {
+				t.Errorf("worker%d: got %d entries (%v), want %d", w, len(artifacts), err, keys)
+			}
+		}
+	})
+}
+
+func TestLatest(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		record := func(body string, tag string, recordedAt time.Time) {
+			artifact := &Artifact{Header: http.Header{"Etag": {`"` + body + `"`}}}
+			artifact.Metadata = NewMetadata(artifact.Header)
+			artifact.Metadata.RecordedAt = recordedAt
+			if err := k.AddArtifact(artifact, strings.NewReader(body), "GET example.com/a", tag, 0); err != nil {
+				t.Fatalf("Failed to add artifact: %s", err)
+			}
+		}
+		monday := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+		record("mon", "mon", monday)
+		record("wed", "wed", monday.AddDate(0, 0, 2))
+		record("tue", "tue", monday.AddDate(0, 0, 1))
+		addArtifact(t, k, "other", "GET example.com/b", "thu")
+
+		lookups := []struct {
+			tag      string
+			wantETag string
+		}{
+			{"mon", `"mon"`},
+			{"thu", `"wed"`},
+			{"DNE", `"wed"`},
+		}
+		for _, lookup := range lookups {
+			artifact, err := Latest(k, "GET example.com/a", lookup.tag, 0)
+			if err != nil {
+				t.Errorf("%s: failed to find the latest: %s", lookup.tag, err)
+				continue
+			}
+			if etag, _ := artifact.Validators(); etag != lookup.wantETag {
+				t.Errorf("%s: got ETag %s, want %s", lookup.tag, etag, lookup.wantETag)
+			}
+		}
+
+		// The index follows newer recordings and tags that go away
+		record("fri", "fri", monday.AddDate(0, 0, 4))
+		if artifact, err := Latest(k, "GET example.com/a", "DNE", 0); err != nil {
+			t.Errorf("after fri: %s", err)
+		} else if etag, _ := artifact.Validators(); etag != `"fri"` {
+			t.Errorf("after fri: got ETag %s, want \"fri\"", etag)
+		}
+		for _, tag := range []string{"fri", "wed"} {
+			if err := k.DeleteTag(tag, 0); err != nil {
+				t.Fatalf("Failed to delete %s: %s", tag, err)
+			}
+		}
+		if artifact, err := Latest(k, "GET example.com/a", "DNE", 0); err != nil {
+			t.Errorf("after deleting: %s", err)
+		} else if etag, _ := artifact.Validators(); etag != `"tue"` {
+			t.Errorf("after deleting: got ETag %s, want \"tue\"", etag)
+		}
+		if _, err := Latest(k, "GET example.com/DNE", "mon", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("key nobody recorded: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestVersion(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		addArtifact(t, k, "base body", "GET example.com/base", "base")
+		addArtifact(t, k, "project body", "GET example.com/project", "project")
+		addArtifact(t, k, "other body", "GET example.com/other", "other")
+		if err := k.SetParents("project", []string{"base"}, 0); err != nil {
+			t.Fatalf("Failed to set parents: %s", err)
+		}
+		version := func() uint64 {
+			version, err := k.Version("project", 0)
+			if err != nil {
+				t.Fatalf("Failed to get the version: %s", err)
+			}
+			return version
+		}
+
+		last := version()
+		steps := []struct {
+			name        string
+			change      func()
+			wantChanged bool
+		}{
+			{"nothing", func() {}, false},
+			{"reading", func() { k.GetArtifact("GET example.com/base", "project", 0) }, false},
+			{"playing", func() { k.Played("project", 0) }, false},
+			{"another tag", func() { addArtifact(t, k, "more", "GET example.com/more", "other") }, false},
+			{"an entry", func() { addArtifact(t, k, "new body", "GET example.com/project", "project") }, true},
+			{"a parent's entry", func() { addArtifact(t, k, "new body", "GET example.com/base", "base") }, true},
+			{"the attestation", func() { k.SetAttestation("project", &Attestation{Tag: "project"}, 0) }, true},
+			{"the parents", func() { k.SetParents("project", []string{"base", "other"}, 0) }, true},
+			{"a new parent's entry", func() { addArtifact(t, k, "even more", "GET example.com/more", "other") }, true},
+			{"renaming a parent", func() { k.RenameTag("other", "renamed", 0) }, true},
+		}
+		for _, step := range steps {
+			step.change()
+			if changed := version() != last; changed != step.wantChanged {
+				t.Errorf("%s: changed %t, want %t", step.name, changed, step.wantChanged)
+			}
+			last = version()
+		}
+		if _, err := k.Version("DNE", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("missing tag: got %v, want ErrNotFound", err)
+		}
+	})
+}
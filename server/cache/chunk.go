@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// With Disk.Chunking on, bodies of at least chunkThreshold bytes are split
+// into content-defined chunks: a gear rolling hash runs over the bytes and a
+// chunk ends wherever its top chunkAvgBits bits are zero, bounded by
+// chunkMinSize and chunkMaxSize. An insertion or deletion only moves the
+// boundaries around it, so the next nightly ISO shares most of its chunks with
+// the last one. Every chunk is stored once under <Root>/chunks by its sha256,
+// and the blob itself becomes a list of chunks with chunkedSuffix on its name.
+const (
+	chunkThreshold = 1 << 20
+	chunkMinSize   = 16 << 10
+	chunkAvgBits   = 16
+	chunkMaxSize   = 256 << 10
+	chunkedSuffix  = ".chunks"
+	chunkDir       = "chunks"
+)
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64 from a fixed seed, boundaries must never change between runs
+	seed := uint64(0x62747266_6c790000)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: bufio.NewReaderSize(r, chunkMaxSize), buf: make([]byte, 0, chunkMaxSize)}
+}
+
+// next returns the next chunk, which is only valid until the following call,
+// or io.EOF once the body is used up.
+func (c *chunker) next() (chunk []byte, err error) {
+	const mask = uint64(1<<chunkAvgBits-1) << (64 - chunkAvgBits)
+	c.buf = c.buf[:0]
+	var h uint64
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF && len(c.buf) > 0 {
+			return c.buf, nil
+		} else if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		h = h<<1 + gear[b]
+		if len(c.buf) >= chunkMaxSize || (len(c.buf) >= chunkMinSize && h&mask == 0) {
+			return c.buf, nil
+		}
+	}
+}
+
+type chunkRef struct {
+	Hash string
+	Size int64
+}
+
+// stagedChunks is a chunked body waiting to be committed: the list of its
+// chunks and closed temporary files for the chunks the store did not have
+// yet. Keeping them closed keeps a large body from using a descriptor per
+// chunk.
+type stagedChunks struct {
+	refs   []chunkRef
+	files  map[string]stagedFile
+	userID uint64
+}
+
+type stagedFile struct {
+	path       string
+	compressed bool
+}
+
+func (s *stagedChunks) discard() {
+	for _, staged := range s.files {
+		os.Remove(staged.path)
+	}
+}
+
+// stageChunks splits body into chunks and writes the new ones to temporary
+// files, filling in the artifact's Hash and Size along the way.
+func (d *Disk) stageChunks(artifact *Artifact, body io.Reader, userID uint64) (staged *stagedChunks, err error) {
+	h := newHashingWriter()
+	c := newChunker(io.TeeReader(body, h))
+	staged = &stagedChunks{refs: make([]chunkRef, 0), files: make(map[string]stagedFile), userID: userID}
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			staged.discard()
+			return nil, fmt.Errorf("failed to read artifact body: %s", err)
+		}
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		staged.refs = append(staged.refs, chunkRef{Hash: hash, Size: int64(len(chunk))})
+		if _, ok := staged.files[hash]; ok {
+			continue
+		}
+		if _, _, err = d.findChunk(d.storedID(hash, userID)); err == nil {
+			continue
+		}
+		f, err := d.createTemp("chunk")
+		if err != nil {
+			staged.discard()
+			return nil, err
+		}
+		sealed, err := d.sealWriter(f, userID)
+		if err != nil {
+			discardTemp(f)
+			staged.discard()
+			return nil, err
+		}
+		compressed, err := writeMaybeCompressed(sealed, chunk)
+		if err == nil {
+			err = sealed.Close()
+		}
+		if err != nil {
+			discardTemp(f)
+			staged.discard()
+			return nil, fmt.Errorf("failed to write chunk: %s", err)
+		}
+		if err = closeTemp(f, "chunk "+hash); err != nil {
+			staged.discard()
+			return nil, err
+		}
+		staged.files[hash] = stagedFile{path: f.Name(), compressed: compressed}
+	}
+	h.sum(artifact)
+	return staged, nil
+}
+
+// commitChunks moves staged chunks into the store and writes the list of
+// chunks as the blob stored as id. It has to be called with d.mu held.
+func (d *Disk) commitChunks(staged *stagedChunks, id string) (err error) {
+	if _, _, err = d.findBlob(id); err == nil {
+		staged.discard()
+		return nil
+	}
+	for i, ref := range staged.refs {
+		chunkID := d.storedID(ref.Hash, staged.userID)
+		file, ok := staged.files[ref.Hash]
+		if !ok {
+			if _, _, err = d.findChunk(chunkID); err != nil {
+				// Collected since it was staged, the orphans go with the next GC
+				staged.discard()
+				return fmt.Errorf("chunk %d of %s went missing while storing it, try again: %s", i, id, err)
+			}
+			continue
+		}
+		delete(staged.files, ref.Hash)
+		if _, _, err = d.findChunk(chunkID); err == nil {
+			os.Remove(file.path)
+			continue
+		}
+		path := filepath.Join(d.Root, chunkDir, chunkID)
+		if file.compressed {
+			path += compressedSuffix
+		}
+		if err = moveTemp(file.path, path); err != nil {
+			staged.discard()
+			return err
+		}
+	}
+	data, err := json.Marshal(staged.refs)
+	if err != nil {
+		return fmt.Errorf("failed to encode chunks of %s: %s", id, err)
+	}
+	buf := &bytes.Buffer{}
+	sealed, err := d.sealWriter(buf, staged.userID)
+	if err != nil {
+		return err
+	}
+	if _, err = sealed.Write(data); err == nil {
+		err = sealed.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to seal chunks of %s: %s", id, err)
+	}
+	return d.writeFile(d.blobPath(id)+chunkedSuffix, buf.Bytes())
+}
+
+// readChunks reads the list of chunks the blob stored as id is made of.
+func (d *Disk) readChunks(path string, id string) (refs []chunkRef, err error) {
+	f, err := d.openStored(path, "", id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("%w: chunk list %s: %s", ErrCorrupt, filepath.Base(path), err)
+	}
+	return refs, nil
+}
+
+// chunkedReader reads a chunked blob one chunk at a time.
+type chunkedReader struct {
+	d    *Disk
+	refs []chunkRef
+	// owner is the ownerSuffix of the blob, its chunks share it
+	owner   string
+	current io.ReadCloser
+}
+
+func (c *chunkedReader) Read(p []byte) (n int, err error) {
+	for {
+		if c.current == nil {
+			if len(c.refs) == 0 {
+				return 0, io.EOF
+			}
+			if c.current, err = c.d.openChunk(c.refs[0].Hash + c.owner); err != nil {
+				return 0, err
+			}
+			c.refs = c.refs[1:]
+		}
+		n, err = c.current.Read(p)
+		if err == io.EOF {
+			err = c.current.Close()
+			c.current = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkedReader) Close() (err error) {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+)
+
+// Blobs that are worth it are stored gzipped, with compressedSuffix on their
+// name. Whether a blob is worth it is decided from a sample of its start: the
+// blob has to be at least compressMinSize bytes and the sample has to shrink
+// below compressMaxRatio of its size at the fastest setting, which already
+// compressed formats quickly fail. Digests are always over the uncompressed
+// bytes.
+const (
+	compressMinSize  = 1 << 10
+	compressSample   = 64 << 10
+	compressMaxRatio = 0.9
+	compressedSuffix = ".gz"
+)
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// worthCompressing applies the heuristic to the first compressSample bytes of
+// a blob, or all of it when it is shorter.
+func worthCompressing(sample []byte) bool {
+	if len(sample) < compressMinSize {
+		return false
+	}
+	c := &countingWriter{}
+	fw, err := flate.NewWriter(c, flate.BestSpeed)
+	if err != nil {
+		return false
+	}
+	fw.Write(sample)
+	fw.Close()
+	return float64(c.n) < compressMaxRatio*float64(len(sample))
+}
+
+// writeMaybeCompressed writes data to w, gzipped if it is worth it.
+func writeMaybeCompressed(w io.Writer, data []byte) (compressed bool, err error) {
+	if !worthCompressing(data) {
+		_, err = w.Write(data)
+		return false, err
+	}
+	gz := gzip.NewWriter(w)
+	if _, err = gz.Write(data); err != nil {
+		return true, err
+	}
+	return true, gz.Close()
+}
+
+// gzipReadCloser decompresses a blob as it is read and closes the file
+// underneath when done.
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g *gzipReadCloser) Close() (err error) {
+	g.Reader.Close()
+	return g.file.Close()
+}
@@ -0,0 +1,414 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With encryption on, every user gets a random data key, and the data keys
+// are kept in <Root>/keys.json wrapped by the master key the server is started
+// with. Rotating the master key rewraps the data keys and leaves the blobs
+// alone.
+//
+// A user's blobs and chunks are sealed with their data key and carry the user
+// in their name (<hash>.u<ID>), so two users recording the same bytes each
+// store their own copy. Files are sealed in segments of segmentSize with
+// AES-GCM, so bodies stream in both directions: a file is encryptedMagic, an
+// 8 byte random nonce prefix, then the segments. A segment's nonce is the
+// prefix followed by its 32 bit number, and the user plus a flag marking the
+// final segment are authenticated with it, which catches files that were
+// truncated, reordered or moved to another user.
+const (
+	keySize        = 32
+	segmentSize    = 64 << 10
+	noncePrefixLen = 8
+	keyringFile    = "keys.json"
+	userSuffix     = ".u"
+)
+
+var encryptedMagic = []byte("btrflyE1")
+
+// keyringCheck is sealed with the master key so a wrong one is noticed even
+// before there are any users.
+var keyringCheck = []byte("btrfly keyring")
+
+// LoadMasterKey reads a master key from path, either as 32 raw bytes or as 64
+// hex digits.
+func LoadMasterKey(path string) (key []byte, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key: %s", err)
+	}
+	if text := strings.TrimSpace(string(data)); len(text) == 2*keySize {
+		if key, err = hex.DecodeString(text); err == nil {
+			return key, nil
+		}
+	}
+	if len(data) != keySize {
+		return nil, fmt.Errorf("master key in %s has to be %d bytes or %d hex digits", path, keySize, 2*keySize)
+	}
+	return data, nil
+}
+
+func newAEAD(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapKey(master cipher.AEAD, key []byte, aad []byte) (wrapped []byte, err error) {
+	nonce := make([]byte, master.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return master.Seal(nonce, nonce, key, aad), nil
+}
+
+func unwrapKey(master cipher.AEAD, wrapped []byte, aad []byte) (key []byte, err error) {
+	if len(wrapped) < master.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce := wrapped[:master.NonceSize()]
+	return master.Open(nil, nonce, wrapped[master.NonceSize():], aad)
+}
+
+// keyring holds the unwrapped data keys. It has its own lock because blobs
+// are staged without holding Disk.mu.
+type keyring struct {
+	mu      sync.Mutex
+	master  cipher.AEAD
+	wrapped map[uint64][]byte
+	keys    map[uint64]cipher.AEAD
+}
+
+type keyringData struct {
+	Check []byte
+	Users map[string][]byte
+}
+
+func userAAD(userID uint64) []byte {
+	return []byte("btrfly user " + strconv.FormatUint(userID, 10))
+}
+
+// loadKeyring unwraps the keyring at path with master, or starts an empty one
+// when there is none.
+func loadKeyring(path string, master []byte) (kr *keyring, err error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, fmt.Errorf("bad master key: %s", err)
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &keyring{master: aead, wrapped: make(map[uint64][]byte), keys: make(map[uint64]cipher.AEAD)}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %s", err)
+	}
+	return decodeKeyring(data, aead)
+}
+
+// decodeKeyring unwraps a stored keyring with master.
+func decodeKeyring(data []byte, master cipher.AEAD) (kr *keyring, err error) {
+	kr = &keyring{master: master, wrapped: make(map[uint64][]byte), keys: make(map[uint64]cipher.AEAD)}
+	stored := keyringData{}
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode keyring: %s", err)
+	}
+	if check, err := unwrapKey(master, stored.Check, nil); err != nil || !bytes.Equal(check, keyringCheck) {
+		return nil, errors.New("keyring was not written with this master key")
+	}
+	for name, wrapped := range stored.Users {
+		userID, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("keyring has a bad user %q", name)
+		}
+		key, err := unwrapKey(master, wrapped, userAAD(userID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap the key of user %d: %s", userID, err)
+		}
+		if kr.keys[userID], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		kr.wrapped[userID] = wrapped
+	}
+	return kr, nil
+}
+
+// encode returns the keyring as it is stored, with the data keys wrapped.
+func (kr *keyring) encode() (data []byte, err error) {
+	check, err := wrapKey(kr.master, keyringCheck, nil)
+	if err != nil {
+		return nil, err
+	}
+	stored := keyringData{Check: check, Users: make(map[string][]byte, len(kr.wrapped))}
+	for userID, wrapped := range kr.wrapped {
+		stored.Users[strconv.FormatUint(userID, 10)] = wrapped
+	}
+	return json.Marshal(stored)
+}
+
+// addUser makes sure the user has a data key and reports whether it created
+// one.
+func (kr *keyring) addUser(userID uint64) (created bool, err error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, ok := kr.keys[userID]; ok {
+		return false, nil
+	}
+	key := make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return false, err
+	}
+	wrapped, err := wrapKey(kr.master, key, userAAD(userID))
+	if err != nil {
+		return false, err
+	}
+	if kr.keys[userID], err = newAEAD(key); err != nil {
+		return false, err
+	}
+	kr.wrapped[userID] = wrapped
+	return true, nil
+}
+
+func (kr *keyring) key(userID uint64) (aead cipher.AEAD, err error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	aead, ok := kr.keys[userID]
+	if !ok {
+		return nil, fmt.Errorf("no data key for user %d", userID)
+	}
+	return aead, nil
+}
+
+// rewrap wraps every data key with a new master key. The data keys, and so
+// the blobs, stay the same.
+func (kr *keyring) rewrap(master []byte) (err error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	aead, err := newAEAD(master)
+	if err != nil {
+		return fmt.Errorf("bad master key: %s", err)
+	}
+	wrapped := make(map[uint64][]byte, len(kr.wrapped))
+	for userID, old := range kr.wrapped {
+		key, err := unwrapKey(kr.master, old, userAAD(userID))
+		if err != nil {
+			return fmt.Errorf("failed to unwrap the key of user %d: %s", userID, err)
+		}
+		if wrapped[userID], err = wrapKey(aead, key, userAAD(userID)); err != nil {
+			return err
+		}
+	}
+	kr.master = aead
+	kr.wrapped = wrapped
+	return nil
+}
+
+// EnableEncryption seals everything stored from now on with per-user data
+// keys, which are wrapped by master. Blobs stored in plaintext before stay
+// readable.
+func (d *Disk) EnableEncryption(master []byte) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	kr, err := loadKeyring(filepath.Join(d.Root, keyringFile), master)
+	if err != nil {
+		return err
+	}
+	d.keys = kr
+	for _, user := range d.Users {
+		if user == nil {
+			continue
+		}
+		if _, err = kr.addUser(user.ID); err != nil {
+			return err
+		}
+	}
+	return d.writeKeyring()
+}
+
+// RotateMasterKey rewraps every data key with master. No blob is rewritten.
+func (d *Disk) RotateMasterKey(master []byte) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.keys == nil {
+		return errors.New("encryption is not enabled")
+	}
+	if err = d.keys.rewrap(master); err != nil {
+		return err
+	}
+	return d.writeKeyring()
+}
+
+func (d *Disk) writeKeyring() (err error) {
+	d.keys.mu.Lock()
+	data, err := d.keys.encode()
+	d.keys.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode keyring: %s", err)
+	}
+	return d.writeFile(filepath.Join(d.Root, keyringFile), data)
+}
+
+// storedID names what a user stores under hash: the hash itself without
+// encryption, the hash and the user with it.
+func (d *Disk) storedID(hash string, userID uint64) (id string) {
+	if d.keys == nil {
+		return hash
+	}
+	return hash + userSuffix + strconv.FormatUint(userID, 10)
+}
+
+// sealer returns the data key and associated data files named id are sealed
+// with, or a nil key for plaintext files.
+func (d *Disk) sealer(id string) (aead cipher.AEAD, aad []byte, err error) {
+	i := strings.LastIndex(id, userSuffix)
+	if i < 0 {
+		return nil, nil, nil
+	}
+	userID, err := strconv.ParseUint(id[i+len(userSuffix):], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad stored name %s", id)
+	}
+	if d.keys == nil {
+		return nil, nil, fmt.Errorf("%s is encrypted but no master key was given", id)
+	}
+	if aead, err = d.keys.key(userID); err != nil {
+		return nil, nil, err
+	}
+	return aead, userAAD(userID), nil
+}
+
+// encryptingWriter seals everything written to it into w. Close seals the
+// final segment, it does not close w.
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newEncryptingWriter(w io.Writer, aead cipher.AEAD, aad []byte) (e *encryptingWriter, err error) {
+	e = &encryptingWriter{w: w, aead: aead, aad: aad, prefix: make([]byte, noncePrefixLen), buf: make([]byte, 0, segmentSize)}
+	if _, err = rand.Read(e.prefix); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(append(append([]byte{}, encryptedMagic...), e.prefix...)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func segmentNonce(prefix []byte, counter uint32) (nonce []byte) {
+	nonce = make([]byte, noncePrefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixLen:], counter)
+	return nonce
+}
+
+func segmentAAD(aad []byte, final bool) []byte {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	return append(append([]byte{}, aad...), flag)
+}
+
+func (e *encryptingWriter) seal(segment []byte, final bool) (err error) {
+	sealed := e.aead.Seal(nil, segmentNonce(e.prefix, e.counter), segment, segmentAAD(e.aad, final))
+	e.counter += 1
+	_, err = e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptingWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// A full segment is only sealed once more follows, the last one has
+		// to be marked final
+		if len(e.buf) == segmentSize {
+			if err = e.seal(e.buf, false); err != nil {
+				return n, err
+			}
+			e.buf = e.buf[:0]
+		}
+		taken := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+taken]
+		p = p[taken:]
+		n += taken
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) Close() (err error) {
+	return e.seal(e.buf, true)
+}
+
+// decryptingReader opens what an encryptingWriter sealed.
+type decryptingReader struct {
+	r       *bufio.Reader
+	file    io.Closer
+	aead    cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	done    bool
+}
+
+func newDecryptingReader(f io.ReadCloser, aead cipher.AEAD, aad []byte) (d *decryptingReader, err error) {
+	r := bufio.NewReaderSize(f, segmentSize+aead.Overhead())
+	header := make([]byte, len(encryptedMagic)+noncePrefixLen)
+	if _, err = io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(encryptedMagic)], encryptedMagic) {
+		return nil, fmt.Errorf("%w: not an encrypted file", ErrCorrupt)
+	}
+	return &decryptingReader{r: r, file: f, aead: aead, aad: aad, prefix: header[len(encryptedMagic):]}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (n int, err error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		sealed := make([]byte, segmentSize+d.aead.Overhead())
+		n, err := io.ReadFull(d.r, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, fmt.Errorf("%w: encrypted file ends early", ErrCorrupt)
+		}
+		_, peekErr := d.r.Peek(1)
+		final := peekErr == io.EOF
+		d.plain, err = d.aead.Open(sealed[:0], segmentNonce(d.prefix, d.counter), sealed[:n], segmentAAD(d.aad, final))
+		if err != nil {
+			return 0, fmt.Errorf("%w: segment %d does not authenticate", ErrCorrupt, d.counter)
+		}
+		d.counter += 1
+		d.done = final
+	}
+	n = copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) Close() (err error) {
+	return d.file.Close()
+}
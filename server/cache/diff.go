@@ -0,0 +1,57 @@
+package cache
+
+// TagDiff is what changed going from one tag to another, every list sorted
+// by key.
+type TagDiff struct {
+	Added   []DiffEntry
+	Removed []DiffEntry
+	Changed []DiffEntry
+}
+
+// DiffEntry describes a single key. OldHash and OldSize are empty for added
+// keys, NewHash and NewSize for removed ones.
+type DiffEntry struct {
+	Key     string
+	OldHash string `json:",omitempty"`
+	OldSize int64
+	NewHash string `json:",omitempty"`
+	NewSize int64
+}
+
+// DiffTags compares the key to digest maps of what tags a and b play back,
+// entries they inherit included. Entries with the same body but a different
+// status or headers count as unchanged.
+func DiffTags(k Handler, a string, b string, userID uint64) (diff TagDiff, err error) {
+	from, _, err := resolveArtifacts(k, a, userID)
+	if err != nil {
+		return diff, err
+	}
+	to, _, err := resolveArtifacts(k, b, userID)
+	if err != nil {
+		return diff, err
+	}
+
+	diff = TagDiff{Added: []DiffEntry{}, Removed: []DiffEntry{}, Changed: []DiffEntry{}}
+	for _, key := range sortedKeys(from) {
+		before := from[key]
+		after, ok := to[key]
+		if !ok {
+			diff.Removed = append(diff.Removed, DiffEntry{Key: key, OldHash: before.Hash, OldSize: before.Size})
+		} else if !before.Equal(after) {
+			diff.Changed = append(diff.Changed, DiffEntry{
+				Key:     key,
+				OldHash: before.Hash,
+				OldSize: before.Size,
+				NewHash: after.Hash,
+				NewSize: after.Size,
+			})
+		}
+	}
+	for _, key := range sortedKeys(to) {
+		if _, ok := from[key]; !ok {
+			after := to[key]
+			diff.Added = append(diff.Added, DiffEntry{Key: key, NewHash: after.Hash, NewSize: after.Size})
+		}
+	}
+	return diff, nil
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffTags(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		same := addArtifact(t, k, "same", "GET example.com/same", "monday")
+		k.TagArtifact(same, "tuesday", "GET example.com/same", 0)
+		gone := addArtifact(t, k, "gone", "GET example.com/gone", "monday")
+		before := addArtifact(t, k, "before", "GET example.com/changed", "monday")
+		after := addArtifact(t, k, "and after", "GET example.com/changed", "tuesday")
+		added := addArtifact(t, k, "added", "GET example.com/added", "tuesday")
+
+		diff, err := DiffTags(k, "monday", "tuesday", 0)
+		if err != nil {
+			t.Fatalf("Failed to diff: %s", err)
+		}
+		want := TagDiff{
+			Added:   []DiffEntry{{Key: "GET example.com/added", NewHash: added.Hash, NewSize: 5}},
+			Removed: []DiffEntry{{Key: "GET example.com/gone", OldHash: gone.Hash, OldSize: 4}},
+			Changed: []DiffEntry{{Key: "GET example.com/changed", OldHash: before.Hash, OldSize: 6, NewHash: after.Hash, NewSize: 9}},
+		}
+		if !reflect.DeepEqual(diff, want) {
+			t.Errorf("got %+v, want %+v", diff, want)
+		}
+
+		// Inherited entries count as well, the same as on playback
+		if err = k.SetParents("wednesday", []string{"tuesday"}, 0); err != nil {
+			t.Fatalf("Failed to set parents: %s", err)
+		}
+		overridden := addArtifact(t, k, "overridden", "GET example.com/added", "wednesday")
+		diff, err = DiffTags(k, "tuesday", "wednesday", 0)
+		if err != nil {
+			t.Fatalf("Failed to diff: %s", err)
+		}
+		want = TagDiff{
+			Added:   []DiffEntry{},
+			Removed: []DiffEntry{},
+			Changed: []DiffEntry{{Key: "GET example.com/added", OldHash: added.Hash, OldSize: 5, NewHash: overridden.Hash, NewSize: 10}},
+		}
+		if !reflect.DeepEqual(diff, want) {
+			t.Errorf("layered: got %+v, want %+v", diff, want)
+		}
+
+		if _, err = DiffTags(k, "monday", "DNE", 0); err == nil {
+			t.Errorf("Diffed against a missing tag")
+		}
+	})
+}
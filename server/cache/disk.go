@@ -0,0 +1,905 @@
+package cache
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexFile = "index.json"
+	blobDir   = "blobs"
+	tmpDir    = "tmp"
+)
+
+// Implements cache.Handler
+// Artifacts are stored content-addressed by their hash under <Root>/blobs,
+// gzipped when that pays off (see compress.go), and the user -> tag -> URL ->
+// hash index lives in <Root>/index.json, with the entries recorded since it was
+// last written in <Root>/journal.jsonl (see journal.go). Every other write goes
+// to a temporary file first and is renamed into place, so a crash never leaves
+// a half-written blob or index behind.
+type Disk struct {
+	Root  string
+	Users []*User
+	// Chunking splits large bodies into content-defined chunks, see chunk.go
+	Chunking bool
+
+	keys *keyring
+
+	mu sync.Mutex
+	// journal and the sizes are guarded by mu, seq is written under mu but
+	// read by syncJournal without it
+	journal     *os.File
+	journalSize int64
+	indexSize   int64
+	seq         uint64
+	// syncMu guards synced, the last record known to be durable
+	syncMu sync.Mutex
+	synced uint64
+}
+
+type diskIndex struct {
+	Users []*User
+	// Seq is the last journal record the index holds
+	Seq uint64 `json:",omitempty"`
+}
+
+func (d *Disk) AddUser(user *User) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Users recorded in a previous run keep their tags
+	if user.ID < uint64(len(d.Users)) && d.Users[user.ID] != nil {
+		return
+	}
+	d.Users = append(d.Users, user)
+	if err := d.writeIndex(); err != nil {
+		log.Printf("Failed to persist btrfly index: %s", err)
+	}
+	if d.keys != nil {
+		if created, err := d.keys.addUser(user.ID); err != nil {
+			log.Printf("Failed to create a data key for user %d: %s", user.ID, err)
+		} else if created {
+			if err = d.writeKeyring(); err != nil {
+				log.Printf("Failed to persist btrfly keyring: %s", err)
+			}
+		}
+	}
+}
+
+func (d *Disk) GetArtifact(url string, tagID string, userID uint64) (artifact *Artifact, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return artifact, err
+	}
+	stored, err := user.lookup(url, tagID)
+	if err != nil {
+		return artifact, err
+	}
+	return d.artifact(stored, userID)
+}
+
+func (d *Disk) LatestArtifact(url string, userID uint64) (artifact *Artifact, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return artifact, err
+	}
+	stored, err := user.latestEntry(url)
+	if err != nil {
+		return artifact, err
+	}
+	return d.artifact(stored, userID)
+}
+
+func (d *Disk) AddArtifact(artifact *Artifact, body io.Reader, url string, tagID string, userID uint64) (err error) {
+	// The (possibly very long) upload does not need to hold the index lock.
+	var commit func() error
+	var discard func()
+	if d.Chunking {
+		br := bufio.NewReaderSize(body, chunkThreshold)
+		body = br
+		if sample, _ := br.Peek(chunkThreshold); len(sample) == chunkThreshold {
+			staged, err := d.stageChunks(artifact, br, userID)
+			if err != nil {
+				return err
+			}
+			commit = func() error { return d.commitChunks(staged, d.storedID(artifact.Hash, userID)) }
+			discard = staged.discard
+		}
+	}
+	if commit == nil {
+		staged, compressed, err := d.stageBlob(artifact, body, userID)
+		if err != nil {
+			return err
+		}
+		commit = func() error { return d.commitBlob(staged, d.storedID(artifact.Hash, userID), compressed) }
+		discard = func() { discardTemp(staged) }
+	}
+
+	seq, err := d.addEntry(commit, discard, artifact, url, tagID, userID)
+	if err != nil {
+		return err
+	}
+	return d.syncJournal(seq)
+}
+
+func (d *Disk) TagArtifact(artifact *Artifact, tag string, URL string, userID uint64) (err error) {
+	seq, err := d.addEntry(nil, nil, artifact, URL, tag, userID)
+	if err != nil {
+		return err
+	}
+	return d.syncJournal(seq)
+}
+
+// addEntry commits the staged body, if there is one, and records artifact
+// under url in the index and the journal. The journal still has to be synced
+// once the lock is let go.
+func (d *Disk) addEntry(commit func() error, discard func(), artifact *Artifact, url string, tagID string, userID uint64) (seq uint64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		if discard != nil {
+			discard()
+		}
+		return 0, err
+	}
+	// Committing under the lock keeps GC from sweeping the blob before the
+	// index references it.
+	if commit != nil {
+		if err = commit(); err != nil {
+			return 0, err
+		}
+	}
+	stored := d.setEntry(user, artifact, url, tagID)
+	return d.journalEntry(userID, tagID, url, stored, user.Tags[tagID].RecordedAt)
+}
+
+func (d *Disk) ListTags(userID uint64) (tags []string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return user.tagNames(), nil
+}
+
+func (d *Disk) ListArtifacts(tagID string, userID uint64) (artifacts map[string]*Artifact, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := user.getTag(tagID)
+	if err != nil {
+		return nil, err
+	}
+	artifacts = make(map[string]*Artifact, len(tag.Artifacts))
+	for key, stored := range tag.Artifacts {
+		artifacts[key] = d.openable(stored, userID)
+	}
+	return artifacts, nil
+}
+
+func (d *Disk) DeleteTag(tag string, userID uint64) (err error) {
+	return d.updateUser(userID, func(user *User) error {
+		return user.deleteTag(tag)
+	})
+}
+
+func (d *Disk) CopyTag(src string, dst string, userID uint64) (err error) {
+	return d.updateUser(userID, func(user *User) error {
+		return user.copyTag(src, dst)
+	})
+}
+
+func (d *Disk) RenameTag(src string, dst string, userID uint64) (err error) {
+	return d.updateUser(userID, func(user *User) error {
+		return user.renameTag(src, dst)
+	})
+}
+
+func (d *Disk) ReplaceTag(src string, dst string, userID uint64) (err error) {
+	return d.updateUser(userID, func(user *User) error {
+		return user.replaceTag(src, dst)
+	})
+}
+
+func (d *Disk) SetParents(tag string, parents []string, userID uint64) (err error) {
+	return d.updateUser(userID, func(user *User) error {
+		return user.setParents(tag, parents)
+	})
+}
+
+func (d *Disk) Parents(tag string, userID uint64) (parents []string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return user.parents(tag)
+}
+
+func (d *Disk) SetPinned(tag string, pinned bool, userID uint64) (err error) {
+	return d.updateUser(userID, func(user *User) error {
+		return user.setPinned(tag, pinned)
+	})
+}
+
+func (d *Disk) Pinned(tag string, userID uint64) (pinned bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return false, err
+	}
+	return user.pinned(tag)
+}
+
+func (d *Disk) SetAttestation(tag string, attestation *Attestation, userID uint64) (err error) {
+	return d.updateUser(userID, func(user *User) error {
+		return user.setAttestation(tag, attestation)
+	})
+}
+
+func (d *Disk) Attestation(tag string, userID uint64) (attestation *Attestation, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return user.attestation(tag)
+}
+
+func (d *Disk) Version(tag string, userID uint64) (version uint64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	return user.version(tag)
+}
+
+func (d *Disk) Played(tag string, userID uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		log.Printf("Failed to note playback: %s", err)
+		return
+	}
+	if !user.played(tag, time.Now().UTC()) {
+		return
+	}
+	if err = d.writeIndex(); err != nil {
+		log.Printf("Failed to persist btrfly index: %s", err)
+	}
+}
+
+// Reap deletes the tags policy no longer keeps. Their blobs stay until the
+// next GC.
+func (d *Disk) Reap(policy RetentionPolicy, now time.Time) (reaped []Reaped, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := false
+	for _, user := range d.Users {
+		if user == nil {
+			continue
+		}
+		deleted, userChanged := user.reap(policy, now)
+		reaped = append(reaped, deleted...)
+		changed = changed || userChanged
+	}
+	if !changed {
+		return reaped, nil
+	}
+	return reaped, d.writeIndex()
+}
+
+// GC removes every blob that no tag of any user references, and every chunk
+// no remaining blob is made of.
+func (d *Disk) GC() (freed int64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	blobs, chunks, err := d.liveStored()
+	if err != nil {
+		return 0, err
+	}
+	if freed, err = removeUnlisted(filepath.Join(d.Root, blobDir), blobs); err != nil {
+		return freed, err
+	}
+	chunksFreed, err := removeUnlisted(filepath.Join(d.Root, chunkDir), chunks)
+	return freed + chunksFreed, err
+}
+
+// liveStored lists the names of the blob and chunk files at least one tag
+// still needs. It has to be called with d.mu held.
+func (d *Disk) liveStored() (blobs []string, chunks []string, err error) {
+	referenced := d.referencedIDs()
+	entries, err := os.ReadDir(filepath.Join(d.Root, blobDir))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list blobs: %s", err)
+	}
+	live := make(map[string]bool)
+	for _, blob := range entries {
+		id := storedID(blob.Name())
+		if !referenced[id] {
+			continue
+		}
+		blobs = append(blobs, blob.Name())
+		if strings.HasSuffix(blob.Name(), chunkedSuffix) {
+			refs, err := d.readChunks(d.blobPath(blob.Name()), id)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, ref := range refs {
+				live[ref.Hash+ownerSuffix(id)] = true
+			}
+		}
+	}
+
+	entries, err = os.ReadDir(filepath.Join(d.Root, chunkDir))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list chunks: %s", err)
+	}
+	for _, chunk := range entries {
+		if live[storedID(chunk.Name())] {
+			chunks = append(chunks, chunk.Name())
+		}
+	}
+	return blobs, chunks, nil
+}
+
+// removeUnlisted removes every file in dir that is not in keep.
+func removeUnlisted(dir string, keep []string) (freed int64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %s", filepath.Base(dir), err)
+	}
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for _, entry := range entries {
+		if kept[entry.Name()] {
+			continue
+		}
+		size, err := removeStored(dir, entry)
+		if err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+	return freed, syncDir(dir)
+}
+
+// referencedIDs is the set of stored names at least one tag still points at,
+// covering blobs stored before and after encryption was turned on.
+func (d *Disk) referencedIDs() (referenced map[string]bool) {
+	referenced = make(map[string]bool)
+	for _, user := range d.Users {
+		if user == nil {
+			continue
+		}
+		for _, tag := range user.Tags {
+			for _, artifact := range tag.Artifacts {
+				referenced[artifact.Hash] = true
+				referenced[artifact.Hash+userSuffix+strconv.FormatUint(user.ID, 10)] = true
+			}
+		}
+	}
+	return referenced
+}
+
+// storedID strips the suffix saying how a blob or chunk is stored.
+func storedID(name string) (id string) {
+	return strings.TrimSuffix(strings.TrimSuffix(name, compressedSuffix), chunkedSuffix)
+}
+
+// ownerSuffix is the part of a stored name saying whose data key sealed it.
+func ownerSuffix(id string) (suffix string) {
+	if i := strings.LastIndex(id, userSuffix); i >= 0 {
+		return id[i:]
+	}
+	return ""
+}
+
+func removeStored(dir string, entry os.DirEntry) (size int64, err error) {
+	info, err := entry.Info()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %s", entry.Name(), err)
+	}
+	if err = os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+		return 0, fmt.Errorf("failed to remove %s: %s", entry.Name(), err)
+	}
+	return info.Size(), nil
+}
+
+func (d *Disk) Stats() (stats Stats, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats = indexStats(d.Users)
+	blobs, err := os.ReadDir(filepath.Join(d.Root, blobDir))
+	if err != nil {
+		return stats, fmt.Errorf("failed to list blobs: %s", err)
+	}
+	sizes := uniqueSizes(d.Users)
+	var compressedSize, uncompressedSize int64
+	for _, blob := range blobs {
+		info, err := blob.Info()
+		if err != nil {
+			return stats, fmt.Errorf("failed to stat blob %s: %s", blob.Name(), err)
+		}
+		stats.Blobs += 1
+		stats.StoredSize += info.Size()
+		id := storedID(blob.Name())
+		size, ok := sizes[strings.TrimSuffix(id, ownerSuffix(id))]
+		if ok && strings.HasSuffix(blob.Name(), compressedSuffix) {
+			stats.CompressedBlobs += 1
+			compressedSize += info.Size()
+			uncompressedSize += size
+		}
+	}
+	if compressedSize > 0 {
+		stats.CompressionRatio = float64(uncompressedSize) / float64(compressedSize)
+	}
+
+	chunks, err := os.ReadDir(filepath.Join(d.Root, chunkDir))
+	if err != nil {
+		return stats, fmt.Errorf("failed to list chunks: %s", err)
+	}
+	for _, chunk := range chunks {
+		info, err := chunk.Info()
+		if err != nil {
+			return stats, fmt.Errorf("failed to stat chunk %s: %s", chunk.Name(), err)
+		}
+		stats.Chunks += 1
+		stats.StoredSize += info.Size()
+	}
+	return stats, nil
+}
+
+func (d *Disk) TagStats(tag string, userID uint64) (stats TagStats, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return stats, err
+	}
+	return tagStats(d.Users, user, tag, func(userID uint64, artifact *Artifact) ([]chunkRef, error) {
+		id, err := d.locate(artifact.Hash, userID)
+		if err != nil {
+			return nil, err
+		}
+		path, suffix, err := d.findBlob(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find blob %s: %s", id, err)
+		}
+		if suffix != chunkedSuffix {
+			return []chunkRef{{Hash: id, Size: artifact.Size}}, nil
+		}
+		refs, err := d.readChunks(path, id)
+		if err != nil {
+			return nil, err
+		}
+		// Chunks of different users are different chunks
+		for i := range refs {
+			refs[i].Hash += ownerSuffix(id)
+		}
+		return refs, nil
+	})
+}
+
+// updateUser applies update to the user's tags and persists the result.
+func (d *Disk) updateUser(userID uint64, update func(user *User) error) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	user, err := d.getUser(userID)
+	if err != nil {
+		return err
+	}
+	if err = update(user); err != nil {
+		return err
+	}
+	return d.writeIndex()
+}
+
+func (d *Disk) getUser(userID uint64) (user *User, err error) {
+	if userID >= uint64(len(d.Users)) || d.Users[userID] == nil {
+		return nil, fmt.Errorf("failed to get user with ID: %d", userID)
+	}
+	return d.Users[userID], nil
+}
+
+// The index only holds references, the bytes live in the blob.
+func (d *Disk) setEntry(user *User, artifact *Artifact, url string, tagID string) (stored *Artifact) {
+	stored = &Artifact{
+		Hash:       artifact.Hash,
+		Algorithm:  artifact.Algorithm,
+		Size:       artifact.Size,
+		StatusCode: artifact.StatusCode,
+		Header:     artifact.Header.Clone(),
+		Metadata:   artifact.Metadata.clone(),
+	}
+	user.record(tagID, url, stored)
+	return stored
+}
+
+// artifact hands out a copy of an index entry after checking its blob exists.
+func (d *Disk) artifact(stored *Artifact, userID uint64) (artifact *Artifact, err error) {
+	if _, err = d.locate(stored.Hash, userID); err != nil {
+		return nil, err
+	}
+	return d.openable(stored, userID), nil
+}
+
+// openable hands out a copy of an index entry that can open its blob.
+func (d *Disk) openable(stored *Artifact, userID uint64) (artifact *Artifact) {
+	hash := stored.Hash
+	artifact = &Artifact{
+		Hash:       stored.Hash,
+		Algorithm:  stored.Algorithm,
+		Size:       stored.Size,
+		StatusCode: stored.StatusCode,
+		Header:     stored.Header.Clone(),
+		Metadata:   stored.Metadata.clone(),
+	}
+	artifact.open = func() (io.ReadCloser, error) {
+		id, err := d.locate(hash, userID)
+		if err != nil {
+			return nil, err
+		}
+		return d.openBlob(id)
+	}
+	return artifact
+}
+
+// locate finds the stored name of a user's blob, which is a plain hash when
+// it was stored before encryption was turned on.
+func (d *Disk) locate(hash string, userID uint64) (id string, err error) {
+	for _, id = range []string{d.storedID(hash, userID), hash} {
+		if _, _, err = d.findBlob(id); err == nil {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find blob %s: %s", hash, err)
+}
+
+func (d *Disk) blobPath(hash string) string {
+	return filepath.Join(d.Root, blobDir, hash)
+}
+
+// stageBlob streams body into a temporary file, filling in the artifact's Hash
+// and Size along the way. The file is gzipped when the start of the body
+// looks compressible.
+func (d *Disk) stageBlob(artifact *Artifact, body io.Reader, userID uint64) (f *os.File, compressed bool, err error) {
+	f, err = d.createTemp("blob")
+	if err != nil {
+		return nil, false, err
+	}
+	sealed, err := d.sealWriter(f, userID)
+	if err != nil {
+		discardTemp(f)
+		return nil, false, err
+	}
+	br := bufio.NewReaderSize(body, compressSample)
+	// A short body gives a short sample, read errors come back from the copy
+	sample, _ := br.Peek(compressSample)
+	compressed = worthCompressing(sample)
+
+	var w io.Writer = sealed
+	var gz *gzip.Writer
+	if compressed {
+		gz = gzip.NewWriter(sealed)
+		w = gz
+	}
+	h := newHashingWriter()
+	if _, err = io.Copy(io.MultiWriter(w, h), br); err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = sealed.Close()
+	}
+	if err != nil {
+		discardTemp(f)
+		return nil, false, fmt.Errorf("failed to write blob: %s", err)
+	}
+	h.sum(artifact)
+	return f, compressed, nil
+}
+
+// commitBlob moves a staged blob into the store under its stored name.
+func (d *Disk) commitBlob(f *os.File, id string, compressed bool) (err error) {
+	if _, _, err = d.findBlob(id); err == nil {
+		// Content-addressed, so an existing blob is already the right bytes
+		discardTemp(f)
+		return nil
+	}
+	path := d.blobPath(id)
+	if compressed {
+		path += compressedSuffix
+	}
+	return commitTemp(f, path)
+}
+
+// findBlob returns where the blob stored as id is and the suffix that says
+// how it is stored: whole, gzipped or chunked.
+func (d *Disk) findBlob(id string) (path string, suffix string, err error) {
+	return findStored(d.blobPath(id), "", compressedSuffix, chunkedSuffix)
+}
+
+func (d *Disk) findChunk(id string) (path string, suffix string, err error) {
+	return findStored(filepath.Join(d.Root, chunkDir, id), "", compressedSuffix)
+}
+
+func findStored(base string, suffixes ...string) (path string, suffix string, err error) {
+	for _, suffix = range suffixes {
+		if _, err = os.Stat(base + suffix); err == nil || !errors.Is(err, os.ErrNotExist) {
+			return base + suffix, suffix, err
+		}
+	}
+	return "", "", err
+}
+
+// openBlob opens the blob stored as id, decrypting, decompressing and
+// reassembling it as it is read.
+func (d *Disk) openBlob(id string) (body io.ReadCloser, err error) {
+	path, suffix, err := d.findBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	if suffix == chunkedSuffix {
+		refs, err := d.readChunks(path, id)
+		if err != nil {
+			return nil, err
+		}
+		return &chunkedReader{d: d, refs: refs, owner: ownerSuffix(id)}, nil
+	}
+	return d.openStored(path, suffix, id)
+}
+
+func (d *Disk) openChunk(id string) (body io.ReadCloser, err error) {
+	path, suffix, err := d.findChunk(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find chunk %s: %s", id, err)
+	}
+	return d.openStored(path, suffix, id)
+}
+
+func (d *Disk) openStored(path string, suffix string, id string) (body io.ReadCloser, err error) {
+	aead, aad, err := d.sealer(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	body = f
+	if aead != nil {
+		if body, err = newDecryptingReader(f, aead, aad); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+	if suffix != compressedSuffix {
+		return body, nil
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("%w: %s: %s", ErrCorrupt, filepath.Base(path), err)
+	}
+	return &gzipReadCloser{Reader: gz, file: body}, nil
+}
+
+// sealWriter wraps w so that what the user stores is encrypted, when
+// encryption is on. Closing it does not close w.
+func (d *Disk) sealWriter(w io.Writer, userID uint64) (sealed io.WriteCloser, err error) {
+	aead, aad, err := d.sealer(d.storedID("", userID))
+	if err != nil || aead == nil {
+		return nopWriteCloser{w}, err
+	}
+	return newEncryptingWriter(w, aead, aad)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// writeIndex persists the whole index, and with it everything in the journal.
+// It has to be called with d.mu held.
+func (d *Disk) writeIndex() (err error) {
+	data, err := json.Marshal(diskIndex{Users: d.Users, Seq: d.seq})
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %s", err)
+	}
+	if err = d.writeFile(filepath.Join(d.Root, indexFile), data); err != nil {
+		return err
+	}
+	d.indexSize = int64(len(data))
+	return d.truncateJournal()
+}
+
+// writeFile atomically replaces path with data.
+func (d *Disk) writeFile(path string, data []byte) (err error) {
+	f, err := d.createTemp(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		discardTemp(f)
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return commitTemp(f, path)
+}
+
+func (d *Disk) createTemp(prefix string) (f *os.File, err error) {
+	f, err = os.CreateTemp(filepath.Join(d.Root, tmpDir), prefix+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	return f, nil
+}
+
+func discardTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// commitTemp makes the contents of f durable and moves it to path.
+func commitTemp(f *os.File, path string) (err error) {
+	if err = closeTemp(f, path); err != nil {
+		return err
+	}
+	return moveTemp(f.Name(), path)
+}
+
+// closeTemp makes the contents of f, which is headed for path, durable and
+// closes it. f is removed when that fails.
+func closeTemp(f *os.File, path string) (err error) {
+	if err = f.Sync(); err != nil {
+		discardTemp(f)
+		return fmt.Errorf("failed to sync %s: %s", path, err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close %s: %s", path, err)
+	}
+	return nil
+}
+
+// moveTemp moves the closed temporary file tmp to path.
+func moveTemp(tmp string, path string) (err error) {
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move %s into place: %s", path, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(path string) (err error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// CreateDisk opens the store rooted at root, creating it if it does not exist
+// and loading the index left behind by a previous run.
+func CreateDisk(root string) (d *Disk, err error) {
+	for _, dir := range []string{root, filepath.Join(root, blobDir), filepath.Join(root, chunkDir), filepath.Join(root, tmpDir)} {
+		if err = os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %s", dir, err)
+		}
+	}
+	// Anything left in tmp is from a write that never completed
+	stale, err := filepath.Glob(filepath.Join(root, tmpDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		os.RemoveAll(path)
+	}
+
+	d = &Disk{Root: root, Users: make([]*User, 0)}
+	data, err := os.ReadFile(filepath.Join(root, indexFile))
+	if err == nil {
+		index := diskIndex{}
+		if err = json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to decode index: %s", err)
+		}
+		d.Users = loadedUsers(index.Users)
+		d.seq = index.Seq
+		d.indexSize = int64(len(data))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read index: %s", err)
+	}
+	if err = d.openJournal(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// loadedUsers fills in the maps JSON leaves nil in users read from an index,
+// drops scratch tags and brings keys from older stores up to date.
+func loadedUsers(users []*User) []*User {
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		if user.Tags == nil {
+			user.Tags = make(map[string]*Tag)
+		}
+		for name, tag := range user.Tags {
+			// An import or sync that never finished, its blobs go with the
+			// next GC
+			if isScratch(name) {
+				delete(user.Tags, name)
+				continue
+			}
+			if tag.Artifacts == nil {
+				tag.Artifacts = make(map[string]*Artifact)
+			}
+			migrateKeys(tag)
+			tag.touch()
+		}
+	}
+	return users
+}
+
+// migrateKeys rewrites the keys of stores from before keys had a method in
+// front, which were just host/path?query. Those were recorded without regard
+// for the method, and all but always for a GET.
+func migrateKeys(tag *Tag) {
+	for key, artifact := range tag.Artifacts {
+		if strings.Contains(key, " ") {
+			continue
+		}
+		delete(tag.Artifacts, key)
+		if _, ok := tag.Artifacts["GET "+key]; !ok {
+			tag.Artifacts["GET "+key] = artifact
+		}
+	}
+}
@@ -0,0 +1,649 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readArtifact(t *testing.T, artifact *Artifact) string {
+	buf := &bytes.Buffer{}
+	if _, err := artifact.WriteTo(buf); err != nil {
+		t.Fatalf("Failed to read artifact: %s", err)
+	}
+	return buf.String()
+}
+
+func TestDiskSurvivesRestart(t *testing.T) {
+	root := t.TempDir()
+
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+
+	aData := "this is the /root/a file"
+	bData := "this is the /root/b file"
+	a := &Artifact{StatusCode: 203, Header: http.Header{"Content-Type": {"text/plain"}}}
+	if err = d.AddArtifact(a, strings.NewReader(aData), "GET example.com/root/a", "tag1", 0); err != nil {
+		t.Fatalf("Failed to add artifact: %s", err)
+	}
+	if err = d.AddArtifact(&Artifact{}, strings.NewReader(bData), "GET example.com/root/b", "tag1", 0); err != nil {
+		t.Fatalf("Failed to add artifact: %s", err)
+	}
+	d.TagArtifact(a, "tag2", "GET example.com/root/a", 0)
+
+	// Simulate a restart
+	d, err = CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+
+	cases := []struct {
+		url  string
+		tag  string
+		want string
+	}{
+		{"GET example.com/root/a", "tag1", aData},
+		{"GET example.com/root/b", "tag1", bData},
+		{"GET example.com/root/a", "tag2", aData},
+	}
+	for _, tc := range cases {
+		t.Run(tc.tag+" "+tc.url, func(t *testing.T) {
+			got, err := d.GetArtifact(tc.url, tc.tag, 0)
+			if err != nil {
+				t.Fatalf("Failed to get artifact: %s", err)
+			}
+			if got.Size != int64(len(tc.want)) {
+				t.Errorf("artifact.Size: got %d, want %d", got.Size, len(tc.want))
+			}
+			if body := readArtifact(t, got); body != tc.want {
+				t.Errorf("artifact: got %s, want %s", body, tc.want)
+			}
+		})
+	}
+
+	got, err := d.GetArtifact("GET example.com/root/a", "tag1", 0)
+	if err != nil {
+		t.Fatalf("Failed to get artifact: %s", err)
+	}
+	if got.StatusCode != 203 {
+		t.Errorf("artifact.StatusCode: got %d, want 203", got.StatusCode)
+	}
+	if !reflect.DeepEqual(got.Header, a.Header) {
+		t.Errorf("artifact.Header: got %v, want %v", got.Header, a.Header)
+	}
+
+	if _, err = d.GetArtifact("GET example.com/root/b", "tag2", 0); err == nil {
+		t.Errorf("Got an artifact that was never tagged")
+	}
+	if _, err = d.GetArtifact("GET example.com/root/a", "tag1", 1); err == nil {
+		t.Errorf("Got an artifact for a user that does not exist")
+	}
+}
+
+func TestDiskMigratesKeys(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+	// Keys used to be the bare host and path
+	addArtifact(t, d, "old body", "example.com/old", "tag1")
+	addArtifact(t, d, "new body", "GET example.com/new", "tag1")
+
+	if d, err = CreateDisk(root); err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	artifacts, err := d.ListArtifacts("tag1", 0)
+	if err != nil {
+		t.Fatalf("Failed to list artifacts: %s", err)
+	}
+	if keys := sortedKeys(artifacts); !reflect.DeepEqual(keys, []string{"GET example.com/new", "GET example.com/old"}) {
+		t.Errorf("keys: got %v", keys)
+	}
+	if got := readArtifact(t, artifacts["GET example.com/old"]); got != "old body" {
+		t.Errorf("migrated entry: got %q, want %q", got, "old body")
+	}
+}
+
+func TestDiskJournal(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+	index, err := os.ReadFile(filepath.Join(root, indexFile))
+	if err != nil {
+		t.Fatalf("Failed to read index: %s", err)
+	}
+	// Recording appends to the journal and leaves the index alone
+	addArtifact(t, d, "kept", "GET example.com/kept", "kept")
+	addArtifact(t, d, "gone", "GET example.com/gone", "gone")
+	if after, _ := os.ReadFile(filepath.Join(root, indexFile)); !bytes.Equal(after, index) {
+		t.Errorf("index was rewritten for every entry")
+	}
+	journal, err := os.ReadFile(filepath.Join(root, journalFile))
+	if err != nil || bytes.Count(journal, []byte("\n")) != 2 {
+		t.Fatalf("journal: got %q (%v), want two records", journal, err)
+	}
+
+	// Writing the index takes the journal in, and a journal that was left
+	// behind by a crash right after is not replayed again
+	if err = d.DeleteTag("gone", 0); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	if info, err := os.Stat(filepath.Join(root, journalFile)); err != nil || info.Size() != 0 {
+		t.Errorf("journal after writing the index: got %v (%v), want it empty", info, err)
+	}
+	// A record that was cut off half way was never acknowledged
+	torn := append(append([]byte{}, journal...), `{"Seq": 3, "User": 0, "Tag": "torn"`...)
+	if err = os.WriteFile(filepath.Join(root, journalFile), torn, 0o644); err != nil {
+		t.Fatalf("Failed to write journal: %s", err)
+	}
+	if d, err = CreateDisk(root); err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	if tags, _ := d.ListTags(0); !reflect.DeepEqual(tags, []string{"kept"}) {
+		t.Errorf("tags: got %v, want [kept]", tags)
+	}
+
+	// Entries only in the journal survive a restart
+	addArtifact(t, d, "journalled", "GET example.com/journalled", "kept")
+	if d, err = CreateDisk(root); err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	got, err := d.GetArtifact("GET example.com/journalled", "kept", 0)
+	if err != nil {
+		t.Fatalf("Failed to get journalled entry: %s", err)
+	}
+	if data := readArtifact(t, got); data != "journalled" {
+		t.Errorf("journalled entry: got %q", data)
+	}
+	if info, err := os.Stat(filepath.Join(root, journalFile)); err != nil || info.Size() != 0 {
+		t.Errorf("journal after reopening: got %v (%v), want it folded into the index", info, err)
+	}
+}
+
+func TestDiskDropsScratchTags(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+	addArtifact(t, d, "kept", "GET example.com/kept", "tag1")
+	// An import that was cut short
+	scratch := scratchTag("importing", "tag2")
+	addArtifact(t, d, "half imported", "GET example.com/half", scratch)
+	if tags, _ := d.ListTags(0); !reflect.DeepEqual(tags, []string{"tag1"}) {
+		t.Errorf("tags: got %q, want [tag1]", tags)
+	}
+
+	if d, err = CreateDisk(root); err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	if _, err = d.ListArtifacts(scratch, 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("scratch tag after a restart: got %v, want ErrNotFound", err)
+	}
+	if freed, err := d.GC(); err != nil || freed != int64(len("half imported")) {
+		t.Errorf("GC: freed %d (%v), want the scratch blob", freed, err)
+	}
+}
+
+func TestDiskContentAddressed(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+
+	for _, tag := range []string{"tag1", "tag2", "tag3"} {
+		if err = d.AddArtifact(&Artifact{}, strings.NewReader("same bytes"), "example.com/same", tag, 0); err != nil {
+			t.Fatalf("Failed to add artifact: %s", err)
+		}
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(root, blobDir))
+	if err != nil {
+		t.Fatalf("Failed to list blobs: %s", err)
+	}
+	if len(blobs) != 1 {
+		t.Errorf("blobs: got %d, want 1", len(blobs))
+	}
+	leftovers, err := os.ReadDir(filepath.Join(root, tmpDir))
+	if err != nil {
+		t.Fatalf("Failed to list tmp: %s", err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("tmp: got %d leftover files, want 0", len(leftovers))
+	}
+}
+
+func TestDiskTagManagement(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+	if err = d.AddArtifact(&Artifact{}, strings.NewReader("a"), "GET example.com/a", "base", 0); err != nil {
+		t.Fatalf("Failed to add artifact: %s", err)
+	}
+
+	if err = d.CopyTag("base", "copy", 0); err != nil {
+		t.Errorf("Failed to copy tag: %s", err)
+	}
+	if err = d.CopyTag("base", "copy", 0); !errors.Is(err, ErrExists) {
+		t.Errorf("CopyTag onto an existing tag: got %v, want %v", err, ErrExists)
+	}
+	if err = d.RenameTag("copy", "renamed", 0); err != nil {
+		t.Errorf("Failed to rename tag: %s", err)
+	}
+	if err = d.DeleteTag("base", 0); err != nil {
+		t.Errorf("Failed to delete tag: %s", err)
+	}
+	if err = d.DeleteTag("base", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteTag of a missing tag: got %v, want %v", err, ErrNotFound)
+	}
+
+	// Simulate a restart
+	d, err = CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	tags, err := d.ListTags(0)
+	if err != nil {
+		t.Fatalf("Failed to list tags: %s", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"renamed"}) {
+		t.Errorf("tags: got %v, want [renamed]", tags)
+	}
+	artifacts, err := d.ListArtifacts("renamed", 0)
+	if err != nil {
+		t.Fatalf("Failed to list artifacts: %s", err)
+	}
+	artifact, ok := artifacts["GET example.com/a"]
+	if !ok {
+		t.Fatalf("artifacts: got %v, want GET example.com/a", artifacts)
+	}
+	if body := readArtifact(t, artifact); body != "a" {
+		t.Errorf("artifact: got %s, want a", body)
+	}
+}
+
+func TestDiskVerifiesOnRead(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+
+	original := strings.Repeat("the real bytes ", 1000)
+	artifact := &Artifact{}
+	if err = d.AddArtifact(artifact, strings.NewReader(original), "GET example.com/a", "tag", 0); err != nil {
+		t.Fatalf("Failed to add artifact: %s", err)
+	}
+	if artifact.Algorithm != "sha256" || len(artifact.Hash) != 64 {
+		t.Errorf("digest: got %s:%s, want a sha256", artifact.Algorithm, artifact.Hash)
+	}
+
+	cases := []struct {
+		name   string
+		stored string
+	}{
+		{"flipped byte", strings.Replace(original, "real", "reel", 1)},
+		{"truncated", original[:len(original)-1]},
+		{"extended", original + "!"},
+		{"empty", ""},
+	}
+	path, suffix, err := d.findBlob(artifact.Hash)
+	if err != nil || suffix != compressedSuffix {
+		t.Fatalf("blob: got %s (%v), want it compressed", path, err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stored := &bytes.Buffer{}
+			gz := gzip.NewWriter(stored)
+			gz.Write([]byte(tc.stored))
+			gz.Close()
+			if err := os.WriteFile(path, stored.Bytes(), 0o644); err != nil {
+				t.Fatalf("Failed to corrupt blob: %s", err)
+			}
+			got, err := d.GetArtifact("GET example.com/a", "tag", 0)
+			if err != nil {
+				t.Fatalf("Failed to get artifact: %s", err)
+			}
+			buf := &bytes.Buffer{}
+			_, err = got.WriteTo(buf)
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("err: got %v, want %v", err, ErrCorrupt)
+			}
+			if buf.Len() >= len(tc.stored) && len(tc.stored) > 0 {
+				t.Errorf("Handed out all %d bytes of a corrupt artifact", buf.Len())
+			}
+		})
+	}
+}
+
+func TestDiskReadsLegacyMD5(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+
+	// What a store written before artifacts carried an algorithm looks like
+	body := "recorded a long time ago"
+	digest := md5.Sum([]byte(body))
+	hash := hex.EncodeToString(digest[:])
+	index := fmt.Sprintf(`{"Users":[{"ID":0,"Tags":{"old":{"Artifacts":{"GET example.com/a":{"Hash":"%s","Size":%d}}}}}]}`,
+		hash, len(body))
+	if err = os.WriteFile(filepath.Join(root, indexFile), []byte(index), 0o644); err != nil {
+		t.Fatalf("Failed to write index: %s", err)
+	}
+	if err = os.WriteFile(d.blobPath(hash), []byte(body), 0o644); err != nil {
+		t.Fatalf("Failed to write blob: %s", err)
+	}
+
+	d, err = CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	got, err := d.GetArtifact("GET example.com/a", "old", 0)
+	if err != nil {
+		t.Fatalf("Failed to get artifact: %s", err)
+	}
+	if data := readArtifact(t, got); data != body {
+		t.Errorf("artifact: got %s, want %s", data, body)
+	}
+}
+
+func TestDiskCompression(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+
+	random := make([]byte, 32<<10)
+	if _, err = rand.Read(random); err != nil {
+		t.Fatalf("Failed to generate random bytes: %s", err)
+	}
+	index := strings.Repeat(`<a href="/simple/package/">package</a><br/>`+"\n", 2000)
+	cases := []struct {
+		key    string
+		body   string
+		suffix string
+	}{
+		{"GET pypi.example.com/simple/", index, compressedSuffix},
+		{"GET example.com/go.mod", "module example.com/m\n", ""},
+		{"GET example.com/archive.tar.gz", string(random), ""},
+	}
+	for _, tc := range cases {
+		artifact := &Artifact{}
+		if err = d.AddArtifact(artifact, strings.NewReader(tc.body), tc.key, "tag", 0); err != nil {
+			t.Fatalf("Failed to add %s: %s", tc.key, err)
+		}
+		if artifact.Size != int64(len(tc.body)) {
+			t.Errorf("%s: size %d, want the uncompressed %d", tc.key, artifact.Size, len(tc.body))
+		}
+		_, suffix, err := d.findBlob(artifact.Hash)
+		if err != nil || suffix != tc.suffix {
+			t.Errorf("%s: stored as %q (%v), want %q", tc.key, suffix, err, tc.suffix)
+		}
+		got, err := d.GetArtifact(tc.key, "tag", 0)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %s", tc.key, err)
+		}
+		if data := readArtifact(t, got); data != tc.body {
+			t.Errorf("%s: body does not round trip", tc.key)
+		}
+	}
+
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %s", err)
+	}
+	if stats.CompressedBlobs != 1 || stats.CompressionRatio < 10 || stats.StoredSize >= stats.UniqueSize {
+		t.Errorf("stats: got %+v, want one blob compressed at least 10x", stats)
+	}
+
+	if err = d.DeleteTag("tag", 0); err != nil {
+		t.Fatalf("Failed to delete tag: %s", err)
+	}
+	freed, err := d.GC()
+	if err != nil || freed != stats.StoredSize {
+		t.Errorf("GC: freed %d (%v), want %d", freed, err, stats.StoredSize)
+	}
+}
+
+func TestDiskChunking(t *testing.T) {
+	root := t.TempDir()
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.Chunking = true
+	d.AddUser(CreateUser())
+
+	// Monday's ISO, and Tuesday's with a few bytes inserted and a few changed
+	monday := make([]byte, 4<<20)
+	mathrand.New(mathrand.NewSource(1)).Read(monday)
+	tuesday := append(append(append([]byte{}, monday[:1<<20]...), "a new file"...), monday[1<<20:]...)
+	copy(tuesday[3<<20:], "a changed file")
+	bodies := map[string][]byte{"mon": monday, "tue": tuesday}
+	for _, tag := range []string{"mon", "tue"} {
+		artifact := &Artifact{}
+		if err = d.AddArtifact(artifact, bytes.NewReader(bodies[tag]), "GET example.com/nightly.iso", tag, 0); err != nil {
+			t.Fatalf("Failed to add %s: %s", tag, err)
+		}
+		if _, suffix, err := d.findBlob(artifact.Hash); err != nil || suffix != chunkedSuffix {
+			t.Errorf("%s: stored as %q (%v), want it chunked", tag, suffix, err)
+		}
+	}
+	// Chunks wait for their commit in closed files, not one descriptor each
+	if before, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fresh := make([]byte, 4<<20)
+		mathrand.New(mathrand.NewSource(2)).Read(fresh)
+		staged, err := d.stageChunks(&Artifact{}, bytes.NewReader(fresh), 0)
+		if err != nil {
+			t.Fatalf("Failed to stage chunks: %s", err)
+		}
+		after, _ := os.ReadDir("/proc/self/fd")
+		if len(staged.files) < 16 || len(after) > len(before) {
+			t.Errorf("staged %d chunks with %d descriptors open, had %d", len(staged.files), len(after), len(before))
+		}
+		staged.discard()
+	}
+	small := addArtifact(t, d, "small enough to keep whole", "GET example.com/sha256sums", "tue")
+	if _, suffix, err := d.findBlob(small.Hash); err != nil || suffix != "" {
+		t.Errorf("small body: stored as %q (%v), want it whole", suffix, err)
+	}
+
+	stats, err := d.TagStats("tue", 0)
+	if err != nil {
+		t.Fatalf("Failed to get tag stats: %s", err)
+	}
+	if stats.Entries != 2 || stats.LogicalSize != int64(len(tuesday))+26 || stats.SharedSize < stats.ChunkedSize*8/10 {
+		t.Errorf("tag stats: got %+v, want most of tue shared with mon", stats)
+	}
+	if stats.SavedSize != stats.LogicalSize-(stats.ChunkedSize-stats.SharedSize) {
+		t.Errorf("tag stats: SavedSize %d does not add up", stats.SavedSize)
+	}
+	total, err := d.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %s", err)
+	}
+	if total.Chunks == 0 || total.StoredSize > int64(len(monday))*13/10 {
+		t.Errorf("stats: got %+v, want the two ISOs to take little more than one", total)
+	}
+
+	if err = d.DeleteTag("mon", 0); err != nil {
+		t.Fatalf("Failed to delete mon: %s", err)
+	}
+	if _, err = d.GC(); err != nil {
+		t.Fatalf("Failed to GC: %s", err)
+	}
+	got, err := d.GetArtifact("GET example.com/nightly.iso", "tue", 0)
+	if err != nil {
+		t.Fatalf("Failed to get tue: %s", err)
+	}
+	if data := readArtifact(t, got); data != string(tuesday) {
+		t.Errorf("tue does not round trip after collecting mon")
+	}
+
+	if err = d.DeleteTag("tue", 0); err != nil {
+		t.Fatalf("Failed to delete tue: %s", err)
+	}
+	if _, err = d.GC(); err != nil {
+		t.Fatalf("Failed to GC: %s", err)
+	}
+	chunks, err := os.ReadDir(filepath.Join(root, chunkDir))
+	if err != nil || len(chunks) != 0 {
+		t.Errorf("chunks after deleting everything: got %d (%v), want 0", len(chunks), err)
+	}
+}
+
+func TestDiskEncryption(t *testing.T) {
+	root := t.TempDir()
+	master := bytes.Repeat([]byte{1}, keySize)
+	d, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+	legacy := addArtifact(t, d, "recorded before encryption", "GET example.com/legacy", "tag")
+	if err = d.EnableEncryption(master); err != nil {
+		t.Fatalf("Failed to enable encryption: %s", err)
+	}
+	d.Chunking = true
+
+	chunked := make([]byte, 2<<20)
+	mathrand.New(mathrand.NewSource(1)).Read(chunked)
+	bodies := map[string]string{
+		"GET example.com/legacy":     "recorded before encryption",
+		"GET example.com/small":      "a secret",
+		"GET example.com/compressed": strings.Repeat("a compressible secret ", 1000),
+		"GET example.com/chunked":    string(chunked),
+	}
+	for key, body := range bodies {
+		if key != "GET example.com/legacy" {
+			addArtifact(t, d, body, key, "tag")
+		}
+	}
+	stored, err := filepath.Glob(filepath.Join(root, "*", "*"))
+	if err != nil {
+		t.Fatalf("Failed to list the store: %s", err)
+	}
+	for _, path := range stored {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, chunked[:64]) {
+			t.Errorf("%s holds plaintext", filepath.Base(path))
+		}
+	}
+	blobs := func() (sums map[string][]byte) {
+		sums = make(map[string][]byte)
+		for _, dir := range []string{blobDir, chunkDir} {
+			entries, _ := os.ReadDir(filepath.Join(root, dir))
+			for _, entry := range entries {
+				data, _ := os.ReadFile(filepath.Join(root, dir, entry.Name()))
+				sums[dir+"/"+entry.Name()] = data
+			}
+		}
+		return sums
+	}
+	before := blobs()
+
+	// Rotate, then reopen with the old and the new key
+	rotated := bytes.Repeat([]byte{2}, keySize)
+	if err = d.RotateMasterKey(rotated); err != nil {
+		t.Fatalf("Failed to rotate: %s", err)
+	}
+	if !reflect.DeepEqual(blobs(), before) {
+		t.Errorf("Rotating rewrote blobs")
+	}
+	d, err = CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	if err = d.EnableEncryption(master); err == nil {
+		t.Errorf("Reopened with the master key from before rotating")
+	}
+	if err = d.EnableEncryption(rotated); err != nil {
+		t.Fatalf("Failed to reopen with the rotated key: %s", err)
+	}
+	d.AddUser(CreateUser())
+	if freed, err := d.GC(); err != nil || freed != 0 {
+		t.Errorf("GC: freed %d (%v), want nothing", freed, err)
+	}
+	for key, body := range bodies {
+		artifact, err := d.GetArtifact(key, "tag", 0)
+		if err != nil {
+			t.Errorf("Failed to get %s: %s", key, err)
+			continue
+		}
+		if got := readArtifact(t, artifact); got != body {
+			t.Errorf("%s does not round trip", key)
+		}
+	}
+	if artifact, _ := d.GetArtifact("GET example.com/legacy", "tag", 0); artifact.Hash != legacy.Hash {
+		t.Errorf("legacy blob: got hash %s, want %s", artifact.Hash, legacy.Hash)
+	}
+
+	// Without a master key encrypted blobs can not be read
+	plain, err := CreateDisk(root)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %s", err)
+	}
+	if artifact, err := plain.GetArtifact("GET example.com/small", "tag", 0); err == nil {
+		if _, err = artifact.WriteTo(io.Discard); err == nil {
+			t.Errorf("Read an encrypted blob without the master key")
+		}
+	}
+
+	// Tampering and truncating are caught
+	small, _ := d.GetArtifact("GET example.com/small", "tag", 0)
+	path, _, err := d.findBlob(d.storedID(small.Hash, 0))
+	if err != nil {
+		t.Fatalf("Failed to find the encrypted blob: %s", err)
+	}
+	sealed, _ := os.ReadFile(path)
+	for name, damaged := range map[string][]byte{
+		"flipped":   append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1),
+		"truncated": sealed[:len(encryptedMagic)+noncePrefixLen],
+	} {
+		if err = os.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatalf("Failed to damage the blob: %s", err)
+		}
+		artifact, err := d.GetArtifact("GET example.com/small", "tag", 0)
+		if err == nil {
+			_, err = artifact.WriteTo(io.Discard)
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: got %v, want ErrCorrupt", name, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2, see http://www.softwareishard.com/blog/har-12-spec/
+// Only the parts btrfly can fill in or make use of are modelled.
+
+type harLog struct {
+	Log harContents `json:"log"`
+}
+
+type harContents struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	// BtrflyKey is the exact key the entry was recorded under, so our own
+	// exports come back unchanged even with different matching rules.
+	BtrflyKey string `json:"_btrflyKey,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(header http.Header) (pairs []harNameValue) {
+	pairs = make([]harNameValue, 0, len(header))
+	for _, name := range sortedHeaderNames(header) {
+		for _, value := range header[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+func harQuery(URL string) (pairs []harNameValue) {
+	pairs = make([]harNameValue, 0)
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return pairs
+	}
+	query := parsed.Query()
+	for _, name := range sortedHeaderNames(http.Header(query)) {
+		for _, value := range query[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+// ExportHAR writes tag to w as a HAR 1.2 log. Entries are encoded one at a
+// time, so only a single body is held in memory at once.
+func ExportHAR(k Handler, w io.Writer, tag string, userID uint64) (err error) {
+	artifacts, err := k.ListArtifacts(tag, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, `{"log":{"version":"1.2","creator":{"name":"btrfly","version":"0"},"entries":[`)
+	if err != nil {
+		return err
+	}
+	for i, key := range sortedKeys(artifacts) {
+		entry, err := harExportEntry(key, artifacts[key])
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %s", key, err)
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %s", key, err)
+		}
+		if i > 0 {
+			data = append([]byte(","), data...)
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}}\n")
+	return err
+}
+
+func harExportEntry(key string, artifact *Artifact) (entry harEntry, err error) {
+	buf := &bytes.Buffer{}
+	if _, err = artifact.WriteTo(buf); err != nil {
+		return entry, err
+	}
+	content := harContent{Size: artifact.Size, MimeType: artifact.Header.Get("Content-Type")}
+	if utf8.Valid(buf.Bytes()) && artifact.Header.Get("Content-Encoding") == "" {
+		content.Text = buf.String()
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(buf.Bytes())
+		content.Encoding = "base64"
+	}
+
+	method, URL := SplitKey(key)
+	URL = "http://" + URL
+	statusCode := artifact.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	entry = harEntry{
+		StartedDateTime: time.Now().UTC().Format(time.RFC3339Nano),
+		Request: harRequest{
+			Method:      method,
+			URL:         URL,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(KeyHeaders(key)),
+			QueryString: harQuery(URL),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      statusCode,
+			StatusText:  http.StatusText(statusCode),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(artifact.Header),
+			Content:     content,
+			RedirectURL: artifact.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    artifact.Size,
+		},
+		BtrflyKey: key,
+	}
+	return entry, nil
+}
+
+// ImportHAR records every entry of a HAR log into tag, which must not exist
+// yet. Entries that do not come from a btrfly export get their key from m.
+// When a URL shows up more than once the last entry wins, just like when
+// recording. Nothing is left behind when the import fails.
+func ImportHAR(k Handler, r io.Reader, m *Matcher, tag string, userID uint64) (err error) {
+	har := harLog{}
+	if err = json.NewDecoder(r).Decode(&har); err != nil {
+		return fmt.Errorf("failed to decode HAR: %s", err)
+	}
+	if err = checkNewTag(k, tag, userID); err != nil {
+		return err
+	}
+	// Entries are staged out of sight and only show up in tag once all of
+	// them are in
+	staging := scratchTag("importing", tag)
+	defer func() {
+		if err != nil {
+			if cleanupErr := k.DeleteTag(staging, userID); cleanupErr != nil && !errors.Is(cleanupErr, ErrNotFound) {
+				err = fmt.Errorf("%s (and failed to clean up: %s)", err, cleanupErr)
+			}
+		}
+	}()
+
+	for i, entry := range har.Log.Entries {
+		if err = harImportEntry(k, m, entry, staging, userID); err != nil {
+			return fmt.Errorf("entry %d (%s %s): %s", i, entry.Request.Method, entry.Request.URL, err)
+		}
+	}
+	return publishStaged(k, staging, tag, nil, nil, userID)
+}
+
+func harImportEntry(k Handler, m *Matcher, entry harEntry, tag string, userID uint64) (err error) {
+	key := entry.BtrflyKey
+	if key == "" {
+		var body io.Reader = http.NoBody
+		if entry.Request.PostData != nil && entry.Request.PostData.Text != "" {
+			body = strings.NewReader(entry.Request.PostData.Text)
+		}
+		req, err := http.NewRequest(entry.Request.Method, entry.Request.URL, body)
+		if err != nil {
+			return err
+		}
+		for _, pair := range entry.Request.Headers {
+			req.Header.Add(pair.Name, pair.Value)
+		}
+		if key, err = m.Key(req); err != nil {
+			return err
+		}
+	}
+
+	header := http.Header{}
+	for _, pair := range entry.Response.Headers {
+		header.Add(pair.Name, pair.Value)
+	}
+	if entry.BtrflyKey == "" {
+		// Other tools store the decoded body, so the encoding and length the
+		// server sent no longer describe it. Pseudo headers come from HTTP/2.
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		for name := range header {
+			if strings.HasPrefix(name, ":") {
+				header.Del(name)
+			}
+		}
+	}
+
+	body := []byte(entry.Response.Content.Text)
+	if entry.Response.Content.Encoding == "base64" {
+		if body, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text); err != nil {
+			return fmt.Errorf("failed to decode body: %s", err)
+		}
+	}
+	artifact := &Artifact{StatusCode: entry.Response.Status, Header: header}
+	return k.AddArtifact(artifact, bytes.NewReader(body), key, tag, userID)
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHARRoundTrip(t *testing.T) {
+	src := CreateMemory()
+	src.AddUser(CreateUser())
+	bodies := map[string]string{
+		"GET example.com/index.html":                  "<html>hi</html>",
+		"GET example.com/logo.png":                    "\x89PNG\r\n\x1a\n\x00\xff",
+		"GET registry.example.com/pkg Accept=a%2Fb":   `{"name":"pkg"}`,
+		"POST example.com/graphql body=sha256:abcdef": `{"data":{}}`,
+	}
+	for key, body := range bodies {
+		artifact := &Artifact{StatusCode: 200, Header: http.Header{"Content-Type": {"x/" + key[:4]}}}
+		if err := src.AddArtifact(artifact, strings.NewReader(body), key, "build", 0); err != nil {
+			t.Fatalf("Failed to add artifact: %s", err)
+		}
+	}
+
+	har := &bytes.Buffer{}
+	if err := ExportHAR(src, har, "build", 0); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+	decoded := harLog{}
+	if err := json.Unmarshal(har.Bytes(), &decoded); err != nil {
+		t.Fatalf("Export is not valid JSON: %s\n%s", err, har)
+	}
+	if decoded.Log.Version != "1.2" || len(decoded.Log.Entries) != len(bodies) {
+		t.Errorf("log: got version %s with %d entries, want 1.2 with %d", decoded.Log.Version, len(decoded.Log.Entries), len(bodies))
+	}
+	headers := decoded.Log.Entries[2].Request.Headers
+	if !reflect.DeepEqual(headers, []harNameValue{{"Accept", "a/b"}}) {
+		t.Errorf("request headers: got %v, want Accept: a/b", headers)
+	}
+
+	forEachHandler(t, func(t *testing.T, dst Handler) {
+		if err := ImportHAR(dst, bytes.NewReader(har.Bytes()), &Matcher{}, "imported", 0); err != nil {
+			t.Fatalf("Failed to import: %s", err)
+		}
+		for key, body := range bodies {
+			got, err := dst.GetArtifact(key, "imported", 0)
+			if err != nil {
+				t.Errorf("Failed to get %s: %s", key, err)
+				continue
+			}
+			if data := readArtifact(t, got); data != body {
+				t.Errorf("%s: got %q, want %q", key, data, body)
+			}
+			if got.Header.Get("Content-Type") != "x/"+key[:4] {
+				t.Errorf("%s: got Content-Type %s", key, got.Header.Get("Content-Type"))
+			}
+		}
+	})
+}
+
+func TestHARImportForeign(t *testing.T) {
+	// Trimmed down from what a browser writes
+	har := `{"log": {"version": "1.2", "creator": {"name": "WebInspector", "version": "537.36"},
+	"entries": [
+		{"request": {"method": "GET", "url": "https://example.com/app.js?v=1",
+		             "headers": [{"name": "Accept", "value": "*/*"}]},
+		 "response": {"status": 200, "headers": [
+		                {"name": ":status", "value": "200"},
+		                {"name": "content-encoding", "value": "br"},
+		                {"name": "content-length", "value": "9"},
+		                {"name": "content-type", "value": "text/javascript"}],
+		              "content": {"size": 13, "mimeType": "text/javascript", "text": "YWxlcnQoImhpIik=", "encoding": "base64"}}},
+		{"request": {"method": "POST", "url": "https://example.com/api",
+		             "postData": {"mimeType": "application/json", "text": "{\"q\":1}"}},
+		 "response": {"status": 201, "headers": [], "content": {"size": 2, "text": "ok"}}},
+		{"request": {"method": "GET", "url": "https://example.com/app.js?v=1"},
+		 "response": {"status": 200, "headers": [], "content": {"size": 6, "text": "newest"}}}
+	]}}`
+	m := &Matcher{Default: MatchRule{Headers: []string{"Accept"}, Body: true}}
+
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		if err := ImportHAR(k, strings.NewReader(har), m, "devtools", 0); err != nil {
+			t.Fatalf("Failed to import: %s", err)
+		}
+		cases := []struct {
+			key    string
+			status int
+			header http.Header
+			body   string
+		}{
+			{"GET example.com/app.js?v=1 Accept=%2A%2F%2A", 200,
+				http.Header{"Content-Type": {"text/javascript"}}, `alert("hi")`},
+			{"POST example.com/api body=sha256:6ae0f660046dadcf5fe8462c0e00a062db4c8d67be82f4098c5ea4208d19b076", 201,
+				http.Header{}, "ok"},
+			{"GET example.com/app.js?v=1", 200, http.Header{}, "newest"},
+		}
+		for _, tc := range cases {
+			got, err := k.GetArtifact(tc.key, "devtools", 0)
+			if err != nil {
+				t.Errorf("Failed to get %s: %s", tc.key, err)
+				continue
+			}
+			if got.StatusCode != tc.status || !reflect.DeepEqual(got.Header, tc.header) {
+				t.Errorf("%s: got %d %v, want %d %v", tc.key, got.StatusCode, got.Header, tc.status, tc.header)
+			}
+			if data := readArtifact(t, got); data != tc.body {
+				t.Errorf("%s: got %q, want %q", tc.key, data, tc.body)
+			}
+		}
+
+		if err := ImportHAR(k, strings.NewReader(`{"log": `), m, "broken", 0); err == nil {
+			t.Errorf("Imported a truncated HAR")
+		}
+		// An entry that fails halfway leaves nothing of the ones before it
+		halfway := `{"log": {"entries": [
+			{"request": {"method": "GET", "url": "https://example.com/fine"},
+			 "response": {"status": 200, "headers": [], "content": {"size": 4, "text": "fine"}}},
+			{"request": {"method": "GET", "url": "https://example.com/broken"},
+			 "response": {"status": 200, "headers": [], "content": {"size": 4, "text": "!!!!", "encoding": "base64"}}}
+		]}}`
+		if err := ImportHAR(k, strings.NewReader(halfway), m, "halfway", 0); err == nil {
+			t.Errorf("Imported an entry with a broken body")
+		}
+		if tags, _ := k.ListTags(0); !reflect.DeepEqual(tags, []string{"devtools"}) {
+			t.Errorf("tags after a failed import: got %v, want [devtools]", tags)
+		}
+	})
+}
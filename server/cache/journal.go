@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Rewriting the whole index for every recorded entry makes recording n
+// entries cost n² and keeps playback waiting on an fsync each time. Instead
+// new entries are appended to <Root>/journal.jsonl, one JSON record per line,
+// and synced after the index lock is let go, so concurrent recordings share
+// an fsync. The journal is replayed over index.json when the store is
+// opened, and folded into it whenever the index is written anyway or the
+// journal grows larger than the index.
+const (
+	journalFile = "journal.jsonl"
+	// journalMinSize keeps small stores from rewriting their index all the time
+	journalMinSize = 1 << 20
+)
+
+// journalRecord is an entry recorded after the index was last written.
+type journalRecord struct {
+	// Seq counts records over the life of the store. The index remembers
+	// the last one it holds, so a journal that outlives the index it was
+	// folded into is not replayed twice.
+	Seq      uint64
+	User     uint64
+	Tag      string
+	Key      string
+	Artifact *Artifact
+	// RecordedAt is when the tag was recorded into, replaying is not
+	RecordedAt time.Time
+}
+
+// openJournal replays the journal left by a previous run over the index just
+// read and opens it for appending. It has to be called before the store is
+// handed out.
+func (d *Disk) openJournal() (err error) {
+	path := filepath.Join(d.Root, journalFile)
+	f, err := os.Open(path)
+	if err == nil {
+		err = d.replayJournal(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open journal: %s", err)
+	}
+	if d.journal, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return fmt.Errorf("failed to open journal: %s", err)
+	}
+	info, err := d.journal.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %s", err)
+	}
+	// Whatever was replayed goes into the index right away
+	if d.journalSize = info.Size(); d.journalSize > 0 {
+		return d.writeIndex()
+	}
+	return nil
+}
+
+func (d *Disk) replayJournal(r io.Reader) (err error) {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// A record without its newline was never synced, nobody was
+			// told it was stored
+			if len(line) > 0 {
+				log.Printf("Dropping a torn record at the end of the btrfly journal")
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read journal: %s", err)
+		}
+		record := journalRecord{}
+		if err = json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("failed to decode journal record %d: %s", n, err)
+		}
+		if record.Seq > d.seq {
+			d.seq = record.Seq
+		} else {
+			continue
+		}
+		// Scratch tags are dropped on restart, like the ones in the index
+		user, err := d.getUser(record.User)
+		if err != nil || isScratch(record.Tag) || record.Artifact == nil {
+			continue
+		}
+		user.record(record.Tag, record.Key, record.Artifact)
+		tag := user.Tags[record.Tag]
+		tag.RecordedAt = record.RecordedAt
+		if !strings.Contains(record.Key, " ") {
+			migrateKeys(tag)
+		}
+	}
+}
+
+// journalEntry appends an entry that was just recorded to the journal and
+// returns its sequence number. It has to be called with d.mu held. The entry
+// is only durable once syncJournal was called with that number, which does
+// not need the lock.
+func (d *Disk) journalEntry(userID uint64, tag string, key string, artifact *Artifact, recordedAt time.Time) (seq uint64, err error) {
+	seq = d.seq + 1
+	data, err := json.Marshal(journalRecord{Seq: seq, User: userID, Tag: tag, Key: key, Artifact: artifact, RecordedAt: recordedAt})
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode journal record: %s", err)
+	}
+	atomic.StoreUint64(&d.seq, seq)
+	n, err := d.journal.Write(append(data, '\n'))
+	d.journalSize += int64(n)
+	if err != nil {
+		// Folding the journal into the index does away with whatever part
+		// of the record made it in, and stores the entry all the same
+		log.Printf("Failed to write btrfly journal, writing the index instead: %s", err)
+		return 0, d.writeIndex()
+	}
+	if d.journalSize > journalMinSize && d.journalSize > d.indexSize {
+		// The index written in its place is durable already
+		return 0, d.writeIndex()
+	}
+	return seq, nil
+}
+
+// syncJournal makes the journal durable up to and including record seq.
+// Whoever syncs first syncs everything written so far for those waiting
+// behind them.
+func (d *Disk) syncJournal(seq uint64) (err error) {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+
+	if seq <= d.synced {
+		return nil
+	}
+	written := atomic.LoadUint64(&d.seq)
+	if err = d.journal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %s", err)
+	}
+	d.synced = written
+	return nil
+}
+
+// truncateJournal empties the journal once the index holds all of it. It has
+// to be called with d.mu held.
+func (d *Disk) truncateJournal() (err error) {
+	if d.journal == nil {
+		return nil
+	}
+	if err = d.journal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate journal: %s", err)
+	}
+	d.journalSize = 0
+	return nil
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emmettmcdow/btrfly/attest"
+	"io"
+	"sort"
+)
+
+// Manifest is a lockfile for a tag, shared with the client, see the attest
+// package.
+type (
+	Manifest      = attest.Manifest
+	ManifestEntry = attest.ManifestEntry
+)
+
+// ManifestReport lists where a tag no longer matches a manifest, every list
+// sorted by key.
+type ManifestReport struct {
+	// Missing entries are in the manifest but not in the tag, Unexpected
+	// ones the other way around
+	Missing    []ManifestEntry
+	Unexpected []ManifestEntry
+	Changed    []ManifestChange
+}
+
+// ManifestChange is a key whose body differs from the one in the manifest.
+type ManifestChange struct {
+	Key        string
+	WantDigest string
+	WantSize   int64
+	GotDigest  string
+	GotSize    int64
+}
+
+// OK reports whether the tag matched the manifest.
+func (r ManifestReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0 && len(r.Changed) == 0
+}
+
+// digest is the manifest form of an artifact's hash.
+func digest(artifact *Artifact) string {
+	algorithm := artifact.Algorithm
+	if algorithm == "" {
+		algorithm = "md5"
+	}
+	return algorithm + ":" + artifact.Hash
+}
+
+// BuildManifest describes what tag plays back, sorted by key. Entries
+// inherited from the tags it is layered on are marked with where they come
+// from.
+func BuildManifest(k Handler, tag string, userID uint64) (manifest Manifest, err error) {
+	artifacts, from, err := resolveArtifacts(k, tag, userID)
+	if err != nil {
+		return manifest, err
+	}
+	manifest = Manifest{Tag: tag, Entries: make([]ManifestEntry, 0, len(artifacts))}
+	for _, key := range sortedKeys(artifacts) {
+		method, URL := SplitKey(key)
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Key:    key,
+			Method: method,
+			URL:    URL,
+			Digest: digest(artifacts[key]),
+			Size:   artifacts[key].Size,
+			From:   from[key],
+		})
+	}
+	return manifest, nil
+}
+
+// resolveArtifacts lists every entry tag plays back, falling back through its
+// parents in the same order as playback does. from maps the keys that are
+// inherited to the tag they come from.
+func resolveArtifacts(k Handler, tag string, userID uint64) (artifacts map[string]*Artifact, from map[string]string, err error) {
+	artifacts = make(map[string]*Artifact)
+	from = make(map[string]string)
+	visited := make(map[string]bool)
+	var resolve func(name string) error
+	resolve = func(name string) (err error) {
+		if visited[name] {
+			return nil
+		}
+		visited[name] = true
+		own, err := k.ListArtifacts(name, userID)
+		if err != nil {
+			return err
+		}
+		for key, artifact := range own {
+			if _, ok := artifacts[key]; !ok {
+				artifacts[key] = artifact
+				if name != tag {
+					from[key] = name
+				}
+			}
+		}
+		parents, err := k.Parents(name, userID)
+		if err != nil {
+			return err
+		}
+		for _, parent := range parents {
+			if err = resolve(parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = resolve(tag); err != nil {
+		return nil, nil, err
+	}
+	return artifacts, from, nil
+}
+
+// WriteManifest renders the manifest of tag to w in its canonical form:
+// indented JSON with a trailing newline, the same bytes for the same entries.
+func WriteManifest(k Handler, w io.Writer, tag string, userID uint64) (err error) {
+	manifest, err := BuildManifest(k, tag, userID)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s", err)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// VerifyManifest checks tag against manifest. The tag defaults to the one the
+// manifest was made from.
+func VerifyManifest(k Handler, manifest Manifest, tag string, userID uint64) (report ManifestReport, err error) {
+	if tag == "" {
+		tag = manifest.Tag
+	}
+	current, err := BuildManifest(k, tag, userID)
+	if err != nil {
+		return report, err
+	}
+	got := make(map[string]ManifestEntry, len(current.Entries))
+	for _, entry := range current.Entries {
+		got[entry.Key] = entry
+	}
+
+	report = ManifestReport{Missing: []ManifestEntry{}, Unexpected: []ManifestEntry{}, Changed: []ManifestChange{}}
+	want := make(map[string]bool, len(manifest.Entries))
+	entries := append([]ManifestEntry(nil), manifest.Entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	for _, entry := range entries {
+		want[entry.Key] = true
+		actual, ok := got[entry.Key]
+		if !ok {
+			report.Missing = append(report.Missing, entry)
+		} else if actual.Digest != entry.Digest || actual.Size != entry.Size {
+			report.Changed = append(report.Changed, ManifestChange{
+				Key:        entry.Key,
+				WantDigest: entry.Digest,
+				WantSize:   entry.Size,
+				GotDigest:  actual.Digest,
+				GotSize:    actual.Size,
+			})
+		}
+	}
+	for _, entry := range current.Entries {
+		if !want[entry.Key] {
+			report.Unexpected = append(report.Unexpected, entry)
+		}
+	}
+	return report, nil
+}
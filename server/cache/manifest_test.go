@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		b := addArtifact(t, k, "bee", "GET example.com/b", "build")
+		a := addArtifact(t, k, "a", "GET example.com/a", "build")
+		gone := addArtifact(t, k, "gone", "GET example.com/gone", "build")
+
+		first := &bytes.Buffer{}
+		if err := WriteManifest(k, first, "build", 0); err != nil {
+			t.Fatalf("Failed to write manifest: %s", err)
+		}
+		want := `{
+  "Tag": "build",
+  "Entries": [
+    {
+      "Key": "GET example.com/a",
+      "Method": "GET",
+      "URL": "example.com/a",
+      "Digest": "sha256:` + a.Hash + `",
+      "Size": 1
+    },
+    {
+      "Key": "GET example.com/b",
+      "Method": "GET",
+      "URL": "example.com/b",
+      "Digest": "sha256:` + b.Hash + `",
+      "Size": 3
+    },
+    {
+      "Key": "GET example.com/gone",
+      "Method": "GET",
+      "URL": "example.com/gone",
+      "Digest": "sha256:` + gone.Hash + `",
+      "Size": 4
+    }
+  ]
+}
+`
+		if first.String() != want {
+			t.Errorf("manifest:\n    got: %s\n    want: %s", first, want)
+		}
+		// Recording the same bytes again renders the same manifest
+		addArtifact(t, k, "a", "GET example.com/a", "build")
+		second := &bytes.Buffer{}
+		if err := WriteManifest(k, second, "build", 0); err != nil || second.String() != first.String() {
+			t.Errorf("Manifest changed without the recording changing (%v)", err)
+		}
+
+		manifest := Manifest{}
+		if err := json.Unmarshal(first.Bytes(), &manifest); err != nil {
+			t.Fatalf("Failed to decode manifest: %s", err)
+		}
+		if report, err := VerifyManifest(k, manifest, "", 0); err != nil || !report.OK() {
+			t.Errorf("unchanged tag: got %+v (%v), want a match", report, err)
+		}
+
+		changed := addArtifact(t, k, "changed", "GET example.com/b", "build")
+		added := addArtifact(t, k, "added", "GET example.com/added", "build")
+		if err := k.DeleteTag("build", 0); err != nil {
+			t.Fatalf("Failed to delete: %s", err)
+		}
+		addArtifact(t, k, "a", "GET example.com/a", "rebuild")
+		k.TagArtifact(changed, "rebuild", "GET example.com/b", 0)
+		k.TagArtifact(added, "rebuild", "GET example.com/added", 0)
+		report, err := VerifyManifest(k, manifest, "rebuild", 0)
+		if err != nil {
+			t.Fatalf("Failed to verify: %s", err)
+		}
+		wantReport := ManifestReport{
+			Missing:    []ManifestEntry{manifest.Entries[2]},
+			Unexpected: []ManifestEntry{{Key: "GET example.com/added", Method: "GET", URL: "example.com/added", Digest: "sha256:" + added.Hash, Size: 5}},
+			Changed: []ManifestChange{{
+				Key:        "GET example.com/b",
+				WantDigest: "sha256:" + b.Hash,
+				WantSize:   3,
+				GotDigest:  "sha256:" + changed.Hash,
+				GotSize:    7,
+			}},
+		}
+		if report.OK() || !reflect.DeepEqual(report, wantReport) {
+			t.Errorf("report:\n    got: %+v\n    want: %+v", report, wantReport)
+		}
+		if _, err = VerifyManifest(k, manifest, "", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("missing tag: got %v, want ErrNotFound", err)
+		}
+
+		// A layered tag lists what it inherits too, marked with where it
+		// comes from
+		if err = k.SetParents("layered", []string{"rebuild"}, 0); err != nil {
+			t.Fatalf("Failed to set parents: %s", err)
+		}
+		own := addArtifact(t, k, "own", "GET example.com/b", "layered")
+		layered, err := BuildManifest(k, "layered", 0)
+		if err != nil {
+			t.Fatalf("Failed to build manifest: %s", err)
+		}
+		wantEntries := []ManifestEntry{
+			{Key: "GET example.com/a", Method: "GET", URL: "example.com/a", Digest: "sha256:" + a.Hash, Size: 1, From: "rebuild"},
+			{Key: "GET example.com/added", Method: "GET", URL: "example.com/added", Digest: "sha256:" + added.Hash, Size: 5, From: "rebuild"},
+			{Key: "GET example.com/b", Method: "GET", URL: "example.com/b", Digest: "sha256:" + own.Hash, Size: 3},
+		}
+		if !reflect.DeepEqual(layered.Entries, wantEntries) {
+			t.Errorf("layered:\n    got: %+v\n    want: %+v", layered.Entries, wantEntries)
+		}
+		if report, err := VerifyManifest(k, layered, "", 0); err != nil || !report.OK() {
+			t.Errorf("layered tag: got %+v (%v), want a match", report, err)
+		}
+	})
+}
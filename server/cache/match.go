@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MatchRule decides which parts of a request, besides its method and URL,
+// make up the key an artifact is stored under.
+type MatchRule struct {
+	// Headers whose values take part in the key, e.g. Accept for registries
+	// doing content negotiation.
+	Headers []string
+	// Body hashes any non-empty request body into the key, e.g. for GraphQL
+	// or search APIs that POST the query. The body is read into memory to do
+	// so, up to MaxBody bytes (DefaultMaxBody when 0), and requests with a
+	// larger body fail with ErrBodyTooLarge.
+	Body    bool
+	MaxBody int64
+}
+
+// DefaultMaxBody is how much of a request body MatchRule.Body hashes by
+// default.
+const DefaultMaxBody = 1 << 20
+
+// ErrBodyTooLarge is wrapped by errors about request bodies too large to be
+// hashed into a key.
+var ErrBodyTooLarge = errors.New("request body too large to match on")
+
+// Matcher builds cache keys for requests. Hosts overrides Default for
+// requests to a specific host, with or without the port.
+type Matcher struct {
+	Default MatchRule
+	Hosts   map[string]MatchRule
+}
+
+func (m *Matcher) rule(host string) MatchRule {
+	if rule, ok := m.Hosts[host]; ok {
+		return rule
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		if rule, ok := m.Hosts[hostname]; ok {
+			return rule
+		}
+	}
+	return m.Default
+}
+
+// Key returns the cache key for r. It has the form
+//
+//	METHOD host/path?query [Header=value ...] [body=sha256:digest]
+//
+// The body is only read when the rule matches on it, and is left rewound for
+// whoever is next.
+func (m *Matcher) Key(r *http.Request) (key string, err error) {
+	rule := m.rule(r.Host)
+	key = r.Method + " " + r.Host + r.URL.RequestURI()
+
+	headers := make([]string, 0, len(rule.Headers))
+	for _, name := range rule.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(headers)
+	for _, name := range headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		key += " " + name + "=" + url.QueryEscape(strings.Join(values, ","))
+	}
+
+	if !rule.Body || r.Body == nil || r.Body == http.NoBody {
+		return key, nil
+	}
+	limit := rule.MaxBody
+	if limit <= 0 {
+		limit = DefaultMaxBody
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		r.Body.Close()
+		return "", fmt.Errorf("failed to read request body: %s", err)
+	}
+	// Whatever was read goes back in front of the rest
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if int64(len(body)) > limit {
+		return "", fmt.Errorf("body of %s is over %d bytes: %w", key, limit, ErrBodyTooLarge)
+	}
+	if len(body) > 0 {
+		digest := sha256.Sum256(body)
+		key += " body=sha256:" + hex.EncodeToString(digest[:])
+	}
+	return key, nil
+}
+
+// SplitKey returns the method and URL a key was built from.
+func SplitKey(key string) (method string, URL string) {
+	fields := strings.SplitN(key, " ", 3)
+	if len(fields) < 2 {
+		return "", key
+	}
+	return fields[0], fields[1]
+}
+
+// KeyHeaders returns the request headers that were matched into key.
+func KeyHeaders(key string) (header http.Header) {
+	header = http.Header{}
+	fields := strings.Split(key, " ")
+	if len(fields) < 3 {
+		return header
+	}
+	for _, field := range fields[2:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || name == "body" {
+			continue
+		}
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+		header.Set(name, unescaped)
+	}
+	return header
+}
+
+func sortedHeaderNames(header http.Header) (names []string) {
+	names = make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadMatcher reads a Matcher from a JSON file.
+func LoadMatcher(path string) (m *Matcher, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read matcher config: %s", err)
+	}
+	m = &Matcher{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to decode matcher config: %s", err)
+	}
+	return m, nil
+}
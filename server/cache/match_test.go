@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatcherKey(t *testing.T) {
+	m := &Matcher{
+		Hosts: map[string]MatchRule{
+			"registry.example.com": {Headers: []string{"accept", "Accept-Encoding"}},
+			"graphql.example.com":  {Body: true},
+			"small.example.com":    {Body: true, MaxBody: 4},
+		},
+	}
+	bodyDigest := "sha256:1b45598f9ff887df5f9ab1d2b1a02d387cc4691e07564b74c5364fe0dd2a1927"
+
+	cases := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers http.Header
+		want    string
+	}{
+		{"plain GET", "GET", "http://example.com/a?b=c", "", nil,
+			"GET example.com/a?b=c"},
+		{"method is part of the key", "HEAD", "http://example.com/a?b=c", "", nil,
+			"HEAD example.com/a?b=c"},
+		{"headers ignored by default", "GET", "http://example.com/a", "", http.Header{"Accept": {"text/html"}},
+			"GET example.com/a"},
+		{"configured headers are sorted", "GET", "http://registry.example.com/pkg", "",
+			http.Header{"Accept-Encoding": {"gzip"}, "Accept": {"application/json", "text/plain"}},
+			"GET registry.example.com/pkg Accept=application%2Fjson%2Ctext%2Fplain Accept-Encoding=gzip"},
+		{"rule applies with a port", "GET", "http://registry.example.com:8080/pkg", "",
+			http.Header{"Accept": {"text/html"}},
+			"GET registry.example.com:8080/pkg Accept=text%2Fhtml"},
+		{"body ignored by default", "POST", "http://example.com/graphql", "{query}", nil,
+			"POST example.com/graphql"},
+		{"body is hashed when matched on", "POST", "http://graphql.example.com/graphql", "{query}", nil,
+			"POST graphql.example.com/graphql body=" + bodyDigest},
+		{"body up to the limit", "POST", "http://small.example.com/q", "1234", nil,
+			"POST small.example.com/q body=sha256:03ac674216f3e15c761ee1a5e255f067953623c8b388b4459e13f978d7c846f4"},
+		{"body over the limit", "POST", "http://small.example.com/q", "12345", nil, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader = http.NoBody
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			r := httptest.NewRequest(tc.method, tc.target, body)
+			for name, values := range tc.headers {
+				r.Header[name] = values
+			}
+			got, err := m.Key(r)
+			if tc.want == "" {
+				if !errors.Is(err, ErrBodyTooLarge) {
+					t.Errorf("err: got %v, want ErrBodyTooLarge", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Failed to build key: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("key: got %s, want %s", got, tc.want)
+			}
+			// The body still has to make it upstream
+			rest, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("Failed to read body: %s", err)
+			}
+			if string(rest) != tc.body {
+				t.Errorf("body: got %s, want %s", rest, tc.body)
+			}
+			if tc.want == "" {
+				return
+			}
+			method, URL := SplitKey(got)
+			if method != tc.method || !strings.HasPrefix(tc.target, "http://"+URL) {
+				t.Errorf("SplitKey: got %s %s, want %s %s", method, URL, tc.method, tc.target)
+			}
+		})
+	}
+}
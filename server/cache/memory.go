@@ -1,70 +1,320 @@
 package cache
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"sync"
+	"time"
 )
 
 // Implements btrfly.Handler
 // For testing
 type Memory struct {
-	Artifacts []*Artifact
-	Users     []*User
+	// Blobs holds the body of every artifact once, keyed by hash
+	Blobs map[string][]byte
+	Users []*User
+
+	mu sync.Mutex
 }
 
 func (m *Memory) AddUser(user *User) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.Users = append(m.Users, user)
 }
 
 func (m *Memory) GetArtifact(url string, tagID string, userID uint64) (artifact *Artifact, err error) {
-	user := m.Users[userID]
-	if user == nil {
-		return artifact, fmt.Errorf("failed to get user with ID: %d", userID)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return artifact, err
+	}
+	return user.lookup(url, tagID)
+}
+
+func (m *Memory) LatestArtifact(url string, userID uint64) (artifact *Artifact, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return artifact, err
+	}
+	return user.latestEntry(url)
+}
+
+func (m *Memory) AddArtifact(artifact *Artifact, body io.Reader, url string, tagID string, userID uint64) (err error) {
+	// Like Disk, the body is read before taking the lock
+	h := newHashingWriter()
+	data, err := io.ReadAll(io.TeeReader(body, h))
+	if err != nil {
+		return fmt.Errorf("failed to read artifact body: %s", err)
 	}
-	tag, ok := user.Tags[tagID]
-	if !ok {
-		tag = &Tag{Artifacts: make(map[string]*Artifact)}
-		user.Tags[tagID] = tag
+	h.sum(artifact)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
 	}
-	artifact, ok = tag.Artifacts[url]
-	if !ok {
-		return artifact, fmt.Errorf("failed to get artifact for URL: %s", url)
+	if existing, ok := m.Blobs[artifact.Hash]; ok {
+		data = existing
+	} else {
+		m.Blobs[artifact.Hash] = data
 	}
-	return artifact, nil
+	artifact.open = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	user.record(tagID, url, artifact)
+	return nil
 }
 
-func (m *Memory) AddArtifact(artifact *Artifact, url string, tagID string, userID uint64) (err error) {
-	user := m.Users[userID]
-	if user == nil {
-		return fmt.Errorf("failed to get user with ID: %d", userID)
+func (m *Memory) TagArtifact(artifact *Artifact, tag string, URL string, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
 	}
-	tag, ok := user.Tags[tagID]
-	if !ok {
-		tag = &Tag{Artifacts: make(map[string]*Artifact)}
-		user.Tags[tagID] = tag
+	user.record(tag, URL, artifact)
+	return nil
+}
+
+func (m *Memory) ListTags(userID uint64) (tags []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return nil, err
 	}
+	return user.tagNames(), nil
+}
 
-	existingArtifact := false
-	for _, currArtifact := range tag.Artifacts {
-		if artifact.Equal(currArtifact) {
-			existingArtifact = true
-			break
+func (m *Memory) ListArtifacts(tagID string, userID uint64) (artifacts map[string]*Artifact, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := user.getTag(tagID)
+	if err != nil {
+		return nil, err
+	}
+	artifacts = make(map[string]*Artifact, len(tag.Artifacts))
+	for key, artifact := range tag.Artifacts {
+		artifacts[key] = artifact
+	}
+	return artifacts, nil
+}
+
+func (m *Memory) DeleteTag(tag string, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	return user.deleteTag(tag)
+}
+
+func (m *Memory) CopyTag(src string, dst string, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	return user.copyTag(src, dst)
+}
+
+func (m *Memory) RenameTag(src string, dst string, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	return user.renameTag(src, dst)
+}
+
+func (m *Memory) ReplaceTag(src string, dst string, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	return user.replaceTag(src, dst)
+}
+
+func (m *Memory) SetParents(tag string, parents []string, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	return user.setParents(tag, parents)
+}
+
+func (m *Memory) Parents(tag string, userID uint64) (parents []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return user.parents(tag)
+}
+
+func (m *Memory) SetPinned(tag string, pinned bool, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	return user.setPinned(tag, pinned)
+}
+
+func (m *Memory) Pinned(tag string, userID uint64) (pinned bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return false, err
+	}
+	return user.pinned(tag)
+}
+
+func (m *Memory) SetAttestation(tag string, attestation *Attestation, userID uint64) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return err
+	}
+	return user.setAttestation(tag, attestation)
+}
+
+func (m *Memory) Attestation(tag string, userID uint64) (attestation *Attestation, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return user.attestation(tag)
+}
+
+func (m *Memory) Version(tag string, userID uint64) (version uint64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return 0, err
+	}
+	return user.version(tag)
+}
+
+func (m *Memory) Played(tag string, userID uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return
+	}
+	user.played(tag, time.Now().UTC())
+}
+
+func (m *Memory) Reap(policy RetentionPolicy, now time.Time) (reaped []Reaped, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.Users {
+		if user == nil {
+			continue
+		}
+		deleted, _ := user.reap(policy, now)
+		reaped = append(reaped, deleted...)
+	}
+	return reaped, nil
+}
+
+// GC drops every blob that no tag of any user references.
+func (m *Memory) GC() (freed int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	referenced := referencedHashes(m.Users)
+	for hash, data := range m.Blobs {
+		if !referenced[hash] {
+			freed += int64(len(data))
+			delete(m.Blobs, hash)
 		}
 	}
+	return freed, nil
+}
+
+func (m *Memory) Stats() (stats Stats, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if !existingArtifact {
-		m.Artifacts = append(m.Artifacts, artifact)
+	stats = indexStats(m.Users)
+	stats.Blobs = len(m.Blobs)
+	for _, data := range m.Blobs {
+		stats.StoredSize += int64(len(data))
 	}
-	tag.Artifacts[url] = artifact
-	return nil
+	return stats, nil
 }
 
-func (m *Memory) TagArtifact(artifact *Artifact, tag string, URL string, userID uint64) {
-	m.Users[userID].Tags[tag].Artifacts[URL] = artifact
+// TagStats counts every body as a single chunk, Memory does not chunk.
+func (m *Memory) TagStats(tag string, userID uint64) (stats TagStats, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, err := m.getUser(userID)
+	if err != nil {
+		return stats, err
+	}
+	return tagStats(m.Users, user, tag, func(userID uint64, artifact *Artifact) ([]chunkRef, error) {
+		return []chunkRef{{Hash: artifact.Hash, Size: artifact.Size}}, nil
+	})
+}
+
+func (m *Memory) getUser(userID uint64) (user *User, err error) {
+	if userID >= uint64(len(m.Users)) || m.Users[userID] == nil {
+		return nil, fmt.Errorf("failed to get user with ID: %d", userID)
+	}
+	return m.Users[userID], nil
 }
 
 func CreateMemory() (m *Memory) {
-	a := make([]*Artifact, 0)
+	b := make(map[string][]byte)
 	u := make([]*User, 0)
-	m = &Memory{Artifacts: a, Users: u}
+	m = &Memory{Blobs: b, Users: u}
 	return m
 }
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// playedGranularity is how stale PlayedAt may get before playback updates it,
+// so the disk index is not rewritten on every request.
+const playedGranularity = time.Minute
+
+// RetentionPolicy decides which tags are kept. Pinned tags are always kept,
+// and so is every tag a kept tag is layered on.
+type RetentionPolicy struct {
+	// MaxAge reaps tags that have not been played back for longer, or not
+	// recorded into for longer if they never were. Zero keeps them forever.
+	MaxAge time.Duration
+	// KeepLast keeps only the N most recently used tags whose name starts
+	// with the prefix. A tag falls under the longest prefix it starts with.
+	KeepLast map[string]int
+}
+
+// Enabled reports whether the policy can reap anything at all.
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || len(p.KeepLast) > 0
+}
+
+// prefix returns the longest KeepLast prefix name starts with.
+func (p RetentionPolicy) prefix(name string) (prefix string, ok bool) {
+	for candidate := range p.KeepLast {
+		if strings.HasPrefix(name, candidate) && (!ok || len(candidate) > len(prefix)) {
+			prefix, ok = candidate, true
+		}
+	}
+	return prefix, ok
+}
+
+// Reaped is a tag a retention pass deleted.
+type Reaped struct {
+	User   uint64
+	Tag    string
+	Reason string
+}
+
+// lastUsed is the last time the tag was played back or recorded into.
+func (t *Tag) lastUsed() time.Time {
+	if t.PlayedAt.After(t.RecordedAt) {
+		return t.PlayedAt
+	}
+	return t.RecordedAt
+}
+
+func (u *User) setPinned(name string, pinned bool) (err error) {
+	tag, err := u.getTag(name)
+	if err != nil {
+		return err
+	}
+	tag.Pinned = pinned
+	return nil
+}
+
+func (u *User) pinned(name string) (pinned bool, err error) {
+	tag, err := u.getTag(name)
+	if err != nil {
+		return false, err
+	}
+	return tag.Pinned, nil
+}
+
+// played marks name and everything it inherits from as played back at now,
+// and reports whether anything changed.
+func (u *User) played(name string, now time.Time) (changed bool) {
+	visited := make(map[string]bool)
+	var mark func(name string)
+	mark = func(name string) {
+		tag, ok := u.Tags[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+		if now.Sub(tag.PlayedAt) >= playedGranularity {
+			tag.PlayedAt = now
+			changed = true
+		}
+		for _, parent := range tag.Parents {
+			mark(parent)
+		}
+	}
+	mark(name)
+	return changed
+}
+
+// reap deletes the tags policy no longer keeps and reports whether the user
+// changed. Tags from before retention existed start their clock now.
+func (u *User) reap(policy RetentionPolicy, now time.Time) (reaped []Reaped, changed bool) {
+	names := u.tagNames()
+	for _, name := range names {
+		if tag := u.Tags[name]; tag.lastUsed().IsZero() {
+			tag.RecordedAt = now
+			changed = true
+		}
+	}
+
+	doomed := make(map[string]string)
+	groups := make(map[string][]string)
+	for _, name := range names {
+		tag := u.Tags[name]
+		if tag.Pinned {
+			continue
+		}
+		if policy.MaxAge > 0 && now.Sub(tag.lastUsed()) > policy.MaxAge {
+			doomed[name] = fmt.Sprintf("not used since %s", tag.lastUsed().Format(time.RFC3339))
+		}
+		if prefix, ok := policy.prefix(name); ok {
+			groups[prefix] = append(groups[prefix], name)
+		}
+	}
+	for prefix, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return u.Tags[group[i]].lastUsed().After(u.Tags[group[j]].lastUsed())
+		})
+		keep := policy.KeepLast[prefix]
+		for i := keep; i < len(group); i++ {
+			if _, ok := doomed[group[i]]; !ok {
+				doomed[group[i]] = fmt.Sprintf("more than %d tags start with %q", keep, prefix)
+			}
+		}
+	}
+
+	// Deleting a parent would change what the tags on top of it play back
+	var spare func(name string)
+	spare = func(name string) {
+		for _, parent := range u.Tags[name].Parents {
+			if _, ok := doomed[parent]; ok {
+				delete(doomed, parent)
+				spare(parent)
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := doomed[name]; !ok {
+			spare(name)
+		}
+	}
+
+	// A parent can only go once the doomed tags on top of it are gone
+	for progress := true; progress; {
+		progress = false
+		for _, name := range names {
+			reason, ok := doomed[name]
+			if !ok {
+				continue
+			}
+			if err := u.deleteTag(name); err != nil {
+				continue
+			}
+			delete(doomed, name)
+			reaped = append(reaped, Reaped{User: u.ID, Tag: name, Reason: reason})
+			changed, progress = true, true
+		}
+	}
+	return reaped, changed
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tag := func(recorded time.Duration, played time.Duration, parents ...string) *Tag {
+		tag := &Tag{Artifacts: make(map[string]*Artifact), Parents: parents}
+		if recorded != 0 {
+			tag.RecordedAt = now.Add(-recorded)
+		}
+		if played != 0 {
+			tag.PlayedAt = now.Add(-played)
+		}
+		return tag
+	}
+	pinned := tag(30*day, 0)
+	pinned.Pinned = true
+	user := &User{ID: 0, Tags: map[string]*Tag{
+		"release-1":     pinned,
+		"ci-1":          tag(4*time.Hour, 0),
+		"ci-2":          tag(3*time.Hour, 0),
+		"ci-3":          tag(5*time.Hour, time.Hour),
+		"ci-4":          tag(time.Hour, 0),
+		"ci-nightly-1":  tag(2*day, 0),
+		"ci-nightly-2":  tag(day, 0),
+		"old":           tag(10*day, 0),
+		"played":        tag(10*day, day),
+		"base":          tag(20*day, 0),
+		"layered":       tag(day, 0, "base"),
+		"legacy":        tag(0, 0),
+		"ci-layered":    tag(8*day, 0, "ci-base"),
+		"ci-base":       tag(8*day, 0),
+		"ci-pinned-old": tag(9*day, 0),
+	}}
+	user.Tags["ci-pinned-old"].Pinned = true
+
+	policy := RetentionPolicy{
+		MaxAge:   7 * day,
+		KeepLast: map[string]int{"ci-": 2, "ci-nightly-": 1},
+	}
+	reaped, changed := user.reap(policy, now)
+	if !changed {
+		t.Errorf("reap reported no change")
+	}
+	// ci-base only goes once ci-layered, which is on top of it, is gone
+	want := []Reaped{
+		{0, "ci-1", `more than 2 tags start with "ci-"`},
+		{0, "ci-2", `more than 2 tags start with "ci-"`},
+		{0, "ci-layered", "not used since 2024-04-24T12:00:00Z"},
+		{0, "ci-nightly-1", `more than 1 tags start with "ci-nightly-"`},
+		{0, "old", "not used since 2024-04-22T12:00:00Z"},
+		{0, "ci-base", "not used since 2024-04-24T12:00:00Z"},
+	}
+	if !reflect.DeepEqual(reaped, want) {
+		t.Errorf("reaped:\n    got: %v\n    want: %v", reaped, want)
+	}
+	wantTags := []string{"base", "ci-3", "ci-4", "ci-nightly-2", "ci-pinned-old", "layered", "legacy", "played", "release-1"}
+	if got := user.tagNames(); !reflect.DeepEqual(got, wantTags) {
+		t.Errorf("tags:\n    got: %v\n    want: %v", got, wantTags)
+	}
+	if !user.Tags["legacy"].RecordedAt.Equal(now) {
+		t.Errorf("legacy tag: got RecordedAt %s, want %s", user.Tags["legacy"].RecordedAt, now)
+	}
+
+	// Playing back a tag keeps what it is layered on alive too
+	if !user.played("layered", now) || !user.Tags["base"].PlayedAt.Equal(now) {
+		t.Errorf("playback did not reach the parent")
+	}
+	if user.played("layered", now.Add(time.Second)) {
+		t.Errorf("playback within %s changed the tag again", playedGranularity)
+	}
+	if reaped, changed = user.reap(policy, now); changed || len(reaped) != 0 {
+		t.Errorf("second pass: got %v (changed %t), want nothing", reaped, changed)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		addArtifact(t, k, "a", "GET example.com/a", "ci-1")
+		addArtifact(t, k, "b", "GET example.com/b", "release-1")
+		addArtifact(t, k, "c", "GET example.com/c", "ci-2")
+
+		if err := k.SetPinned("release-1", true, 0); err != nil {
+			t.Fatalf("Failed to pin: %s", err)
+		}
+		if pinned, err := k.Pinned("release-1", 0); err != nil || !pinned {
+			t.Errorf("pinned: got %t (%v), want true", pinned, err)
+		}
+		if err := k.SetPinned("DNE", true, 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("pinning a missing tag: got %v, want ErrNotFound", err)
+		}
+		k.Played("ci-2", 0)
+
+		policy := RetentionPolicy{MaxAge: time.Hour}
+		reaped, err := k.Reap(policy, time.Now())
+		if err != nil || len(reaped) != 0 {
+			t.Errorf("fresh tags: got %v (%v), want nothing reaped", reaped, err)
+		}
+		reaped, err = k.Reap(policy, time.Now().Add(2*time.Hour))
+		if err != nil {
+			t.Fatalf("Failed to reap: %s", err)
+		}
+		if len(reaped) != 2 || reaped[0].Tag != "ci-1" || reaped[1].Tag != "ci-2" {
+			t.Errorf("reaped: got %v, want ci-1 and ci-2", reaped)
+		}
+		if tags, _ := k.ListTags(0); !reflect.DeepEqual(tags, []string{"release-1"}) {
+			t.Errorf("tags: got %v, want [release-1]", tags)
+		}
+
+		if d, ok := k.(*Disk); ok {
+			reopened, err := CreateDisk(d.Root)
+			if err != nil {
+				t.Fatalf("Failed to reopen disk store: %s", err)
+			}
+			if pinned, err := reopened.Pinned("release-1", 0); err != nil || !pinned {
+				t.Errorf("after reopening: got pinned %t (%v), want true", pinned, err)
+			}
+			if _, err = reopened.Pinned("ci-1", 0); !errors.Is(err, ErrNotFound) {
+				t.Errorf("after reopening: reaped tag is back (%v)", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Latest finds what tag plays back for key or, when it has nothing, the most
+// recently recorded entry for key in any of the user's other tags.
+func Latest(k Handler, key string, tag string, userID uint64) (artifact *Artifact, err error) {
+	artifact, err = k.GetArtifact(key, tag, userID)
+	if err == nil || !errors.Is(err, ErrNotFound) {
+		return artifact, err
+	}
+	return k.LatestArtifact(key, userID)
+}
+
+// The latest index spares looking through every tag on every recorded
+// request. An entry is trusted as long as its tag still has the key, and
+// looked up again from scratch once it does not.
+
+// latestEntry returns the most recent recording of url in any of the user's
+// tags, the first tag in order winning ties.
+func (u *User) latestEntry(url string) (artifact *Artifact, err error) {
+	if artifact = u.indexedLatest(url); artifact != nil {
+		return artifact, nil
+	}
+	var latest time.Time
+	for _, name := range u.tagNames() {
+		candidate, ok := u.Tags[name].Artifacts[url]
+		if !ok {
+			continue
+		}
+		if recorded := candidate.recordedAt(); artifact == nil || recorded.After(latest) {
+			artifact, latest = candidate, recorded
+			if u.latest == nil {
+				u.latest = make(map[string]string)
+			}
+			u.latest[url] = name
+		}
+	}
+	if artifact == nil {
+		return nil, fmt.Errorf("failed to get artifact for URL %s: %w", url, ErrNotFound)
+	}
+	return artifact, nil
+}
+
+func (u *User) indexedLatest(url string) (artifact *Artifact) {
+	name, ok := u.latest[url]
+	if !ok {
+		return nil
+	}
+	tag, ok := u.Tags[name]
+	if !ok {
+		delete(u.latest, url)
+		return nil
+	}
+	if artifact, ok = tag.Artifacts[url]; !ok {
+		delete(u.latest, url)
+		return nil
+	}
+	return artifact
+}
+
+// noteLatest keeps the index current before artifact is written to the tag.
+// Keys nobody looked up yet stay out of it.
+func (u *User) noteLatest(name string, url string, artifact *Artifact) {
+	if isScratch(name) {
+		return
+	}
+	current := u.indexedLatest(url)
+	if current == nil {
+		return
+	}
+	if artifact.recordedAt().After(current.recordedAt()) {
+		u.latest[url] = name
+	} else if u.latest[url] == name && artifact.recordedAt().Before(current.recordedAt()) {
+		// Some other tag may be more recent now
+		delete(u.latest, url)
+	}
+}
+
+// Validators returns the ETag and Last-Modified upstream sent with the
+// artifact, which can be used to ask upstream whether it changed since.
+func (a *Artifact) Validators() (etag string, lastModified string) {
+	if a.Metadata != nil {
+		etag, lastModified = a.Metadata.ETag, a.Metadata.LastModified
+	}
+	if etag == "" {
+		etag = a.Header.Get("ETag")
+	}
+	if lastModified == "" {
+		lastModified = a.Header.Get("Last-Modified")
+	}
+	return etag, lastModified
+}
+
+// Revalidated returns a copy of the artifact for recording again after
+// upstream confirmed it has not changed. The header fields upstream sent along
+// with its 304 replace the recorded ones, as RFC 9111 section 4.3.4 asks,
+// except for Content-Length, which describes a body the 304 did not have.
+func (a *Artifact) Revalidated(user uint64, session string, header http.Header) (revalidated *Artifact) {
+	copied := *a
+	copied.Header = a.Header.Clone()
+	if copied.Header == nil {
+		copied.Header = make(http.Header)
+	}
+	for name, values := range header {
+		if http.CanonicalHeaderKey(name) == "Content-Length" {
+			continue
+		}
+		copied.Header[name] = append([]string(nil), values...)
+	}
+	meta := a.Metadata.clone()
+	if meta == nil {
+		meta = NewMetadata(copied.Header)
+	}
+	if etag := header.Get("ETag"); etag != "" {
+		meta.ETag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		meta.LastModified = lastModified
+	}
+	now := time.Now().UTC()
+	meta.RevalidatedAt = &now
+	meta.User = user
+	meta.Session = session
+	copied.Metadata = meta
+	return &copied
+}
+
+func (a *Artifact) recordedAt() time.Time {
+	if a.Metadata == nil {
+		return time.Time{}
+	}
+	return a.Metadata.RecordedAt
+}
@@ -0,0 +1,312 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot directory holds any number of snapshots of a Disk store:
+// <dir>/snapshots/<name>.json has the index, the keyring and the blob and
+// chunk files a snapshot is made of, and the files themselves live in
+// <dir>/blobs and <dir>/chunks. Stored files never change under their name,
+// so every snapshot in a directory shares them and a new snapshot only copies
+// the ones that are not there yet.
+const (
+	snapshotDir    = "snapshots"
+	snapshotSuffix = ".json"
+	snapshotLayout = "20060102T150405.000000000Z"
+)
+
+type snapshot struct {
+	Taken time.Time
+	Users []*User
+	// Keyring is keys.json as it was, with the data keys still wrapped
+	Keyring json.RawMessage `json:",omitempty"`
+	Blobs   []string
+	Chunks  []string
+}
+
+// SnapshotStats describes a snapshot that was taken or restored.
+type SnapshotStats struct {
+	Name string
+	// Files counts the blob and chunk files the snapshot is made of, Copied
+	// the ones that were not at the destination yet
+	Files      int
+	Copied     int
+	CopiedSize int64
+}
+
+// Snapshot takes a consistent snapshot of every user, tag and blob into dir,
+// copying only the files dir does not have yet. The store keeps serving while
+// the files are copied: they are hard linked aside under the lock and copied
+// after it is released.
+func (d *Disk) Snapshot(dir string) (stats SnapshotStats, err error) {
+	for _, sub := range []string{blobDir, chunkDir, snapshotDir} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return stats, fmt.Errorf("failed to create %s: %s", sub, err)
+		}
+	}
+	staging, err := os.MkdirTemp(filepath.Join(d.Root, tmpDir), "snapshot.*")
+	if err != nil {
+		return stats, fmt.Errorf("failed to create staging directory: %s", err)
+	}
+	defer os.RemoveAll(staging)
+
+	snap, data, staged, err := d.stageSnapshot(dir, staging)
+	if err != nil {
+		return stats, err
+	}
+	stats = SnapshotStats{
+		Name:   snap.Taken.Format(snapshotLayout),
+		Files:  len(snap.Blobs) + len(snap.Chunks),
+		Copied: len(staged),
+	}
+	for _, name := range staged {
+		size, err := copyFile(filepath.Join(staging, name), filepath.Join(dir, name))
+		if err != nil {
+			return stats, err
+		}
+		stats.CopiedSize += size
+	}
+	// The snapshot only shows up once everything it needs is there
+	path := filepath.Join(dir, snapshotDir, stats.Name+snapshotSuffix)
+	if _, err = os.Stat(path); err == nil {
+		return stats, fmt.Errorf("snapshot %s: %w", stats.Name, ErrExists)
+	}
+	if err = writeFileAtomic(path, data); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// stageSnapshot records the index and the files it needs, and hard links the
+// files dir is missing into staging. It returns the staged files relative to
+// staging, which mirrors the layout of dir.
+func (d *Disk) stageSnapshot(dir string, staging string) (snap snapshot, data []byte, staged []string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if snap.Blobs, snap.Chunks, err = d.liveStored(); err != nil {
+		return snap, nil, nil, err
+	}
+	snap.Taken = time.Now().UTC()
+	snap.Users = d.Users
+	if d.keys != nil {
+		d.keys.mu.Lock()
+		snap.Keyring, err = d.keys.encode()
+		d.keys.mu.Unlock()
+		if err != nil {
+			return snap, nil, nil, fmt.Errorf("failed to encode keyring: %s", err)
+		}
+	}
+	if data, err = json.Marshal(snap); err != nil {
+		return snap, nil, nil, fmt.Errorf("failed to encode snapshot: %s", err)
+	}
+	// Later changes to the index must not leak into the snapshot
+	snap.Users = nil
+
+	for _, sub := range []string{blobDir, chunkDir} {
+		if err = os.Mkdir(filepath.Join(staging, sub), 0o755); err != nil {
+			return snap, nil, nil, fmt.Errorf("failed to create staging directory: %s", err)
+		}
+	}
+	stage := func(sub string, names []string) (err error) {
+		for _, name := range names {
+			if _, err = os.Stat(filepath.Join(dir, sub, name)); err == nil {
+				continue
+			}
+			src, dst := filepath.Join(d.Root, sub, name), filepath.Join(staging, sub, name)
+			if err = os.Link(src, dst); err != nil {
+				// No hard links here, copying under the lock is slower but works
+				if _, err = copyFile(src, dst); err != nil {
+					return err
+				}
+			}
+			staged = append(staged, filepath.Join(sub, name))
+		}
+		return nil
+	}
+	if err = stage(blobDir, snap.Blobs); err != nil {
+		return snap, nil, nil, err
+	}
+	if err = stage(chunkDir, snap.Chunks); err != nil {
+		return snap, nil, nil, err
+	}
+	return snap, data, staged, nil
+}
+
+// Restore replaces every user, tag and the keyring with the ones in the
+// snapshot name in dir, or the latest one when name is empty. Files the store
+// does not have are copied in first. What the store held before stays on disk
+// until the next GC.
+func (d *Disk) Restore(dir string, name string) (stats SnapshotStats, err error) {
+	snap, name, err := readSnapshot(dir, name)
+	if err != nil {
+		return stats, err
+	}
+	stats = SnapshotStats{Name: name, Files: len(snap.Blobs) + len(snap.Chunks)}
+	// Most of the copying happens outside the lock. A GC can sweep what was
+	// copied before the index points at it, so the pass under the lock copies
+	// that again.
+	if err = d.restoreFiles(dir, snap, &stats); err != nil {
+		return stats, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err = d.restoreFiles(dir, snap, &stats); err != nil {
+		return stats, err
+	}
+	var keys *keyring
+	if d.keys != nil {
+		keys = d.keys
+		if len(snap.Keyring) > 0 {
+			if keys, err = decodeKeyring(snap.Keyring, d.keys.master); err != nil {
+				return stats, fmt.Errorf("failed to restore keyring: %s", err)
+			}
+		}
+		for _, user := range snap.Users {
+			if user == nil {
+				continue
+			}
+			if _, err = keys.addUser(user.ID); err != nil {
+				return stats, err
+			}
+		}
+	} else if len(snap.Keyring) > 0 {
+		// Nothing to unwrap it with now, it is kept for when there is
+		if err = d.writeFile(filepath.Join(d.Root, keyringFile), snap.Keyring); err != nil {
+			return stats, err
+		}
+	}
+
+	d.Users = loadedUsers(snap.Users)
+	d.keys = keys
+	if d.keys != nil {
+		if err = d.writeKeyring(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, d.writeIndex()
+}
+
+// restoreFiles copies the files of snap the store is missing from dir.
+func (d *Disk) restoreFiles(dir string, snap snapshot, stats *SnapshotStats) (err error) {
+	restore := func(sub string, names []string) (err error) {
+		for _, name := range names {
+			dst := filepath.Join(d.Root, sub, name)
+			if _, err = os.Stat(dst); err == nil {
+				continue
+			}
+			size, err := d.copyIn(filepath.Join(dir, sub, name), dst)
+			if err != nil {
+				return err
+			}
+			stats.Copied += 1
+			stats.CopiedSize += size
+		}
+		return nil
+	}
+	if err = restore(blobDir, snap.Blobs); err != nil {
+		return err
+	}
+	return restore(chunkDir, snap.Chunks)
+}
+
+// Snapshots lists the names of the snapshots in dir, oldest first.
+func Snapshots(dir string) (names []string, err error) {
+	entries, err := os.ReadDir(filepath.Join(dir, snapshotDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %s", err)
+	}
+	names = []string{}
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, snapshotSuffix) && !strings.HasPrefix(name, ".") {
+			names = append(names, strings.TrimSuffix(name, snapshotSuffix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readSnapshot(dir string, name string) (snap snapshot, _ string, err error) {
+	if name == "" {
+		names, err := Snapshots(dir)
+		if err != nil {
+			return snap, "", err
+		}
+		if len(names) == 0 {
+			return snap, "", fmt.Errorf("no snapshot in %s: %w", dir, ErrNotFound)
+		}
+		name = names[len(names)-1]
+	}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotDir, filepath.Base(name)+snapshotSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, "", fmt.Errorf("snapshot %s: %w", name, ErrNotFound)
+	} else if err != nil {
+		return snap, "", fmt.Errorf("failed to read snapshot %s: %s", name, err)
+	}
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return snap, "", fmt.Errorf("failed to decode snapshot %s: %s", name, err)
+	}
+	return snap, name, nil
+}
+
+// copyFile copies src to dst through a temporary file next to dst, so dst is
+// either missing or complete.
+func copyFile(src string, dst string) (size int64, err error) {
+	f, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	return copyThrough(f, src, dst)
+}
+
+// copyIn copies src to dst in the store through the store's temporary
+// directory, where a GC does not look, unlike next to dst in blobs.
+func (d *Disk) copyIn(src string, dst string) (size int64, err error) {
+	f, err := d.createTemp(filepath.Base(dst))
+	if err != nil {
+		return 0, err
+	}
+	return copyThrough(f, src, dst)
+}
+
+// copyThrough copies src into the temporary file f and moves it to dst.
+func copyThrough(f *os.File, src string, dst string) (size int64, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		discardTemp(f)
+		return 0, fmt.Errorf("failed to open %s: %s", src, err)
+	}
+	defer in.Close()
+	if size, err = io.Copy(f, in); err != nil {
+		discardTemp(f)
+		return 0, fmt.Errorf("failed to copy %s: %s", src, err)
+	}
+	return size, commitTemp(f, dst)
+}
+
+// writeFileAtomic replaces path with data through a temporary file next to
+// it, for files outside the store.
+func writeFileAtomic(path string, data []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %s", err)
+	}
+	if _, err = f.Write(data); err != nil {
+		discardTemp(f)
+		return fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return commitTemp(f, path)
+}
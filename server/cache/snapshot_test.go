@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	mathrand "math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, keySize)
+	d, err := CreateDisk(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	d.AddUser(CreateUser())
+	plain := addArtifact(t, d, "recorded before encryption", "GET example.com/plain", "tag1")
+	if err = d.EnableEncryption(master); err != nil {
+		t.Fatalf("Failed to enable encryption: %s", err)
+	}
+	d.Chunking = true
+	large := make([]byte, 2<<20)
+	mathrand.New(mathrand.NewSource(1)).Read(large)
+	chunked := addArtifact(t, d, string(large), "GET example.com/chunked", "tag1")
+	compressed := addArtifact(t, d, strings.Repeat("compress me ", 1000), "GET example.com/compressed", "tag2")
+	addArtifact(t, d, "garbage", "GET example.com/garbage", "deleted")
+	if err = d.DeleteTag("deleted", 0); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+
+	dir := t.TempDir()
+	first, err := d.Snapshot(dir)
+	if err != nil {
+		t.Fatalf("Failed to snapshot: %s", err)
+	}
+	if first.Files < 4 || first.Copied != first.Files {
+		t.Errorf("first snapshot: got %+v, want every file copied", first)
+	}
+
+	added := addArtifact(t, d, "new since the first snapshot", "GET example.com/added", "tag2")
+	second, err := d.Snapshot(dir)
+	if err != nil {
+		t.Fatalf("Failed to snapshot: %s", err)
+	}
+	if second.Files != first.Files+1 || second.Copied != 1 {
+		t.Errorf("incremental snapshot: got %+v, want only the new blob copied", second)
+	}
+	if names, err := Snapshots(dir); err != nil || !reflect.DeepEqual(names, []string{first.Name, second.Name}) {
+		t.Errorf("snapshots: got %v (%v), want %s and %s", names, err, first.Name, second.Name)
+	}
+
+	// The live store moves on, restoring takes it back
+	if err = d.DeleteTag("tag1", 0); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	if _, err = d.GC(); err != nil {
+		t.Fatalf("Failed to GC: %s", err)
+	}
+	restored, err := d.Restore(dir, first.Name)
+	if err != nil {
+		t.Fatalf("Failed to restore: %s", err)
+	}
+	if restored.Name != first.Name || restored.Copied == 0 {
+		t.Errorf("restore: got %+v, want the deleted blobs copied back", restored)
+	}
+	want := map[string]string{
+		"tag1 GET example.com/plain":      "recorded before encryption",
+		"tag1 GET example.com/chunked":    string(large),
+		"tag2 GET example.com/compressed": strings.Repeat("compress me ", 1000),
+	}
+	checkRestored := func(t *testing.T, k Handler, want map[string]string) {
+		for entry, body := range want {
+			tag, key, _ := strings.Cut(entry, " ")
+			artifact, err := k.GetArtifact(key, tag, 0)
+			if err != nil {
+				t.Errorf("%s: %s", entry, err)
+				continue
+			}
+			if got := readArtifact(t, artifact); got != body {
+				t.Errorf("%s: got %d bytes, want %d", entry, len(got), len(body))
+			}
+		}
+	}
+	checkRestored(t, d, want)
+	if _, err = d.GetArtifact("GET example.com/added", "tag2", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("entry newer than the snapshot: got %v, want ErrNotFound", err)
+	}
+
+	// A fresh store restores the latest snapshot, and needs the master key
+	// for what was encrypted
+	fresh, err := CreateDisk(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	if err = fresh.EnableEncryption(master); err != nil {
+		t.Fatalf("Failed to enable encryption: %s", err)
+	}
+	if _, err = fresh.Restore(dir, ""); err != nil {
+		t.Fatalf("Failed to restore: %s", err)
+	}
+	want["tag2 GET example.com/added"] = "new since the first snapshot"
+	checkRestored(t, fresh, want)
+	if tags, _ := fresh.ListTags(0); !reflect.DeepEqual(tags, []string{"tag1", "tag2"}) {
+		t.Errorf("tags: got %v, want [tag1 tag2]", tags)
+	}
+	for _, artifact := range []*Artifact{plain, chunked, compressed, added} {
+		if _, err = fresh.locate(artifact.Hash, 0); err != nil {
+			t.Errorf("blob %s was not restored: %s", artifact.Hash, err)
+		}
+	}
+
+	other, err := CreateDisk(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %s", err)
+	}
+	if err = other.EnableEncryption(bytes.Repeat([]byte{2}, keySize)); err != nil {
+		t.Fatalf("Failed to enable encryption: %s", err)
+	}
+	if _, err = other.Restore(dir, ""); err == nil {
+		t.Errorf("restoring with another master key: got no error")
+	}
+	if _, err = other.Restore(dir, "DNE"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing snapshot: got %v, want ErrNotFound", err)
+	}
+	if _, err = other.Restore(t.TempDir(), ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("empty snapshot directory: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"time"
+)
+
+// SyncStats describes what pulling a tag from another server did.
+type SyncStats struct {
+	Tag     string
+	Entries int
+	// Unchanged entries were already there, Reused ones point at a body the
+	// store already had and Pulled ones had their body transferred. Removed
+	// entries were in the tag but not in the source anymore.
+	Unchanged  int
+	Reused     int
+	Pulled     int
+	PulledSize int64
+	Removed    int
+}
+
+// SyncManifest describes tag for another server to pull: every entry and the
+// attestation, like in a bundle, and the tags it is layered on.
+func SyncManifest(k Handler, tag string, userID uint64) (manifest BundleManifest, err error) {
+	artifacts, err := k.ListArtifacts(tag, userID)
+	if err != nil {
+		return manifest, err
+	}
+	if manifest.Parents, err = k.Parents(tag, userID); err != nil {
+		return manifest, err
+	}
+	if manifest.Attestation, err = k.Attestation(tag, userID); err != nil {
+		return manifest, err
+	}
+	manifest.Tag = tag
+	manifest.Entries = make([]BundleEntry, 0, len(artifacts))
+	for _, key := range sortedKeys(artifacts) {
+		manifest.Entries = append(manifest.Entries, bundleEntry(key, artifacts[key]))
+	}
+	return manifest, nil
+}
+
+// SyncTag makes tag a copy of manifest, which another server made with
+// SyncManifest. Bodies any of the user's tags already have are reused, fetch
+// is only asked for the others. The new entries are put together in a
+// scratch tag and only replace those of tag, along with its parents and the
+// source's attestation, once all of them are in, so a failed sync leaves tag
+// as it was.
+func SyncTag(k Handler, manifest BundleManifest, tag string, userID uint64, fetch func(entry BundleEntry) (io.ReadCloser, error)) (stats SyncStats, err error) {
+	if tag == "" {
+		tag = manifest.Tag
+	}
+	stats = SyncStats{Tag: tag, Entries: len(manifest.Entries)}
+	stored, err := storedDigests(k, userID)
+	if err != nil {
+		return stats, err
+	}
+	current, err := k.ListArtifacts(tag, userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return stats, err
+	}
+
+	scratch := scratchTag("sync", tag)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if cleanupErr := k.DeleteTag(scratch, userID); cleanupErr != nil && !errors.Is(cleanupErr, ErrNotFound) {
+			log.Printf("Failed to clean up after syncing %s: %s", tag, cleanupErr)
+		}
+	}()
+	synced := make(map[string]bool, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		synced[entry.Key] = true
+		if existing, ok := current[entry.Key]; ok && sameEntry(existing, entry) {
+			if err = k.TagArtifact(existing, scratch, entry.Key, userID); err != nil {
+				return stats, err
+			}
+			stats.Unchanged += 1
+			continue
+		}
+		want := digest(&Artifact{Hash: entry.Hash, Algorithm: entry.Algorithm})
+		body, ok := stored[want]
+		if ok {
+			stats.Reused += 1
+		} else {
+			if body, err = pull(k, entry, scratch, userID, fetch); err != nil {
+				return stats, err
+			}
+			stored[want] = body
+			stats.Pulled += 1
+			stats.PulledSize += body.Size
+		}
+		artifact := *body
+		artifact.StatusCode = entry.StatusCode
+		artifact.Header = entry.Header
+		artifact.Metadata = entry.Metadata
+		if err = k.TagArtifact(&artifact, scratch, entry.Key, userID); err != nil {
+			return stats, err
+		}
+	}
+	for key := range current {
+		if !synced[key] {
+			stats.Removed += 1
+		}
+	}
+
+	if err = publishStaged(k, scratch, tag, manifest.Parents, manifest.Attestation, userID); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// sameEntry reports whether existing is already what entry describes, body,
+// status, headers and metadata alike.
+func sameEntry(existing *Artifact, entry BundleEntry) bool {
+	if digest(existing) != digest(&Artifact{Hash: entry.Hash, Algorithm: entry.Algorithm}) || existing.StatusCode != entry.StatusCode {
+		return false
+	}
+	if (len(existing.Header) != 0 || len(entry.Header) != 0) && !reflect.DeepEqual(existing.Header, entry.Header) {
+		return false
+	}
+	if existing.Metadata == nil || entry.Metadata == nil {
+		return existing.Metadata == entry.Metadata
+	}
+	// Times are compared as instants, whatever their location
+	return sameTime(existing.Metadata.RevalidatedAt, entry.Metadata.RevalidatedAt) &&
+		existing.Metadata.RecordedAt.Equal(entry.Metadata.RecordedAt) &&
+		withoutTimes(*existing.Metadata) == withoutTimes(*entry.Metadata)
+}
+
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func withoutTimes(meta Metadata) Metadata {
+	meta.RecordedAt = time.Time{}
+	meta.RevalidatedAt = nil
+	return meta
+}
+
+// pull fetches the body of entry into scratch and checks it against the
+// entry's digest.
+func pull(k Handler, entry BundleEntry, scratch string, userID uint64, fetch func(entry BundleEntry) (io.ReadCloser, error)) (artifact *Artifact, err error) {
+	body, err := fetch(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull %s: %s", entry.Key, err)
+	}
+	defer body.Close()
+	artifact = &Artifact{}
+	if err = k.AddArtifact(artifact, body, entry.Key, scratch, userID); err != nil {
+		return nil, err
+	}
+	if err = checkDigest(artifact, entry.Hash, entry.Algorithm, entry.Size); err != nil {
+		return nil, fmt.Errorf("pulled %s: %w", entry.Key, err)
+	}
+	return artifact, nil
+}
+
+// storedDigests maps the digest of every body the user's tags point at to one
+// of the artifacts with it.
+func storedDigests(k Handler, userID uint64) (stored map[string]*Artifact, err error) {
+	tags, err := k.ListTags(userID)
+	if err != nil {
+		return nil, err
+	}
+	stored = make(map[string]*Artifact)
+	for _, tag := range tags {
+		artifacts, err := k.ListArtifacts(tag, userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, artifact := range artifacts {
+			stored[digest(artifact)] = artifact
+		}
+	}
+	return stored, nil
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSyncTag(t *testing.T) {
+	forEachHandler(t, func(t *testing.T, k Handler) {
+		src := CreateMemory()
+		src.AddUser(CreateUser())
+		addArtifact(t, src, "base body", "GET example.com/base", "base")
+		addArtifact(t, src, "project body", "GET example.com/project", "project")
+		addArtifact(t, src, "shared body", "GET example.com/shared", "project")
+		if err := src.SetParents("project", []string{"base"}, 0); err != nil {
+			t.Fatalf("Failed to set parents: %s", err)
+		}
+		addArtifact(t, k, "shared body", "GET example.com/elsewhere", "local")
+		fetched := []string{}
+		fetch := func(tag string) func(entry BundleEntry) (io.ReadCloser, error) {
+			return func(entry BundleEntry) (io.ReadCloser, error) {
+				fetched = append(fetched, entry.Key)
+				artifact, err := src.GetArtifact(entry.Key, tag, 0)
+				if err != nil {
+					return nil, err
+				}
+				buf := &bytes.Buffer{}
+				_, err = artifact.WriteTo(buf)
+				return io.NopCloser(buf), err
+			}
+		}
+		sync := func(tag string) SyncStats {
+			manifest, err := SyncManifest(src, tag, 0)
+			if err != nil {
+				t.Fatalf("Failed to build manifest: %s", err)
+			}
+			stats, err := SyncTag(k, manifest, "", 0, fetch(tag))
+			if err != nil {
+				t.Fatalf("Failed to sync %s: %s", tag, err)
+			}
+			return stats
+		}
+
+		if stats := sync("base"); stats != (SyncStats{Tag: "base", Entries: 1, Pulled: 1, PulledSize: 9}) {
+			t.Errorf("base: got %+v", stats)
+		}
+		stats := sync("project")
+		if stats != (SyncStats{Tag: "project", Entries: 2, Reused: 1, Pulled: 1, PulledSize: 12}) {
+			t.Errorf("project: got %+v", stats)
+		}
+		if want := []string{"GET example.com/base", "GET example.com/project"}; !reflect.DeepEqual(fetched, want) {
+			t.Errorf("fetched: got %v, want %v", fetched, want)
+		}
+		if stats = sync("project"); stats.Unchanged != 2 || stats.Pulled != 0 || len(fetched) != 2 {
+			t.Errorf("second sync: got %+v after fetching %v, want nothing pulled", stats, fetched)
+		}
+
+		// Parents come along, so layered playback works the same
+		if parents, _ := k.Parents("project", 0); !reflect.DeepEqual(parents, []string{"base"}) {
+			t.Errorf("parents: got %v, want [base]", parents)
+		}
+		for key, body := range map[string]string{
+			"GET example.com/base":    "base body",
+			"GET example.com/project": "project body",
+			"GET example.com/shared":  "shared body",
+		} {
+			artifact, err := k.GetArtifact(key, "project", 0)
+			if err != nil {
+				t.Errorf("%s: %s", key, err)
+			} else if got := readArtifact(t, artifact); got != body {
+				t.Errorf("%s: got %q, want %q", key, got, body)
+			}
+		}
+		if tags, _ := k.ListTags(0); !reflect.DeepEqual(tags, []string{"base", "local", "project"}) {
+			t.Errorf("tags: got %v, want [base local project]", tags)
+		}
+
+		// A body that does not match its digest is not recorded
+		addArtifact(t, src, "changed body", "GET example.com/project", "project")
+		manifest, err := SyncManifest(src, "project", 0)
+		if err != nil {
+			t.Fatalf("Failed to build manifest: %s", err)
+		}
+		_, err = SyncTag(k, manifest, "", 0, func(entry BundleEntry) (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("tampered body")), nil
+		})
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("tampered body: got %v, want ErrCorrupt", err)
+		}
+		if artifact, err := k.GetArtifact("GET example.com/project", "project", 0); err != nil || readArtifact(t, artifact) != "project body" {
+			t.Errorf("tampered body replaced the recording (%v)", err)
+		}
+		if tags, _ := k.ListTags(0); len(tags) != 3 {
+			t.Errorf("tags after a failed sync: got %v", tags)
+		}
+
+		// Entries the source dropped go away and changed headers come along,
+		// so the tag still matches the source's attestation
+		project := src.Users[0].Tags["project"]
+		delete(project.Artifacts, "GET example.com/shared")
+		changed := *project.Artifacts["GET example.com/project"]
+		changed.Header = http.Header{"Content-Type": {"text/plain"}}
+		project.Artifacts["GET example.com/project"] = &changed
+		key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+		for _, tag := range []string{"base", "project"} {
+			if _, err := SignTag(src, tag, 0, key); err != nil {
+				t.Fatalf("Failed to sign %s: %s", tag, err)
+			}
+		}
+		sync("base")
+		stats = sync("project")
+		if stats != (SyncStats{Tag: "project", Entries: 1, Pulled: 1, PulledSize: 12, Removed: 1}) {
+			t.Errorf("after the source changed: got %+v", stats)
+		}
+		if _, err := k.GetArtifact("GET example.com/shared", "project", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("dropped entry: got %v, want ErrNotFound", err)
+		}
+		if artifact, err := k.GetArtifact("GET example.com/project", "project", 0); err != nil || artifact.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("changed header did not come along (%v)", err)
+		}
+		if err := VerifyTag(k, "project", 0, key.Public().(ed25519.PublicKey)); err != nil {
+			t.Errorf("synced tag does not match its attestation: %s", err)
+		}
+		if tags, _ := k.ListTags(0); !reflect.DeepEqual(tags, []string{"base", "local", "project"}) {
+			t.Errorf("tags after syncing: got %v, want [base local project]", tags)
+		}
+
+		// A header change alone is not left out as unchanged either
+		relabeled := changed
+		relabeled.Header = http.Header{"Content-Type": {"text/html"}}
+		project.Artifacts["GET example.com/project"] = &relabeled
+		if _, err := SignTag(src, "project", 0, key); err != nil {
+			t.Fatalf("Failed to sign project: %s", err)
+		}
+		if stats = sync("project"); stats != (SyncStats{Tag: "project", Entries: 1, Reused: 1}) {
+			t.Errorf("after a header change: got %+v", stats)
+		}
+		if err := VerifyTag(k, "project", 0, key.Public().(ed25519.PublicKey)); err != nil {
+			t.Errorf("synced tag does not match its attestation: %s", err)
+		}
+	})
+}
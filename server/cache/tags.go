@@ -0,0 +1,405 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound is wrapped by errors about tags or artifacts that do not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is wrapped by errors about tags that would be overwritten.
+var ErrExists = errors.New("already exists")
+
+// ErrCycle is wrapped by errors about parents that would lead back to the tag.
+var ErrCycle = errors.New("parents would form a cycle")
+
+// ErrHasChildren is wrapped by errors about deleting tags that other tags are
+// still layered on.
+var ErrHasChildren = errors.New("other tags are layered on it")
+
+// Tag bookkeeping shared by the Handlers. None of it locks, that is up to
+// the Handler.
+
+func (u *User) getTag(name string) (tag *Tag, err error) {
+	tag, ok := u.Tags[name]
+	if !ok {
+		return nil, fmt.Errorf("tag %s: %w", name, ErrNotFound)
+	}
+	return tag, nil
+}
+
+// lookup finds url in the tag or, failing that, depth first through its
+// parents.
+func (u *User) lookup(url string, name string) (artifact *Artifact, err error) {
+	if _, err = u.getTag(name); err != nil {
+		return nil, err
+	}
+	visited := make(map[string]bool)
+	var search func(name string) *Artifact
+	search = func(name string) *Artifact {
+		tag, ok := u.Tags[name]
+		if !ok || visited[name] {
+			return nil
+		}
+		visited[name] = true
+		if artifact, ok := tag.Artifacts[url]; ok {
+			return artifact
+		}
+		for _, parent := range tag.Parents {
+			if artifact := search(parent); artifact != nil {
+				return artifact
+			}
+		}
+		return nil
+	}
+	if artifact = search(name); artifact == nil {
+		return nil, fmt.Errorf("failed to get artifact for URL %s: %w", url, ErrNotFound)
+	}
+	return artifact, nil
+}
+
+// inherits reports whether ancestor is name or one of its (grand)parents.
+func (u *User) inherits(name string, ancestor string) bool {
+	visited := make(map[string]bool)
+	var search func(name string) bool
+	search = func(name string) bool {
+		if name == ancestor {
+			return true
+		}
+		tag, ok := u.Tags[name]
+		if !ok || visited[name] {
+			return false
+		}
+		visited[name] = true
+		for _, parent := range tag.Parents {
+			if search(parent) {
+				return true
+			}
+		}
+		return false
+	}
+	return search(name)
+}
+
+func (u *User) setParents(name string, parents []string) (err error) {
+	for _, parent := range parents {
+		if _, err = u.getTag(parent); err != nil {
+			return err
+		}
+		if u.inherits(parent, name) {
+			return fmt.Errorf("tag %s on top of %s: %w", name, parent, ErrCycle)
+		}
+	}
+	tag, ok := u.Tags[name]
+	if !ok {
+		tag = newTag()
+		u.Tags[name] = tag
+	}
+	tag.Parents = append([]string(nil), parents...)
+	tag.touch()
+	return nil
+}
+
+func newTag() (tag *Tag) {
+	return &Tag{Artifacts: make(map[string]*Artifact), RecordedAt: time.Now().UTC()}
+}
+
+// tagChanges counts every change to any tag in this process, so a tag that
+// is deleted, restored from a snapshot or loaded again never gets a version it
+// had before.
+var tagChanges uint64
+
+// touch notes that the tag changed.
+func (t *Tag) touch() {
+	t.version = atomic.AddUint64(&tagChanges, 1)
+}
+
+// version is the latest change to name or any tag it inherits from.
+func (u *User) version(name string) (version uint64, err error) {
+	if _, err = u.getTag(name); err != nil {
+		return 0, err
+	}
+	visited := make(map[string]bool)
+	var search func(name string)
+	search = func(name string) {
+		tag, ok := u.Tags[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+		if tag.version > version {
+			version = tag.version
+		}
+		for _, parent := range tag.Parents {
+			search(parent)
+		}
+	}
+	search(name)
+	return version, nil
+}
+
+// recordInto returns the tag entries are written to, creating it if needed.
+func (u *User) recordInto(name string) (tag *Tag) {
+	tag, ok := u.Tags[name]
+	if !ok {
+		tag = newTag()
+		u.Tags[name] = tag
+	} else {
+		tag.RecordedAt = time.Now().UTC()
+	}
+	tag.touch()
+	return tag
+}
+
+// record writes an entry for url into the tag.
+func (u *User) record(name string, url string, artifact *Artifact) {
+	u.noteLatest(name, url, artifact)
+	u.recordInto(name).Artifacts[url] = artifact
+}
+
+func (u *User) parents(name string) (parents []string, err error) {
+	tag, err := u.getTag(name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, tag.Parents...), nil
+}
+
+// replaceParent points every tag layered on top of from at to instead.
+func (u *User) replaceParent(from string, to string) {
+	for _, tag := range u.Tags {
+		for i, parent := range tag.Parents {
+			if parent == from {
+				tag.Parents[i] = to
+				tag.touch()
+			}
+		}
+	}
+}
+
+// Scratch tags hold what an import is still working on. Their names start
+// with a NUL, which no name from a request header can, so they never clash
+// with the user's tags. They are left out of ListTags and retention, and a
+// Disk store drops any that a crash left behind when it is opened.
+const scratchPrefix = "\x00"
+
+func scratchTag(purpose string, tag string) string {
+	return scratchPrefix + purpose + " " + tag
+}
+
+func isScratch(name string) bool {
+	return strings.HasPrefix(name, scratchPrefix)
+}
+
+// tagNames returns the user's tags in order, leaving out scratch tags.
+func (u *User) tagNames() (names []string) {
+	names = make([]string, 0, len(u.Tags))
+	for name := range u.Tags {
+		if !isScratch(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deleteTag refuses to delete a tag others are layered on, they would quietly
+// lose what they inherit from it.
+func (u *User) deleteTag(name string) (err error) {
+	if _, err = u.getTag(name); err != nil {
+		return err
+	}
+	if children := u.children(name); len(children) > 0 {
+		return fmt.Errorf("tag %s is a parent of %s: %w", name, strings.Join(children, ", "), ErrHasChildren)
+	}
+	delete(u.Tags, name)
+	return nil
+}
+
+// children returns the tags that have name as one of their parents, in order.
+func (u *User) children(name string) (children []string) {
+	for child, tag := range u.Tags {
+		for _, parent := range tag.Parents {
+			if parent == name {
+				children = append(children, child)
+				break
+			}
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (u *User) copyTag(src string, dst string) (err error) {
+	tag, err := u.getTag(src)
+	if err != nil {
+		return err
+	}
+	if _, ok := u.Tags[dst]; ok {
+		return fmt.Errorf("tag %s: %w", dst, ErrExists)
+	}
+	// Entries are never modified in place, so sharing them is fine
+	copied := &Tag{
+		Artifacts:  make(map[string]*Artifact, len(tag.Artifacts)),
+		Parents:    append([]string(nil), tag.Parents...),
+		Pinned:     tag.Pinned,
+		RecordedAt: tag.RecordedAt,
+		PlayedAt:   tag.PlayedAt,
+		// Attestations are replaced, never modified, like entries
+		Attestation: tag.Attestation,
+	}
+	for key, artifact := range tag.Artifacts {
+		u.noteLatest(dst, key, artifact)
+		copied.Artifacts[key] = artifact
+	}
+	copied.touch()
+	u.Tags[dst] = copied
+	return nil
+}
+
+func (u *User) renameTag(src string, dst string) (err error) {
+	if err = u.copyTag(src, dst); err != nil {
+		return err
+	}
+	u.replaceParent(src, dst)
+	return u.deleteTag(src)
+}
+
+func (u *User) replaceTag(src string, dst string) (err error) {
+	tag, err := u.getTag(src)
+	if err != nil {
+		return err
+	}
+	for _, parent := range tag.Parents {
+		if u.inherits(parent, dst) {
+			return fmt.Errorf("tag %s on top of %s: %w", dst, parent, ErrCycle)
+		}
+	}
+	for key, artifact := range tag.Artifacts {
+		u.noteLatest(dst, key, artifact)
+	}
+	replaced := u.recordInto(dst)
+	replaced.Artifacts = tag.Artifacts
+	replaced.Parents = tag.Parents
+	replaced.Attestation = tag.Attestation
+	delete(u.Tags, src)
+	return nil
+}
+
+// referencedHashes is the set of hashes at least one tag still points at.
+func referencedHashes(users []*User) (referenced map[string]bool) {
+	referenced = make(map[string]bool)
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		for _, tag := range user.Tags {
+			for _, artifact := range tag.Artifacts {
+				referenced[artifact.Hash] = true
+			}
+		}
+	}
+	return referenced
+}
+
+// uniqueSizes maps the hash of every referenced body to its size.
+func uniqueSizes(users []*User) (sizes map[string]int64) {
+	sizes = make(map[string]int64)
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		for _, tag := range user.Tags {
+			for _, artifact := range tag.Artifacts {
+				sizes[artifact.Hash] = artifact.Size
+			}
+		}
+	}
+	return sizes
+}
+
+// indexStats fills in everything in Stats that the index alone can answer.
+func indexStats(users []*User) (stats Stats) {
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		for _, tag := range user.Tags {
+			for _, artifact := range tag.Artifacts {
+				stats.Entries += 1
+				stats.LogicalSize += artifact.Size
+			}
+		}
+	}
+	for _, size := range uniqueSizes(users) {
+		stats.UniqueSize += size
+	}
+	if stats.UniqueSize > 0 {
+		stats.DedupRatio = float64(stats.LogicalSize) / float64(stats.UniqueSize)
+	}
+	return stats
+}
+
+// tagStats works out TagStats for a tag of user, with chunksOf listing the
+// chunks a body is made of.
+func tagStats(users []*User, user *User, name string, chunksOf func(userID uint64, artifact *Artifact) ([]chunkRef, error)) (stats TagStats, err error) {
+	tag, err := user.getTag(name)
+	if err != nil {
+		return stats, err
+	}
+	mine := make(map[string]int64)
+	for _, artifact := range tag.Artifacts {
+		stats.Entries += 1
+		stats.LogicalSize += artifact.Size
+		refs, err := chunksOf(user.ID, artifact)
+		if err != nil {
+			return stats, err
+		}
+		for _, ref := range refs {
+			mine[ref.Hash] = ref.Size
+		}
+	}
+	for _, size := range mine {
+		stats.Chunks += 1
+		stats.ChunkedSize += size
+	}
+
+	shared := make(map[string]bool)
+	seen := make(map[string]bool) // user/hash pairs
+	for _, other := range users {
+		if other == nil {
+			continue
+		}
+		for otherName, otherTag := range other.Tags {
+			if other == user && otherName == name {
+				continue
+			}
+			for _, artifact := range otherTag.Artifacts {
+				pair := fmt.Sprintf("%d/%s", other.ID, artifact.Hash)
+				if seen[pair] {
+					continue
+				}
+				seen[pair] = true
+				refs, err := chunksOf(other.ID, artifact)
+				if err != nil {
+					return stats, err
+				}
+				for _, ref := range refs {
+					if _, ok := mine[ref.Hash]; ok {
+						shared[ref.Hash] = true
+					}
+				}
+			}
+		}
+	}
+	for hash := range shared {
+		stats.SharedSize += mine[hash]
+	}
+	stats.SavedSize = stats.LogicalSize - (stats.ChunkedSize - stats.SharedSize)
+	return stats, nil
+}
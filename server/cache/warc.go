@@ -0,0 +1,394 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WARC 1.1 (ISO 28500:2017), see
+// https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/
+// Every entry becomes a request/response record pair. The key the entry was
+// recorded under travels in the WARC-Btrfly-Key extension field.
+
+const warcBtrflyKey = "Warc-Btrfly-Key"
+
+type warcField struct {
+	name  string
+	value string
+}
+
+func warcRecordID() (id string, err error) {
+	uuid := make([]byte, 16)
+	if _, err = rand.Read(uuid); err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// writeWARCRecord writes a record whose block is head followed by length-len(head)
+// bytes of body. Compressed records are a gzip member each, so readers can
+// seek to any record.
+func writeWARCRecord(w io.Writer, compress bool, fields []warcField, head []byte, body io.Reader, length int64) (err error) {
+	if compress {
+		gz := gzip.NewWriter(w)
+		if err = writeWARCRecord(gz, false, fields, head, body, length); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("WARC/1.1\r\n")
+	for _, field := range fields {
+		fmt.Fprintf(buf, "%s: %s\r\n", field.name, field.value)
+	}
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", length)
+	buf.Write(head)
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if body != nil {
+		n, err := io.Copy(w, body)
+		if err != nil {
+			return err
+		}
+		if n != length-int64(len(head)) {
+			return fmt.Errorf("record body is %d bytes, want %d", n, length-int64(len(head)))
+		}
+	}
+	_, err = io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// ExportWARC writes every entry of tag to w as WARC request and response
+// records, preceded by a warcinfo record.
+func ExportWARC(k Handler, w io.Writer, tag string, userID uint64) (err error) {
+	return exportWARC(k, w, tag, userID, false)
+}
+
+// ExportWARCGzip writes the same records as ExportWARC, gzipped one by one as
+// .warc.gz files are.
+func ExportWARCGzip(k Handler, w io.Writer, tag string, userID uint64) (err error) {
+	return exportWARC(k, w, tag, userID, true)
+}
+
+func exportWARC(k Handler, w io.Writer, tag string, userID uint64, compress bool) (err error) {
+	artifacts, err := k.ListArtifacts(tag, userID)
+	if err != nil {
+		return err
+	}
+	date := time.Now().UTC().Format(time.RFC3339)
+
+	infoID, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+	info := []byte("software: btrfly\r\nformat: WARC File Format 1.1\r\nbtrfly-tag: " + tag + "\r\n")
+	err = writeWARCRecord(w, compress, []warcField{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", infoID},
+		{"WARC-Date", date},
+		{"Content-Type", "application/warc-fields"},
+	}, info, nil, int64(len(info)))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range sortedKeys(artifacts) {
+		if err = writeWARCPair(w, compress, key, artifacts[key], date, infoID); err != nil {
+			return fmt.Errorf("failed to export %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+func writeWARCPair(w io.Writer, compress bool, key string, artifact *Artifact, date string, infoID string) (err error) {
+	requestID, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+	responseID, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+	method, URL := SplitKey(key)
+	target, err := url.Parse("http://" + URL)
+	if err != nil {
+		return err
+	}
+
+	request := &bytes.Buffer{}
+	fmt.Fprintf(request, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, target.RequestURI(), target.Host)
+	if err = KeyHeaders(key).Write(request); err != nil {
+		return err
+	}
+	request.WriteString("\r\n")
+	err = writeWARCRecord(w, compress, []warcField{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", requestID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", target.String()},
+		{"WARC-Concurrent-To", responseID},
+		{"WARC-Warcinfo-ID", infoID},
+		{"WARC-Btrfly-Key", key},
+		{"Content-Type", "application/http;msgtype=request"},
+	}, request.Bytes(), nil, int64(request.Len()))
+	if err != nil {
+		return err
+	}
+
+	statusCode := artifact.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	// Without a Content-Length the body runs to the end of the block
+	response := &bytes.Buffer{}
+	fmt.Fprintf(response, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	if err = artifact.Header.Write(response); err != nil {
+		return err
+	}
+	response.WriteString("\r\n")
+
+	body, err := artifact.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return writeWARCRecord(w, compress, []warcField{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", target.String()},
+		{"WARC-Concurrent-To", requestID},
+		{"WARC-Warcinfo-ID", infoID},
+		{"WARC-Btrfly-Key", key},
+		{"WARC-Payload-Digest", warcDigest(artifact)},
+		{"Content-Type", "application/http;msgtype=response"},
+	}, response.Bytes(), body, int64(response.Len())+artifact.Size)
+}
+
+// warcDigest is the artifact's hash the way WARC tools write digests, the
+// algorithm and the base32 of the hash.
+func warcDigest(artifact *Artifact) string {
+	algorithm := artifact.Algorithm
+	if algorithm == "" {
+		algorithm = "md5"
+	}
+	sum, err := hex.DecodeString(artifact.Hash)
+	if err != nil {
+		return algorithm + ":" + artifact.Hash
+	}
+	return algorithm + ":" + base32.StdEncoding.EncodeToString(sum)
+}
+
+// warcReader walks the records of a WARC file, plain or gzipped.
+type warcReader struct {
+	r     *bufio.Reader
+	block *io.LimitedReader
+}
+
+func newWARCReader(r io.Reader) (wr *warcReader, err error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		// .warc.gz is a gzip member per record, which gzip reads as one stream
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(gz)
+	}
+	return &warcReader{r: br}, nil
+}
+
+// next returns the header and block of the next record, or io.EOF.
+func (wr *warcReader) next() (header textproto.MIMEHeader, block io.Reader, err error) {
+	if wr.block != nil {
+		// Skip whatever the caller left of the previous block
+		if _, err = io.Copy(io.Discard, wr.block); err != nil {
+			return nil, nil, err
+		}
+		if wr.block.N > 0 {
+			return nil, nil, fmt.Errorf("record is %d bytes short: %w", wr.block.N, io.ErrUnexpectedEOF)
+		}
+	}
+	tp := textproto.NewReader(wr.r)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "WARC/") {
+			return nil, nil, fmt.Errorf("expected a WARC record, got %q", line)
+		}
+		break
+	}
+	header, err = tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read record header: %s", err)
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("record %s has a bad Content-Length: %s", header.Get("WARC-Record-ID"), err)
+	}
+	wr.block = &io.LimitedReader{R: wr.r, N: length}
+	return header, wr.block, nil
+}
+
+// warcResponse is a response record already stored in the staging tag.
+type warcResponse struct {
+	artifact *Artifact
+	key      string
+}
+
+// ImportWARC records every response in a WARC file into tag, which must not
+// exist yet. Requests are paired with their responses through
+// WARC-Concurrent-To, falling back to WARC-Target-URI, and keyed with m
+// unless they carry the key a btrfly export put there. Responses without a
+// request are keyed as a GET of their target. Nothing is left behind when the
+// import fails.
+func ImportWARC(k Handler, r io.Reader, m *Matcher, tag string, userID uint64) (err error) {
+	wr, err := newWARCReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read WARC: %s", err)
+	}
+	if err = checkNewTag(k, tag, userID); err != nil {
+		return err
+	}
+	// Pairing may only settle after a response is stored, so responses go
+	// into a staging tag first and are only tagged once all keys are known.
+	staging := scratchTag("importing", tag)
+	imported := scratchTag("imported", tag)
+	defer func() {
+		if cleanupErr := k.DeleteTag(staging, userID); cleanupErr != nil && !errors.Is(cleanupErr, ErrNotFound) && err == nil {
+			err = cleanupErr
+		}
+		if err != nil {
+			k.DeleteTag(imported, userID)
+		}
+	}()
+
+	requestKeys := make(map[string]string)   // request record ID -> key
+	requestsByURI := make(map[string]string) // target URI -> key of the latest unpaired request
+	responses := make(map[string]*warcResponse)
+	order := make([]*warcResponse, 0)
+	for {
+		header, block, err := wr.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read WARC: %s", err)
+		}
+		id := header.Get("WARC-Record-ID")
+		target := header.Get("WARC-Target-URI")
+		linked := header.Values("WARC-Concurrent-To")
+
+		switch header.Get("WARC-Type") {
+		case "request":
+			key := header.Get(warcBtrflyKey)
+			if key == "" {
+				if key, err = warcRequestKey(block, target, m); err != nil {
+					return fmt.Errorf("request %s: %s", id, err)
+				}
+			}
+			requestKeys[id] = key
+			paired := false
+			for _, responseID := range linked {
+				if response, ok := responses[responseID]; ok {
+					response.key = key
+					paired = true
+				}
+			}
+			if !paired {
+				requestsByURI[target] = key
+			}
+		case "response":
+			response := &warcResponse{key: header.Get(warcBtrflyKey)}
+			for _, requestID := range linked {
+				if key, ok := requestKeys[requestID]; ok && response.key == "" {
+					response.key = key
+				}
+			}
+			if key, ok := requestsByURI[target]; ok && response.key == "" {
+				response.key = key
+				delete(requestsByURI, target)
+			}
+			if response.key == "" {
+				if response.key, err = warcRequestKey(nil, target, m); err != nil {
+					return fmt.Errorf("response %s: %s", id, err)
+				}
+			}
+			method, _ := SplitKey(response.key)
+			if response.artifact, err = warcStoreResponse(k, block, method, id, staging, userID); err != nil {
+				return fmt.Errorf("response %s: %s", id, err)
+			}
+			responses[id] = response
+			order = append(order, response)
+		}
+	}
+
+	// Later responses for the same key win, just like when recording. They
+	// only show up in tag once all of them are in.
+	for _, response := range order {
+		if err = k.TagArtifact(response.artifact, imported, response.key, userID); err != nil {
+			return err
+		}
+	}
+	return publishStaged(k, imported, tag, nil, nil, userID)
+}
+
+// warcRequestKey keys the HTTP request in block, or a plain GET of target
+// when there is no block.
+func warcRequestKey(block io.Reader, target string, m *Matcher) (key string, err error) {
+	if block == nil {
+		req, err := http.NewRequest("GET", target, http.NoBody)
+		if err != nil {
+			return "", err
+		}
+		return m.Key(req)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(block))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse HTTP request: %s", err)
+	}
+	if req.Host == "" {
+		if parsed, err := url.Parse(target); err == nil {
+			req.Host = parsed.Host
+		}
+	}
+	return m.Key(req)
+}
+
+// warcStoreResponse stores the HTTP response in block under the record's ID.
+// The method decides whether the response can have a body at all.
+func warcStoreResponse(k Handler, block io.Reader, method string, id string, staging string, userID uint64) (artifact *Artifact, err error) {
+	resp, err := http.ReadResponse(bufio.NewReader(block), &http.Request{Method: method})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTTP response: %s", err)
+	}
+	defer resp.Body.Close()
+	header := resp.Header.Clone()
+	header.Del("Transfer-Encoding")
+	artifact = &Artifact{StatusCode: resp.StatusCode, Header: header}
+	if err = k.AddArtifact(artifact, resp.Body, id, staging, userID); err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWARCRoundTrip(t *testing.T) {
+	src := CreateMemory()
+	src.AddUser(CreateUser())
+	bodies := map[string]string{
+		"GET example.com/index.html":                "<html>hi</html>",
+		"GET example.com/logo.png":                  "\x89PNG\r\n\x1a\n\x00\xff\r\n\r\n",
+		"GET registry.example.com/pkg Accept=a%2Fb": `{"name":"pkg"}`,
+		"HEAD example.com/index.html":               "",
+	}
+	for key, body := range bodies {
+		header := http.Header{"Content-Type": {"x/" + strings.Fields(key)[0]}}
+		if strings.HasPrefix(key, "HEAD") {
+			header.Set("Content-Length", "15")
+		}
+		artifact := &Artifact{StatusCode: 203, Header: header}
+		if err := src.AddArtifact(artifact, strings.NewReader(body), key, "build", 0); err != nil {
+			t.Fatalf("Failed to add artifact: %s", err)
+		}
+	}
+
+	warc := &bytes.Buffer{}
+	if err := ExportWARC(src, warc, "build", 0); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+	if n := strings.Count(warc.String(), "WARC/1.1\r\n"); n != 1+2*len(bodies) {
+		t.Errorf("got %d records, want %d", n, 1+2*len(bodies))
+	}
+	// Payload digests are base32, like other WARC tools write them
+	sum := sha256.Sum256([]byte("<html>hi</html>"))
+	if digest := "WARC-Payload-Digest: sha256:" + base32.StdEncoding.EncodeToString(sum[:]) + "\r\n"; !strings.Contains(warc.String(), digest) {
+		t.Errorf("no %q in the export", digest)
+	}
+	gzipped := &bytes.Buffer{}
+	if err := ExportWARCGzip(src, gzipped, "build", 0); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+	// Every record is a gzip member of its own
+	members := bytes.NewReader(gzipped.Bytes())
+	zr, err := gzip.NewReader(members)
+	if err != nil {
+		t.Fatalf("Failed to read gzip: %s", err)
+	}
+	for n := 0; ; n++ {
+		zr.Multistream(false)
+		member, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Failed to read member %d: %s", n, err)
+		}
+		if records := strings.Count(string(member), "WARC/1.1\r\n"); records != 1 {
+			t.Errorf("member %d holds %d records", n, records)
+		}
+		if err = zr.Reset(members); err == io.EOF {
+			if n+1 != 1+2*len(bodies) {
+				t.Errorf("got %d members, want %d", n+1, 1+2*len(bodies))
+			}
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read member %d: %s", n+1, err)
+		}
+	}
+
+	forEachHandler(t, func(t *testing.T, dst Handler) {
+		// A matcher that would key these differently, the exported keys win
+		m := &Matcher{Default: MatchRule{Headers: []string{"Host"}}}
+		if err := ImportWARC(dst, bytes.NewReader(warc.Bytes()), m, "imported", 0); err != nil {
+			t.Fatalf("Failed to import: %s", err)
+		}
+		tags, err := dst.ListTags(0)
+		if err != nil || !reflect.DeepEqual(tags, []string{"imported"}) {
+			t.Errorf("tags: got %v (%v), want [imported]", tags, err)
+		}
+		if err = ImportWARC(dst, bytes.NewReader(gzipped.Bytes()), m, "imported-gz", 0); err != nil {
+			t.Fatalf("Failed to import gzipped: %s", err)
+		}
+		if got, _ := dst.ListArtifacts("imported-gz", 0); len(got) != len(bodies) {
+			t.Errorf("gzipped: got %d entries, want %d", len(got), len(bodies))
+		}
+		for key, body := range bodies {
+			got, err := dst.GetArtifact(key, "imported", 0)
+			if err != nil {
+				t.Errorf("Failed to get %s: %s", key, err)
+				continue
+			}
+			if data := readArtifact(t, got); data != body {
+				t.Errorf("%s: got %q, want %q", key, data, body)
+			}
+			if got.StatusCode != 203 || got.Header.Get("Content-Type") != "x/"+strings.Fields(key)[0] {
+				t.Errorf("%s: got %d %v", key, got.StatusCode, got.Header)
+			}
+		}
+	})
+}
+
+func warcRecord(fields string, block string) string {
+	return fmt.Sprintf("WARC/1.0\r\n%sContent-Length: %d\r\n\r\n%s\r\n\r\n", fields, len(block), block)
+}
+
+func TestWARCImportForeign(t *testing.T) {
+	// Response before request, the way crawlers tend to write them
+	records := warcRecord(
+		"WARC-Type: response\r\nWARC-Record-ID: <urn:uuid:1>\r\nWARC-Target-URI: https://example.com/app.js\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: text/javascript\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nalert\r\n0\r\n\r\n",
+	) + warcRecord(
+		"WARC-Type: request\r\nWARC-Record-ID: <urn:uuid:2>\r\nWARC-Concurrent-To: <urn:uuid:1>\r\nWARC-Target-URI: https://example.com/app.js\r\n",
+		"GET /app.js HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n",
+	) + warcRecord(
+		"WARC-Type: metadata\r\nWARC-Record-ID: <urn:uuid:3>\r\n",
+		"outlinks: none\r\n",
+	) + warcRecord(
+		"WARC-Type: request\r\nWARC-Record-ID: <urn:uuid:4>\r\nWARC-Target-URI: http://example.com/api\r\n",
+		"POST /api HTTP/1.1\r\nHost: example.com\r\nContent-Length: 7\r\n\r\n{\"q\":1}",
+	) + warcRecord(
+		"WARC-Type: response\r\nWARC-Record-ID: <urn:uuid:5>\r\nWARC-Target-URI: http://example.com/api\r\n",
+		"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+	) + warcRecord(
+		"WARC-Type: response\r\nWARC-Record-ID: <urn:uuid:6>\r\nWARC-Target-URI: http://example.com/lonely\r\n",
+		"HTTP/1.1 404 Not Found\r\n\r\nnope",
+	)
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	gz.Write([]byte(records))
+	gz.Close()
+	m := &Matcher{Default: MatchRule{Headers: []string{"Accept"}, Body: true}}
+
+	cases := []struct {
+		key    string
+		status int
+		header http.Header
+		body   string
+	}{
+		{"GET example.com/app.js Accept=%2A%2F%2A", 200,
+			http.Header{"Content-Type": {"text/javascript"}}, "alert"},
+		{"POST example.com/api body=sha256:6ae0f660046dadcf5fe8462c0e00a062db4c8d67be82f4098c5ea4208d19b076", 201,
+			http.Header{"Content-Length": {"2"}}, "ok"},
+		{"GET example.com/lonely", 404, http.Header{}, "nope"},
+	}
+	for name, data := range map[string][]byte{"plain": []byte(records), "gzip": gzipped.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			forEachHandler(t, func(t *testing.T, k Handler) {
+				if err := ImportWARC(k, bytes.NewReader(data), m, "crawl", 0); err != nil {
+					t.Fatalf("Failed to import: %s", err)
+				}
+				artifacts, err := k.ListArtifacts("crawl", 0)
+				if err != nil || len(artifacts) != len(cases) {
+					t.Errorf("got %d entries (%v), want %d", len(artifacts), err, len(cases))
+				}
+				for _, tc := range cases {
+					got, err := k.GetArtifact(tc.key, "crawl", 0)
+					if err != nil {
+						t.Errorf("Failed to get %s: %s", tc.key, err)
+						continue
+					}
+					if got.StatusCode != tc.status || !reflect.DeepEqual(got.Header, tc.header) {
+						t.Errorf("%s: got %d %v, want %d %v", tc.key, got.StatusCode, got.Header, tc.status, tc.header)
+					}
+					if body := readArtifact(t, got); body != tc.body {
+						t.Errorf("%s: got %q, want %q", tc.key, body, tc.body)
+					}
+				}
+
+				truncated := data[:len(data)/2]
+				if err := ImportWARC(k, bytes.NewReader(truncated), m, "broken", 0); err == nil {
+					t.Errorf("Imported a truncated WARC")
+				}
+				if tags, _ := k.ListTags(0); !reflect.DeepEqual(tags, []string{"crawl"}) {
+					t.Errorf("tags after failed import: got %q, want [crawl]", tags)
+				}
+			})
+		})
+	}
+}
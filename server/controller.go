@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/emmettmcdow/btrfly/server/cache"
+	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	// "github.com/emmettmcdow/btrfly/server/proxy"
 )
 
 // TODO: make the controller API actually not shit(comply with REST)
-func controller(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server) {
+func controller(wg *sync.WaitGroup, port uint, tlsEnabled bool, k cache.Handler) (s *http.Server) {
 	var config *tls.Config
 
 	m := http.NewServeMux()
@@ -50,9 +58,11 @@ func controller(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server)
 				http.StatusBadRequest)
 			return
 		}
+		previous := currentState()
 		if err := Tag(tag[0]); err != nil {
 			fmt.Printf("Failed to Tag %s: %s\n", tag[0], err)
 		}
+		endRecording(k, previous)
 	})
 	m.HandleFunc("/mode", func(w http.ResponseWriter, r *http.Request) {
 		mode, ok := r.Header["Mode"]
@@ -62,6 +72,7 @@ func controller(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server)
 				http.StatusBadRequest)
 			return
 		}
+		previous := currentState()
 		err := Mode(mode[0])
 		if err != nil {
 			http.Error(w,
@@ -69,6 +80,485 @@ func controller(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server)
 				http.StatusBadRequest)
 			return
 		}
+		endRecording(k, previous)
+	})
+	m.HandleFunc("/tags", func(w http.ResponseWriter, r *http.Request) {
+		tags, err := k.ListTags(currentUser())
+		if err != nil {
+			storeError(w, "Failed to list tags", err)
+			return
+		}
+		writeJSON(w, tags)
+	})
+	m.HandleFunc("/tags/entries", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		artifacts, err := k.ListArtifacts(tag, currentUser())
+		if err != nil {
+			storeError(w, "Failed to list entries", err)
+			return
+		}
+		entries := make([]tagEntry, 0, len(artifacts))
+		for key, artifact := range artifacts {
+			entries = append(entries, tagEntry{Key: key, Hash: artifact.Hash, Size: artifact.Size})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		writeJSON(w, entries)
+	})
+	m.HandleFunc("/tags/diff", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		other, ok := requireHeader(w, r, "Other")
+		if !ok {
+			return
+		}
+		diff, err := cache.DiffTags(k, tag, other, currentUser())
+		if err != nil {
+			storeError(w, "Failed to diff tags", err)
+			return
+		}
+		writeJSON(w, diff)
+	})
+	m.HandleFunc("/tags/parents", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		user := currentUser()
+		// A POST replaces the tag's parents with the Parents header, even an
+		// empty one, GET only shows them
+		if r.Method == http.MethodPost {
+			list, ok := requireHeader(w, r, "Parents")
+			if !ok {
+				return
+			}
+			parents := make([]string, 0)
+			for _, parent := range strings.Split(list, ",") {
+				if parent = strings.TrimSpace(parent); parent != "" {
+					parents = append(parents, parent)
+				}
+			}
+			if err := k.SetParents(tag, parents, user); err != nil {
+				storeError(w, "Failed to set parents", err)
+				return
+			}
+		} else if _, ok := r.Header["Parents"]; ok {
+			http.Error(w, "Parents are set with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		parents, err := k.Parents(tag, user)
+		if err != nil {
+			storeError(w, "Failed to get parents", err)
+			return
+		}
+		writeJSON(w, parents)
+	})
+	m.HandleFunc("/tags/pin", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		user := currentUser()
+		// A POST pins or unpins the tag, GET only shows whether it is
+		if r.Method == http.MethodPost {
+			value, ok := requireHeader(w, r, "Pinned")
+			if !ok {
+				return
+			}
+			pinned, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "Pinned has to be true or false", http.StatusBadRequest)
+				return
+			}
+			if err = k.SetPinned(tag, pinned, user); err != nil {
+				storeError(w, "Failed to pin tag", err)
+				return
+			}
+		} else if _, ok := r.Header["Pinned"]; ok {
+			http.Error(w, "Tags are pinned with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		pinned, err := k.Pinned(tag, user)
+		if err != nil {
+			storeError(w, "Failed to get pin", err)
+			return
+		}
+		writeJSON(w, pinned)
+	})
+	m.HandleFunc("/tags/entry", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		key, ok := requireHeader(w, r, "Key")
+		if !ok {
+			return
+		}
+		entry, err := cache.InspectEntry(k, tag, key, currentUser())
+		if err != nil {
+			storeError(w, "Failed to inspect entry", err)
+			return
+		}
+		writeJSON(w, entry)
+	})
+	m.HandleFunc("/tags/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Tags are deleted with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		if err := k.DeleteTag(tag, currentUser()); err != nil {
+			storeError(w, "Failed to delete tag", err)
+		}
+	})
+	m.HandleFunc("/tags/copy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Tags are copied with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		src, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		dst, ok := requireHeader(w, r, "Dest")
+		if !ok {
+			return
+		}
+		if err := k.CopyTag(src, dst, currentUser()); err != nil {
+			storeError(w, "Failed to copy tag", err)
+		}
+	})
+	m.HandleFunc("/tags/rename", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Tags are renamed with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		src, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		dst, ok := requireHeader(w, r, "Dest")
+		if !ok {
+			return
+		}
+		if err := k.RenameTag(src, dst, currentUser()); err != nil {
+			storeError(w, "Failed to rename tag", err)
+		}
+	})
+	m.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		var export func(k cache.Handler, w io.Writer, tag string, userID uint64) error
+		switch format := r.Header.Get("Format"); format {
+		case "", "bundle":
+			w.Header().Set("Content-Type", "application/x-tar")
+			export = cache.ExportTag
+		case "har":
+			w.Header().Set("Content-Type", "application/json")
+			export = cache.ExportHAR
+		case "warc":
+			w.Header().Set("Content-Type", "application/warc")
+			export = cache.ExportWARC
+		case "warc.gz":
+			w.Header().Set("Content-Type", "application/gzip")
+			export = cache.ExportWARCGzip
+		default:
+			http.Error(w, fmt.Sprintf("Unknown format %s", format), http.StatusBadRequest)
+			return
+		}
+		user := currentUser()
+		if _, err := k.ListArtifacts(tag, user); err != nil {
+			w.Header().Del("Content-Type")
+			storeError(w, "Failed to export tag", err)
+			return
+		}
+		if err := export(k, w, tag, user); err != nil {
+			// Part of the export is already out, so cut it short
+			log.Printf("Failed to export %s: %s", tag, err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+	m.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Imports have to be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		tag := r.Header.Get("Tag")
+		state := currentState()
+		var err error
+		switch format := r.Header.Get("Format"); format {
+		case "", "bundle":
+			tag, err = cache.ImportTag(k, r.Body, tag, state.user)
+		case "har":
+			if _, ok := requireHeader(w, r, "Tag"); !ok {
+				return
+			}
+			err = cache.ImportHAR(k, r.Body, state.matcher, tag, state.user)
+		case "warc", "warc.gz":
+			if _, ok := requireHeader(w, r, "Tag"); !ok {
+				return
+			}
+			// Compressed or not is told apart by the content
+			err = cache.ImportWARC(k, r.Body, state.matcher, tag, state.user)
+		default:
+			http.Error(w, fmt.Sprintf("Unknown format %s", format), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			storeError(w, "Failed to import", err)
+			return
+		}
+		writeJSON(w, tag)
+	})
+	m.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Garbage is collected with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		freed, err := k.GC()
+		if err != nil {
+			storeError(w, "Failed to collect garbage", err)
+			return
+		}
+		log.Printf("Garbage collection freed %d bytes", freed)
+		writeJSON(w, gcResult{Freed: freed})
+	})
+	m.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Snapshots are taken with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		d, ok := snapshotStore(w, k)
+		if !ok {
+			return
+		}
+		stats, err := d.Snapshot(snapshotRoot)
+		if err != nil {
+			storeError(w, "Failed to take snapshot", err)
+			return
+		}
+		log.Printf("Took snapshot %s, copied %d of %d files (%d bytes)", stats.Name, stats.Copied, stats.Files, stats.CopiedSize)
+		writeJSON(w, stats)
+	})
+	m.HandleFunc("/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := snapshotStore(w, k); !ok {
+			return
+		}
+		names, err := cache.Snapshots(snapshotRoot)
+		if err != nil {
+			storeError(w, "Failed to list snapshots", err)
+			return
+		}
+		writeJSON(w, names)
+	})
+	m.HandleFunc("/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Snapshots are restored with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		d, ok := snapshotStore(w, k)
+		if !ok {
+			return
+		}
+		// Without a Snapshot header the latest one is restored
+		stats, err := d.Restore(snapshotRoot, r.Header.Get("Snapshot"))
+		if err != nil {
+			storeError(w, "Failed to restore snapshot", err)
+			return
+		}
+		log.Printf("Restored snapshot %s, copied %d of %d files (%d bytes)", stats.Name, stats.Copied, stats.Files, stats.CopiedSize)
+		writeJSON(w, stats)
+	})
+	m.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := k.Stats()
+		if err != nil {
+			storeError(w, "Failed to gather stats", err)
+			return
+		}
+		writeJSON(w, stats)
+	})
+	m.HandleFunc("/tags/stats", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		stats, err := k.TagStats(tag, currentUser())
+		if err != nil {
+			storeError(w, "Failed to get tag stats", err)
+			return
+		}
+		writeJSON(w, stats)
+	})
+	m.HandleFunc("/tags/manifest", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		manifest := &bytes.Buffer{}
+		if err := cache.WriteManifest(k, manifest, tag, currentUser()); err != nil {
+			storeError(w, "Failed to build manifest", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := manifest.WriteTo(w); err != nil {
+			log.Printf("Failed to write manifest: %s", err)
+		}
+	})
+	m.HandleFunc("/tags/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Manifests have to be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		manifest := cache.Manifest{}
+		if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decode manifest: %s", err), http.StatusBadRequest)
+			return
+		}
+		report, err := cache.VerifyManifest(k, manifest, r.Header.Get("Tag"), currentUser())
+		if err != nil {
+			storeError(w, "Failed to verify manifest", err)
+			return
+		}
+		writeJSON(w, report)
+	})
+	auditClient := &http.Client{}
+	m.HandleFunc("/tags/audit", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		workers := defaultAuditWorkers
+		if value := r.Header.Get("Workers"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxAuditWorkers {
+				http.Error(w, fmt.Sprintf("Workers has to be between 1 and %d", maxAuditWorkers), http.StatusBadRequest)
+				return
+			}
+			workers = n
+		}
+		report, err := auditTag(k, tag, currentUser(), auditClient, workers)
+		if err != nil {
+			storeError(w, "Failed to audit tag", err)
+			return
+		}
+		writeJSON(w, report)
+	})
+	m.HandleFunc("/tags/sign", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Tags are signed with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		if signingKey == nil {
+			http.Error(w, "The server was started without -signing-key", http.StatusNotImplemented)
+			return
+		}
+		attestation, err := cache.SignTag(k, tag, currentUser(), signingKey)
+		if err != nil {
+			storeError(w, "Failed to sign tag", err)
+			return
+		}
+		writeJSON(w, attestation)
+	})
+	m.HandleFunc("/tags/attestation", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		attestation, err := k.Attestation(tag, currentUser())
+		if err != nil {
+			storeError(w, "Failed to get attestation", err)
+			return
+		}
+		if attestation == nil {
+			http.Error(w, fmt.Sprintf("Tag %s has no attestation", tag), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, attestation)
+	})
+	m.HandleFunc("/signing-key", func(w http.ResponseWriter, r *http.Request) {
+		if signingKey == nil {
+			http.Error(w, "The server was started without -signing-key", http.StatusNotImplemented)
+			return
+		}
+		fmt.Fprintf(w, "%x\n", signingKey.Public())
+	})
+	m.HandleFunc("/sync/manifest", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		manifest, err := cache.SyncManifest(k, tag, currentUser())
+		if err != nil {
+			storeError(w, "Failed to describe tag", err)
+			return
+		}
+		writeJSON(w, manifest)
+	})
+	m.HandleFunc("/sync/blob", func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := requireHeader(w, r, "Tag")
+		if !ok {
+			return
+		}
+		key, ok := requireHeader(w, r, "Key")
+		if !ok {
+			return
+		}
+		artifact, err := k.GetArtifact(key, tag, currentUser())
+		if err != nil {
+			storeError(w, "Failed to get artifact", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(artifact.Size, 10))
+		if _, err = artifact.WriteTo(w); err != nil {
+			log.Printf("Failed to send %s of %s for syncing: %s", key, tag, err)
+			// The puller checks the digest, but do not let it wait for the rest
+			panic(http.ErrAbortHandler)
+		}
+	})
+	syncClient := &http.Client{}
+	m.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Syncing is started with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		source, ok := requireHeader(w, r, "Source")
+		if !ok {
+			return
+		}
+		if !syncPeer(source) {
+			http.Error(w, fmt.Sprintf("%s is not one of -sync-peers", source), http.StatusForbidden)
+			return
+		}
+		list, ok := requireHeader(w, r, "Tags")
+		if !ok {
+			return
+		}
+		patterns, err := syncPatterns(list)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		synced, err := syncTags(k, source, patterns, currentUser(), syncClient)
+		if err != nil {
+			storeError(w, "Failed to sync", err)
+			return
+		}
+		logSynced(source, synced)
+		writeJSON(w, synced)
 	})
 	m.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte("healthy"))
@@ -100,3 +590,105 @@ func controller(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server)
 	fmt.Printf("Health check failed")
 	return nil
 }
+
+type tagEntry struct {
+	Key  string
+	Hash string
+	Size int64
+}
+
+type gcResult struct {
+	Freed int64
+}
+
+// collectGarbage runs a GC pass on k every interval, forever.
+func collectGarbage(k cache.Handler, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		freed, err := k.GC()
+		if err != nil {
+			log.Printf("Scheduled garbage collection failed: %s", err)
+			continue
+		}
+		log.Printf("Scheduled garbage collection freed %d bytes", freed)
+	}
+}
+
+// reapTags enforces policy on k every interval, forever, and reclaims the
+// storage of whatever it deleted.
+func reapTags(k cache.Handler, policy cache.RetentionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		reaped, err := k.Reap(policy, now)
+		for _, tag := range reaped {
+			log.Printf("Reaped tag %s of user %d: %s", tag.Tag, tag.User, tag.Reason)
+		}
+		if err != nil {
+			log.Printf("Scheduled retention failed: %s", err)
+			continue
+		}
+		if len(reaped) == 0 {
+			continue
+		}
+		freed, err := k.GC()
+		if err != nil {
+			log.Printf("Garbage collection after retention failed: %s", err)
+			continue
+		}
+		log.Printf("Retention reaped %d tags and freed %d bytes", len(reaped), freed)
+	}
+}
+
+// snapshotRoot is where /snapshot and /restore keep snapshots of the store.
+// It is set from -snapshot-dir before the controller starts.
+var snapshotRoot string
+
+// snapshotStore returns the store to snapshot, answering with a 501 when
+// snapshots are not set up.
+func snapshotStore(w http.ResponseWriter, k cache.Handler) (d *cache.Disk, ok bool) {
+	d, ok = k.(*cache.Disk)
+	if !ok {
+		http.Error(w, "Only the disk store can be snapshotted", http.StatusNotImplemented)
+		return nil, false
+	}
+	if snapshotRoot == "" {
+		http.Error(w, "The server was started without -snapshot-dir", http.StatusNotImplemented)
+		return nil, false
+	}
+	return d, true
+}
+
+// requireHeader fetches a header the endpoint cannot do without, answering
+// with a 400 when it is missing.
+func requireHeader(w http.ResponseWriter, r *http.Request, name string) (value string, ok bool) {
+	values, ok := r.Header[name]
+	if !ok {
+		http.Error(w,
+			fmt.Sprintf("No '%s' header was passed", name),
+			http.StatusBadRequest)
+		return "", false
+	}
+	return values[0], true
+}
+
+// storeError answers with the status code matching an error from cache.Handler.
+func storeError(w http.ResponseWriter, msg string, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, cache.ErrNotFound) {
+		code = http.StatusNotFound
+	} else if errors.Is(err, cache.ErrExists) || errors.Is(err, cache.ErrHasChildren) {
+		code = http.StatusConflict
+	} else if errors.Is(err, cache.ErrCycle) {
+		code = http.StatusBadRequest
+	}
+	http.Error(w, fmt.Sprintf("%s: %s", msg, err), code)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Failed to write response: %s", err)
+	}
+}
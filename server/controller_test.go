@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"github.com/emmettmcdow/btrfly/server/cache"
+	"io"
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -24,14 +32,15 @@ var baseWant = state{
 }
 
 func verifyState(wantState state, t *testing.T) {
-	if proxyMode != wantState.mode {
-		t.Errorf("proxyMode: Got: %s, Want: %s\n", proxyMode.String(), wantState.mode.String())
+	got := currentState()
+	if got.mode != wantState.mode {
+		t.Errorf("proxyMode: Got: %s, Want: %s\n", got.mode.String(), wantState.mode.String())
 	}
-	if buildTag != wantState.tag {
-		t.Errorf("buildTag: Got: %s, Want: %s\n", buildTag, wantState.tag)
+	if got.tag != wantState.tag {
+		t.Errorf("buildTag: Got: %s, Want: %s\n", got.tag, wantState.tag)
 	}
-	if currUser != wantState.user {
-		t.Errorf("currUser: Got: %d, Want: %d\n", currUser, wantState.user)
+	if got.user != wantState.user {
+		t.Errorf("currUser: Got: %d, Want: %d\n", got.user, wantState.user)
 	}
 }
 
@@ -144,6 +153,411 @@ func testControllerTag(t *testing.T) {
 	}
 }
 
+func doControllerRequest(t *testing.T, method string, path string, header http.Header, reqBody io.Reader) (body string, statusCode int) {
+	URL := "http://127.0.0.1:5678" + path
+	req, err := http.NewRequest(method, URL, reqBody)
+	if err != nil {
+		t.Fatalf("Failed to generate new request for %s\n", URL)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to \"Do\" %s with error: %s\n", URL, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body of %s: %s\n", URL, err)
+	}
+	return string(data), resp.StatusCode
+}
+
+func testControllerTags(t *testing.T, k cache.Handler) {
+	addTestArtifacts(t, k, "base", "GET example.com/b", "GET example.com/a")
+	a, _ := k.GetArtifact("GET example.com/a", "base", 0)
+	b, _ := k.GetArtifact("GET example.com/b", "base", 0)
+	entries := fmt.Sprintf(`[{"Key":"GET example.com/a","Hash":"%s","Size":17},{"Key":"GET example.com/b","Hash":"%s","Size":17}]`+"\n",
+		a.Hash, b.Hash)
+	recorded := &cache.Artifact{Metadata: &cache.Metadata{
+		RecordedAt:  time.Date(2024, 5, 2, 3, 4, 5, 0, time.UTC),
+		Session:     "nightly",
+		Scheme:      "http",
+		Host:        "example.com",
+		FinalURL:    "http://mirror.example.com/c",
+		ContentType: "text/plain",
+		ETag:        `"c1"`,
+	}}
+	if err := k.AddArtifact(recorded, strings.NewReader("c"), "GET example.com/c", "audited", 0); err != nil {
+		t.Fatalf("Failed to add artifact: %s", err)
+	}
+	entry := fmt.Sprintf(`{"Key":"GET example.com/c","Method":"GET","URL":"example.com/c","StatusCode":0,"Header":null,"Hash":"%s","Algorithm":"sha256","Size":1,`+
+		`"Metadata":{"RecordedAt":"2024-05-02T03:04:05Z","User":0,"Session":"nightly","Scheme":"http","Host":"example.com",`+
+		`"FinalURL":"http://mirror.example.com/c","ContentType":"text/plain","ETag":"\"c1\""}}`+"\n", recorded.Hash)
+
+	subtests := []struct {
+		method   string
+		path     string
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{"GET", "/tags/entry", http.Header{"Tag": {"audited"}, "Key": {"GET example.com/c"}}, 200, entry},
+		{"GET", "/tags/entry", http.Header{"Tag": {"audited"}, "Key": {"GET example.com/DNE"}}, 404, ""},
+		{"GET", "/tags/entry", http.Header{"Tag": {"audited"}}, 400, ""},
+		{"GET", "/tags/delete", http.Header{"Tag": {"audited"}}, 405, ""},
+		{"POST", "/tags/delete", http.Header{"Tag": {"audited"}}, 200, ""},
+		{"GET", "/tags", nil, 200, `["base"]` + "\n"},
+		{"GET", "/tags/entries", http.Header{"Tag": {"base"}}, 200, entries},
+		{"GET", "/tags/entries", http.Header{"Tag": {"DNE"}}, 404, ""},
+		{"GET", "/tags/stats", http.Header{"Tag": {"base"}}, 200, `{"Entries":2,"LogicalSize":34,"Chunks":2,"ChunkedSize":34,"SharedSize":0,"SavedSize":0}` + "\n"},
+		{"GET", "/tags/stats", http.Header{"Tag": {"DNE"}}, 404, ""},
+		{"GET", "/tags/entries", nil, 400, ""},
+		{"POST", "/tags/copy", http.Header{"Tag": {"base"}, "Dest": {"copy"}}, 200, ""},
+		{"POST", "/tags/copy", http.Header{"Tag": {"base"}, "Dest": {"copy"}}, 409, ""},
+		{"POST", "/tags/copy", http.Header{"Tag": {"base"}}, 400, ""},
+		{"GET", "/tags/copy", http.Header{"Tag": {"base"}, "Dest": {"copy2"}}, 405, ""},
+		{"GET", "/tags/entries", http.Header{"Tag": {"copy"}}, 200, entries},
+		{"GET", "/tags/diff", http.Header{"Tag": {"base"}, "Other": {"copy"}}, 200, `{"Added":[],"Removed":[],"Changed":[]}` + "\n"},
+		{"GET", "/tags/diff", http.Header{"Tag": {"base"}, "Other": {"DNE"}}, 404, ""},
+		{"GET", "/tags/diff", http.Header{"Tag": {"base"}}, 400, ""},
+		{"GET", "/tags/parents", http.Header{"Tag": {"layer"}, "Parents": {"copy, base"}}, 405, ""},
+		{"POST", "/tags/parents", http.Header{"Tag": {"layer"}}, 400, ""},
+		{"POST", "/tags/parents", http.Header{"Tag": {"layer"}, "Parents": {"copy, base"}}, 200, `["copy","base"]` + "\n"},
+		{"POST", "/tags/parents", http.Header{"Tag": {"base"}, "Parents": {"layer"}}, 400, ""},
+		{"POST", "/tags/parents", http.Header{"Tag": {"layer"}, "Parents": {"DNE"}}, 404, ""},
+		{"GET", "/tags/pin", http.Header{"Tag": {"copy"}}, 200, "false\n"},
+		{"GET", "/tags/pin", http.Header{"Tag": {"copy"}, "Pinned": {"true"}}, 405, ""},
+		{"POST", "/tags/pin", http.Header{"Tag": {"copy"}}, 400, ""},
+		{"POST", "/tags/pin", http.Header{"Tag": {"copy"}, "Pinned": {"true"}}, 200, "true\n"},
+		{"POST", "/tags/pin", http.Header{"Tag": {"copy"}, "Pinned": {"maybe"}}, 400, ""},
+		{"POST", "/tags/pin", http.Header{"Tag": {"DNE"}, "Pinned": {"true"}}, 404, ""},
+		{"GET", "/tags/pin", nil, 400, ""},
+		{"POST", "/tags/rename", http.Header{"Tag": {"copy"}, "Dest": {"renamed"}}, 200, ""},
+		{"GET", "/tags/parents", http.Header{"Tag": {"layer"}}, 200, `["renamed","base"]` + "\n"},
+		{"GET", "/tags/pin", http.Header{"Tag": {"renamed"}}, 200, "true\n"},
+		{"POST", "/tags/delete", http.Header{"Tag": {"renamed"}}, 409, ""},
+		{"POST", "/tags/parents", http.Header{"Tag": {"layer"}, "Parents": {""}}, 200, `[]` + "\n"},
+		{"POST", "/tags/delete", http.Header{"Tag": {"layer"}}, 200, ""},
+		{"POST", "/tags/rename", http.Header{"Tag": {"copy"}, "Dest": {"again"}}, 404, ""},
+		{"GET", "/tags/rename", http.Header{"Tag": {"renamed"}, "Dest": {"again"}}, 405, ""},
+		{"GET", "/tags", nil, 200, `["base","renamed"]` + "\n"},
+		{"POST", "/tags/delete", http.Header{"Tag": {"renamed"}}, 200, ""},
+		{"POST", "/tags/delete", http.Header{"Tag": {"renamed"}}, 404, ""},
+		{"GET", "/tags", nil, 200, `["base"]` + "\n"},
+		{"GET", "/gc", nil, 405, ""},
+		{"POST", "/gc", nil, 200, `{"Freed":1}` + "\n"},
+		{"POST", "/tags/delete", http.Header{"Tag": {"base"}}, 200, ""},
+		{"POST", "/gc", nil, 200, `{"Freed":34}` + "\n"},
+		{"GET", "/tags", nil, 200, `[]` + "\n"},
+		{"GET", "/snapshot", nil, 405, ""},
+		{"GET", "/restore", nil, 405, ""},
+		{"GET", "/snapshots", nil, 501, ""},
+		{"GET", "/stats", nil, 200, `{"Entries":0,"Blobs":0,"LogicalSize":0,"UniqueSize":0,"StoredSize":0,"DedupRatio":0,"CompressedBlobs":0,"CompressionRatio":0,"Chunks":0}` + "\n"},
+	}
+	for _, st := range subtests {
+		t.Run(fmt.Sprintf("%s-%s{%d}", st.path, st.method, st.wantCode), func(t *testing.T) {
+			body, statusCode := doControllerRequest(t, st.method, st.path, st.header, http.NoBody)
+			if statusCode != st.wantCode {
+				t.Errorf("statusCode: Got: %d, Want: %d (%s)\n", statusCode, st.wantCode, body)
+			}
+			if st.wantBody != "" && body != st.wantBody {
+				t.Errorf("body:\n    got: %s\n    want: %s\n", body, st.wantBody)
+			}
+		})
+	}
+}
+
+func testControllerBundle(t *testing.T, k cache.Handler) {
+	addTestArtifacts(t, k, "exported", "GET example.com/a", "GET example.com/b")
+
+	bundle, statusCode := doControllerRequest(t, "GET", "/export", http.Header{"Tag": {"exported"}}, http.NoBody)
+	if statusCode != 200 {
+		t.Fatalf("export: Got: %d, Want: 200 (%s)", statusCode, bundle)
+	}
+	_, statusCode = doControllerRequest(t, "GET", "/export", http.Header{"Tag": {"DNE"}}, http.NoBody)
+	if statusCode != 404 {
+		t.Errorf("export of a missing tag: Got: %d, Want: 404", statusCode)
+	}
+
+	body, statusCode := doControllerRequest(t, "POST", "/import", http.Header{"Tag": {"imported"}}, strings.NewReader(bundle))
+	if statusCode != 200 || body != `"imported"`+"\n" {
+		t.Errorf("import: Got: %d %s, Want: 200 \"imported\"", statusCode, body)
+	}
+	_, statusCode = doControllerRequest(t, "POST", "/import", http.Header{"Tag": {"imported"}}, strings.NewReader(bundle))
+	if statusCode != 409 {
+		t.Errorf("import over an existing tag: Got: %d, Want: 409", statusCode)
+	}
+
+	har, statusCode := doControllerRequest(t, "GET", "/export", http.Header{"Tag": {"exported"}, "Format": {"har"}}, http.NoBody)
+	if statusCode != 200 {
+		t.Fatalf("HAR export: Got: %d, Want: 200 (%s)", statusCode, har)
+	}
+	_, statusCode = doControllerRequest(t, "POST", "/import", http.Header{"Format": {"har"}}, strings.NewReader(har))
+	if statusCode != 400 {
+		t.Errorf("HAR import without a tag: Got: %d, Want: 400", statusCode)
+	}
+	_, statusCode = doControllerRequest(t, "POST", "/import", http.Header{"Tag": {"from-har"}, "Format": {"har"}}, strings.NewReader(har))
+	if statusCode != 200 {
+		t.Errorf("HAR import: Got: %d, Want: 200", statusCode)
+	}
+	warc, statusCode := doControllerRequest(t, "GET", "/export", http.Header{"Tag": {"exported"}, "Format": {"warc"}}, http.NoBody)
+	if statusCode != 200 {
+		t.Fatalf("WARC export: Got: %d, Want: 200 (%s)", statusCode, warc)
+	}
+	_, statusCode = doControllerRequest(t, "POST", "/import", http.Header{"Tag": {"from-warc"}, "Format": {"warc"}}, strings.NewReader(warc))
+	if statusCode != 200 {
+		t.Errorf("WARC import: Got: %d, Want: 200", statusCode)
+	}
+	warcGz, statusCode := doControllerRequest(t, "GET", "/export", http.Header{"Tag": {"exported"}, "Format": {"warc.gz"}}, http.NoBody)
+	if statusCode != 200 {
+		t.Fatalf("WARC export: Got: %d, Want: 200 (%s)", statusCode, warcGz)
+	}
+	_, statusCode = doControllerRequest(t, "POST", "/import", http.Header{"Tag": {"from-warc-gz"}, "Format": {"warc.gz"}}, strings.NewReader(warcGz))
+	if statusCode != 200 {
+		t.Errorf("gzipped WARC import: Got: %d, Want: 200", statusCode)
+	}
+	_, statusCode = doControllerRequest(t, "GET", "/export", http.Header{"Tag": {"exported"}, "Format": {"zip"}}, http.NoBody)
+	if statusCode != 400 {
+		t.Errorf("export in an unknown format: Got: %d, Want: 400", statusCode)
+	}
+
+	want, _ := k.ListArtifacts("exported", 0)
+	for _, imported := range []string{"imported", "from-har", "from-warc", "from-warc-gz"} {
+		got, err := k.ListArtifacts(imported, 0)
+		if err != nil {
+			t.Fatalf("Failed to list %s: %s", imported, err)
+		}
+		for key, artifact := range want {
+			if g, ok := got[key]; !ok || !g.Equal(artifact) {
+				t.Errorf("%s %s: got %v, want %v", imported, key, g, artifact)
+			}
+		}
+	}
+}
+
+func testControllerManifest(t *testing.T, k cache.Handler) {
+	addTestArtifacts(t, k, "locked", "GET example.com/b", "GET example.com/a")
+	addTestArtifacts(t, k, "drifted", "GET example.com/a", "GET example.com/c")
+
+	manifest, statusCode := doControllerRequest(t, "GET", "/tags/manifest", http.Header{"Tag": {"locked"}}, http.NoBody)
+	if statusCode != 200 || !strings.HasPrefix(manifest, "{\n  \"Tag\": \"locked\",") {
+		t.Fatalf("manifest: Got: %d %s", statusCode, manifest)
+	}
+	again, _ := doControllerRequest(t, "GET", "/tags/manifest", http.Header{"Tag": {"locked"}}, http.NoBody)
+	if again != manifest {
+		t.Errorf("manifest is not deterministic:\n%s\n%s", manifest, again)
+	}
+	_, statusCode = doControllerRequest(t, "GET", "/tags/manifest", http.Header{"Tag": {"DNE"}}, http.NoBody)
+	if statusCode != 404 {
+		t.Errorf("manifest of a missing tag: Got: %d, Want: 404", statusCode)
+	}
+
+	subtests := []struct {
+		method   string
+		header   http.Header
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"POST", nil, manifest, 200, `{"Missing":[],"Unexpected":[],"Changed":[]}` + "\n"},
+		{"POST", http.Header{"Tag": {"drifted"}}, manifest, 200, ""},
+		{"POST", http.Header{"Tag": {"DNE"}}, manifest, 404, ""},
+		{"POST", nil, "not a manifest", 400, ""},
+		{"GET", nil, manifest, 405, ""},
+	}
+	for _, st := range subtests {
+		body, statusCode := doControllerRequest(t, st.method, "/tags/verify", st.header, strings.NewReader(st.body))
+		if statusCode != st.wantCode {
+			t.Errorf("verify %v: Got: %d, Want: %d (%s)", st.header, statusCode, st.wantCode, body)
+		}
+		if st.wantBody != "" && body != st.wantBody {
+			t.Errorf("verify %v:\n    got: %s\n    want: %s", st.header, body, st.wantBody)
+		}
+	}
+	report, _ := doControllerRequest(t, "POST", "/tags/verify", http.Header{"Tag": {"drifted"}}, strings.NewReader(manifest))
+	if !strings.Contains(report, `"Missing":[{"Key":"GET example.com/b"`) || !strings.Contains(report, `"Unexpected":[{"Key":"GET example.com/c"`) {
+		t.Errorf("verify drifted: got %s", report)
+	}
+}
+
+func testControllerAudit(t *testing.T, k cache.Handler) {
+	addTestArtifacts(t, k, "unaudited", "POST example.com/a")
+
+	subtests := []struct {
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{http.Header{"Tag": {"unaudited"}}, 200,
+			`{"Tag":"unaudited","Unchanged":[],"Changed":[],"Gone":[],"Unreachable":[],` +
+				`"Skipped":[{"Key":"POST example.com/a","Hash":"` + hashOf(t, k, "unaudited", "POST example.com/a") + `","Size":18,` +
+				`"Error":"POST requests are not fetched again"}]}` + "\n"},
+		{http.Header{"Tag": {"unaudited"}, "Workers": {"1"}}, 200, ""},
+		{http.Header{"Tag": {"unaudited"}, "Workers": {"0"}}, 400, ""},
+		{http.Header{"Tag": {"unaudited"}, "Workers": {"many"}}, 400, ""},
+		{http.Header{"Tag": {"DNE"}}, 404, ""},
+		{nil, 400, ""},
+	}
+	for _, st := range subtests {
+		body, statusCode := doControllerRequest(t, "GET", "/tags/audit", st.header, http.NoBody)
+		if statusCode != st.wantCode {
+			t.Errorf("audit %v: Got: %d, Want: %d (%s)", st.header, statusCode, st.wantCode, body)
+		}
+		if st.wantBody != "" && body != st.wantBody {
+			t.Errorf("audit %v:\n    got: %s\n    want: %s", st.header, body, st.wantBody)
+		}
+	}
+}
+
+func testControllerSync(t *testing.T, k cache.Handler) {
+	addTestArtifacts(t, k, "sync-base", "GET example.com/s1")
+	addTestArtifacts(t, k, "sync-child", "GET example.com/s1", "GET example.com/s2")
+	if err := k.SetParents("sync-child", []string{"sync-base"}, 0); err != nil {
+		t.Fatalf("Failed to set parents: %s", err)
+	}
+
+	defer func(peers []string) { syncPeers = peers }(syncPeers)
+	setupSyncPeers("127.0.0.1:5678", "")
+
+	// The controller under test is the source, pulling into a second store
+	dst := cache.CreateMemory()
+	dst.AddUser(cache.CreateUser())
+	synced, err := syncTags(dst, "127.0.0.1:5678", []string{"sync-c*"}, 0, &http.Client{})
+	if err != nil {
+		t.Fatalf("Failed to sync: %s", err)
+	}
+	want := []cache.SyncStats{
+		{Tag: "sync-base", Entries: 1, Pulled: 1, PulledSize: 18},
+		{Tag: "sync-child", Entries: 2, Reused: 1, Pulled: 1, PulledSize: 18},
+	}
+	if !reflect.DeepEqual(synced, want) {
+		t.Errorf("synced:\n    got: %+v\n    want: %+v", synced, want)
+	}
+	if parents, _ := dst.Parents("sync-child", 0); !reflect.DeepEqual(parents, []string{"sync-base"}) {
+		t.Errorf("parents: got %v, want [sync-base]", parents)
+	}
+	artifact, err := dst.GetArtifact("GET example.com/s2", "sync-child", 0)
+	if err != nil || artifact.Hash != hashOf(t, k, "sync-child", "GET example.com/s2") {
+		t.Errorf("synced entry: got %+v (%v)", artifact, err)
+	}
+
+	subtests := []struct {
+		method   string
+		path     string
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{"POST", "/sync", http.Header{"Source": {"127.0.0.1:5678"}, "Tags": {"sync-base"}}, 200,
+			`[{"Tag":"sync-base","Entries":1,"Unchanged":1,"Reused":0,"Pulled":0,"PulledSize":0,"Removed":0}]` + "\n"},
+		{"POST", "/sync", http.Header{"Source": {"http://127.0.0.1:5678/"}, "Tags": {"sync-base"}}, 200, ""},
+		{"POST", "/sync", http.Header{"Source": {"169.254.169.254"}, "Tags": {"sync-base"}}, 403, ""},
+		{"POST", "/sync", http.Header{"Source": {"127.0.0.1:5678"}, "Tags": {"["}}, 400, ""},
+		{"POST", "/sync", http.Header{"Tags": {"sync-base"}}, 400, ""},
+		{"GET", "/sync", http.Header{"Source": {"127.0.0.1:5678"}, "Tags": {"sync-base"}}, 405, ""},
+		{"GET", "/sync/manifest", http.Header{"Tag": {"DNE"}}, 404, ""},
+		{"GET", "/sync/manifest", nil, 400, ""},
+		{"GET", "/sync/blob", http.Header{"Tag": {"sync-base"}, "Key": {"GET example.com/s1"}}, 200, "GET example.com/s1"},
+		{"GET", "/sync/blob", http.Header{"Tag": {"sync-base"}, "Key": {"GET example.com/DNE"}}, 404, ""},
+		{"GET", "/sync/blob", http.Header{"Tag": {"sync-base"}}, 400, ""},
+	}
+	for _, st := range subtests {
+		body, statusCode := doControllerRequest(t, st.method, st.path, st.header, http.NoBody)
+		if statusCode != st.wantCode {
+			t.Errorf("%s %s %v: Got: %d, Want: %d (%s)", st.method, st.path, st.header, statusCode, st.wantCode, body)
+		}
+		if st.wantBody != "" && body != st.wantBody {
+			t.Errorf("%s %s %v:\n    got: %s\n    want: %s", st.method, st.path, st.header, body, st.wantBody)
+		}
+	}
+}
+
+func testControllerAttest(t *testing.T, k cache.Handler) {
+	addTestArtifacts(t, k, "attest-tag", "GET example.com/a1", "GET example.com/a2")
+	if _, statusCode := doControllerRequest(t, "POST", "/tags/sign", http.Header{"Tag": {"attest-tag"}}, http.NoBody); statusCode != 501 {
+		t.Errorf("signing without a key: Got: %d, Want: 501", statusCode)
+	}
+	signingKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	defer func() { signingKey = nil }()
+
+	subtests := []struct {
+		method   string
+		path     string
+		header   http.Header
+		wantCode int
+	}{
+		{"GET", "/tags/attestation", http.Header{"Tag": {"attest-tag"}}, 404},
+		{"GET", "/tags/attestation", http.Header{"Tag": {"DNE"}}, 404},
+		{"GET", "/tags/attestation", nil, 400},
+		{"GET", "/tags/sign", http.Header{"Tag": {"attest-tag"}}, 405},
+		{"POST", "/tags/sign", http.Header{"Tag": {"DNE"}}, 404},
+		{"POST", "/tags/sign", nil, 400},
+		{"POST", "/tags/sign", http.Header{"Tag": {"attest-tag"}}, 200},
+		{"GET", "/tags/attestation", http.Header{"Tag": {"attest-tag"}}, 200},
+	}
+	for _, st := range subtests {
+		body, statusCode := doControllerRequest(t, st.method, st.path, st.header, http.NoBody)
+		if statusCode != st.wantCode {
+			t.Errorf("%s %s %v: Got: %d, Want: %d (%s)", st.method, st.path, st.header, statusCode, st.wantCode, body)
+		}
+	}
+
+	// What the controller hands out checks out against its manifest and key
+	body, _ := doControllerRequest(t, "GET", "/tags/attestation", http.Header{"Tag": {"attest-tag"}}, http.NoBody)
+	attestation := cache.Attestation{}
+	if err := json.Unmarshal([]byte(body), &attestation); err != nil {
+		t.Fatalf("Failed to decode attestation: %s", err)
+	}
+	body, _ = doControllerRequest(t, "GET", "/tags/manifest", http.Header{"Tag": {"attest-tag"}}, http.NoBody)
+	manifest := cache.Manifest{}
+	if err := json.Unmarshal([]byte(body), &manifest); err != nil {
+		t.Fatalf("Failed to decode manifest: %s", err)
+	}
+	body, _ = doControllerRequest(t, "GET", "/signing-key", nil, http.NoBody)
+	trusted, err := hex.DecodeString(strings.TrimSpace(body))
+	if err != nil {
+		t.Fatalf("Failed to decode public key %q: %s", body, err)
+	}
+	if err = attestation.Check(manifest, ed25519.PublicKey(trusted)); err != nil {
+		t.Errorf("attestation: %s", err)
+	}
+
+	// Recording is signed as soon as it stops, or moves on to another tag
+	doControllerRequest(t, "GET", "/tag", http.Header{"Tag": {"attest-recorded"}}, http.NoBody)
+	doControllerRequest(t, "GET", "/mode", http.Header{"Mode": {"0"}}, http.NoBody)
+	addTestArtifacts(t, k, "attest-recorded", "GET example.com/r1")
+	doControllerRequest(t, "GET", "/tag", http.Header{"Tag": {"attest-switched"}}, http.NoBody)
+	if err = cache.VerifyTag(k, "attest-recorded", 0, ed25519.PublicKey(trusted)); err != nil {
+		t.Errorf("tag recorded before switching: %s", err)
+	}
+	addTestArtifacts(t, k, "attest-switched", "GET example.com/r2")
+	doControllerRequest(t, "GET", "/mode", http.Header{"Mode": {"2"}}, http.NoBody)
+	doControllerRequest(t, "GET", "/tag", http.Header{"Tag": {baseWant.tag}}, http.NoBody)
+	if err = cache.VerifyTag(k, "attest-switched", 0, ed25519.PublicKey(trusted)); err != nil {
+		t.Errorf("recorded tag: %s", err)
+	}
+	verifyState(baseWant, t)
+}
+
+func hashOf(t *testing.T, k cache.Handler, tag string, key string) string {
+	artifact, err := k.GetArtifact(key, tag, 0)
+	if err != nil {
+		t.Fatalf("Failed to get artifact: %s", err)
+	}
+	return artifact.Hash
+}
+
+// addTestArtifacts records each key in tag with the key itself as the body.
+func addTestArtifacts(t *testing.T, k cache.Handler, tag string, keys ...string) {
+	for _, key := range keys {
+		if err := k.AddArtifact(&cache.Artifact{}, strings.NewReader(key), key, tag, 0); err != nil {
+			t.Fatalf("Failed to add artifact: %s", err)
+		}
+	}
+}
+
 // TODO: Add login back
 
 // func testControllerLogin(t *testing.T) {
@@ -208,7 +622,9 @@ func TestController(t *testing.T) {
 	// Start up controller
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	s := controller(wg, 5678, false)
+	k := cache.CreateMemory()
+	k.AddUser(cache.CreateUser())
+	s := controller(wg, 5678, false, k)
 
 	timeout, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -226,6 +642,12 @@ func TestController(t *testing.T) {
 		// {"login", testControllerLogin},
 		{"mode", testControllerMode},
 		{"tag", testControllerTag},
+		{"tags", func(t *testing.T) { testControllerTags(t, k) }},
+		{"bundle", func(t *testing.T) { testControllerBundle(t, k) }},
+		{"manifest", func(t *testing.T) { testControllerManifest(t, k) }},
+		{"audit", func(t *testing.T) { testControllerAudit(t, k) }},
+		{"sync", func(t *testing.T) { testControllerSync(t, k) }},
+		{"attest", func(t *testing.T) { testControllerAttest(t, k) }},
 	}
 
 	for _, st := range subtests {
@@ -2,27 +2,117 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"github.com/emmettmcdow/btrfly/server/cache"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 func main() {
+	storeKind := flag.String("store", "memory", "where artifacts are kept: memory or disk")
+	storeDir := flag.String("store-dir", "btrfly-store", "root directory of the disk store")
+	matchConfig := flag.String("match-config", "", "JSON file with the request matching rules")
+	chunking := flag.Bool("chunking", false, "split large artifacts into content-defined chunks, disk store only")
+	masterKey := flag.String("master-key", "", "file with the key that wraps the per-user data keys, turns on encryption at rest, disk store only")
+	rotateKey := flag.String("rotate-master-key", "", "file with a new master key to rewrap the data keys with at startup")
+	gcInterval := flag.Duration("gc-interval", 0, "how often to reclaim unreferenced artifacts, 0 to only do it on request")
+	maxTagAge := flag.Duration("max-tag-age", 0, "reap tags not played back for longer than this, 0 to keep them forever")
+	keepLast := flag.String("keep-last", "", "comma separated prefix=N rules, keeping only the N most recently used tags that start with prefix")
+	reapInterval := flag.Duration("reap-interval", time.Hour, "how often to enforce -max-tag-age and -keep-last")
+	follow := flag.String("follow", "", "controller of another btrfly server to keep pulling -follow-tags from")
+	followTagList := flag.String("follow-tags", "*", "comma separated patterns of the tags to follow, e.g. ci-*,release-*")
+	followInterval := flag.Duration("follow-interval", time.Minute, "how often to pull from -follow")
+	syncPeerList := flag.String("sync-peers", "", "comma separated controllers /sync may pull from, besides -follow")
+	snapshotDir := flag.String("snapshot-dir", "", "directory snapshots of the disk store are taken into and restored from")
+	signingKeyFile := flag.String("signing-key", "", "file with the ed25519 key tags are signed with when recording stops")
+	trustedKeyFile := flag.String("trusted-key", "", "file with the ed25519 public key -strict trusts, defaults to the one of -signing-key")
+	strict := flag.Bool("strict", false, "refuse to play back tags that do not match an attestation by the trusted key")
+	// The subcommands snapshot and restore work on the store and exit, they
+	// may come before or after the flags
+	subcommand, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		subcommand, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	args = flag.Args()
+	if subcommand == "" && len(args) > 0 {
+		subcommand, args = args[0], args[1:]
+	}
+	snapshotRoot = *snapshotDir
+	setupSyncPeers(*syncPeerList, *follow)
+
+	if *matchConfig != "" {
+		m, err := cache.LoadMatcher(*matchConfig)
+		if err != nil {
+			log.Fatalf("Failed to load the request matching rules: %s\n", err)
+		}
+		setMatcher(m)
+	}
+
+	if err := setupSigning(*signingKeyFile, *trustedKeyFile, *strict); err != nil {
+		log.Fatalf("Failed to set up signing: %s\n", err)
+	}
+
+	k, err := openStore(*storeKind, *storeDir, *chunking)
+	if err != nil {
+		log.Fatalf("Failed to open the %s store: %s\n", *storeKind, err)
+	}
+	if err = setupEncryption(k, *masterKey, *rotateKey); err != nil {
+		log.Fatalf("Failed to set up encryption: %s\n", err)
+	}
+	if subcommand != "" {
+		if err = runSubcommand(k, subcommand, args); err != nil {
+			log.Fatalf("Failed to %s: %s\n", subcommand, err)
+		}
+		return
+	}
+	// TODO: for now we only have an id of 0
+	k.AddUser(cache.CreateUser())
+	if *gcInterval > 0 {
+		go collectGarbage(k, *gcInterval)
+	}
+	if *follow != "" {
+		patterns, err := syncPatterns(*followTagList)
+		if err != nil {
+			log.Fatalf("Failed to parse -follow-tags: %s\n", err)
+		}
+		go followTags(k, *follow, patterns, *followInterval)
+	}
+	policy, err := retentionPolicy(*maxTagAge, *keepLast)
+	if err != nil {
+		log.Fatalf("Failed to parse the retention policy: %s\n", err)
+	}
+	if policy.Enabled() && *reapInterval > 0 {
+		go reapTags(k, policy, *reapInterval)
+	}
+
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	controllerServer := controller(wg, 5678, true)
+	controllerServer := controller(wg, 5678, true, k)
 	wg.Add(1)
-	proxyServer := proxy(wg, 80, false)
+	proxyServer := proxy(wg, 80, false, k)
 	wg.Add(1)
-	proxyServerTLS := proxy(wg, 443, true)
+	proxyServerTLS := proxy(wg, 443, true, k)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
+		// Once the servers are down nothing is recorded anymore, so whatever
+		// was being recorded can be signed
+		defer func() {
+			previous := currentState()
+			setMode(MODE_S)
+			endRecording(k, previous)
+		}()
 		timeout, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 		defer func() {
@@ -43,12 +133,115 @@ func main() {
 				fmt.Printf("failed to shutdown controllerServer: %s", err)
 			}
 		}()
-		for sig := range c {
-			if sig == syscall.SIGINT {
-				log.Println("Recieved keyboard interrupt. Shutting down server.")
-			}
+		if sig := <-c; sig == syscall.SIGINT {
+			log.Println("Recieved keyboard interrupt. Shutting down server.")
 		}
 	}()
 
 	wg.Wait()
 }
+
+func openStore(kind string, dir string, chunking bool) (k cache.Handler, err error) {
+	switch kind {
+	case "memory":
+		if chunking {
+			return nil, fmt.Errorf("the memory store does not chunk")
+		}
+		return cache.CreateMemory(), nil
+	case "disk":
+		d, err := cache.CreateDisk(dir)
+		if err != nil {
+			return nil, err
+		}
+		d.Chunking = chunking
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unknown store %s", kind)
+	}
+}
+
+// setupEncryption turns on encryption at rest with the master key in
+// keyPath, then rotates to the one in rotatePath if there is one.
+func setupEncryption(k cache.Handler, keyPath string, rotatePath string) (err error) {
+	if keyPath == "" {
+		if rotatePath != "" {
+			return fmt.Errorf("rotating needs the current master key")
+		}
+		return nil
+	}
+	d, ok := k.(*cache.Disk)
+	if !ok {
+		return fmt.Errorf("only the disk store encrypts")
+	}
+	master, err := cache.LoadMasterKey(keyPath)
+	if err != nil {
+		return err
+	}
+	if err = d.EnableEncryption(master); err != nil {
+		return err
+	}
+	if rotatePath == "" {
+		return nil
+	}
+	next, err := cache.LoadMasterKey(rotatePath)
+	if err != nil {
+		return err
+	}
+	if err = d.RotateMasterKey(next); err != nil {
+		return err
+	}
+	log.Printf("Rewrapped the data keys with the master key in %s, start with -master-key %s from now on", rotatePath, rotatePath)
+	return nil
+}
+
+// retentionPolicy builds the policy from the -max-tag-age and -keep-last
+// flags, e.g. "ci-=10,nightly-=3".
+func retentionPolicy(maxAge time.Duration, keepLast string) (policy cache.RetentionPolicy, err error) {
+	policy = cache.RetentionPolicy{MaxAge: maxAge, KeepLast: make(map[string]int)}
+	for _, rule := range strings.Split(keepLast, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		prefix, count, ok := strings.Cut(rule, "=")
+		if !ok {
+			return policy, fmt.Errorf("keep-last rule %s is not prefix=N", rule)
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("keep-last rule %s does not keep a number of tags", rule)
+		}
+		policy.KeepLast[prefix] = n
+	}
+	return policy, nil
+}
+
+// runSubcommand runs the snapshot or restore subcommand against a store the
+// server is not serving from. A running server takes them through the
+// controller instead.
+func runSubcommand(k cache.Handler, subcommand string, args []string) (err error) {
+	d, ok := k.(*cache.Disk)
+	if !ok {
+		return fmt.Errorf("only the disk store can be snapshotted")
+	}
+	if snapshotRoot == "" {
+		return fmt.Errorf("-snapshot-dir is required")
+	}
+	var stats cache.SnapshotStats
+	switch subcommand {
+	case "snapshot":
+		stats, err = d.Snapshot(snapshotRoot)
+	case "restore":
+		name := ""
+		if len(args) > 0 {
+			name = args[0]
+		}
+		stats, err = d.Restore(snapshotRoot, name)
+	default:
+		return fmt.Errorf("unknown subcommand, use snapshot or restore [name]")
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("%s %s: copied %d of %d files (%d bytes)", subcommand, stats.Name, stats.Copied, stats.Files, stats.CopiedSize)
+	return nil
+}
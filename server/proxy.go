@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/emmettmcdow/btrfly/server/cache"
 	"io"
@@ -67,24 +67,53 @@ func (m ProxyMode) String() string {
 	}
 }
 
-var proxyMode = MODE_S
-var buildTag = "shoop da woop"
-var currUser uint64 = 0
+// The controller changes these while proxy handlers are reading them, so
+// they are only touched with stateMu held. Handlers take a snapshot with
+// currentState once per request, a request that is underway when the mode or
+// tag changes finishes the way it started.
+var (
+	stateMu   sync.RWMutex
+	proxyMode = MODE_S
+	buildTag  = "shoop da woop"
+	currUser  uint64
+	// requestMatcher decides which requests share an artifact
+	requestMatcher = &cache.Matcher{}
+)
+
+type proxyState struct {
+	mode    ProxyMode
+	tag     string
+	user    uint64
+	matcher *cache.Matcher
+}
+
+func currentState() (state proxyState) {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return proxyState{mode: proxyMode, tag: buildTag, user: currUser, matcher: requestMatcher}
+}
+
+func currentUser() uint64 {
+	return currentState().user
+}
+
+func setMatcher(m *cache.Matcher) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	requestMatcher = m
+}
 
 type tempResponse struct {
 	StatusCode int
 	Header     http.Header
-	Body       []byte
+	Body       io.ReadCloser
+	// FinalURL is where the request ended up after redirects
+	FinalURL string
 }
 
-func proxy(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server) {
-	var k cache.Handler
+func proxy(wg *sync.WaitGroup, port uint, tlsEnabled bool, k cache.Handler) (s *http.Server) {
 	var config *tls.Config
 
-	// TODO: this is temporary for testing
-	k = cache.CreateMemory()
-	k.AddUser(cache.CreateUser())
-
 	var httpClient *http.Client
 
 	log.Print("Starting btrfly...")
@@ -103,57 +132,82 @@ func proxy(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server) {
 	m.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		full_url := r.Host + r.URL.String()
 		log.Printf("Received a %s request to %s", r.Method, full_url)
-		// TODO: use the conditional get
-		switch proxyMode {
+		state := currentState()
+		key, err := state.matcher.Key(r)
+		if errors.Is(err, cache.ErrBodyTooLarge) {
+			log.Printf("Failed to build the cache key: %s", err)
+			http.Error(w,
+				"Request body is too large to match on",
+				http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			log.Printf("Failed to build the cache key: %s", err)
+			http.Error(w,
+				"Error reading request",
+				http.StatusBadRequest)
+			return
+		}
+		switch state.mode {
 		case MODE_R:
-			upstreamArtifact := &cache.Artifact{}
-
 			upstreamRequest, err := generateUpstreamRequest(r)
 			if err != nil {
 				log.Printf("Failed to generate an upstream request: %s", err)
 				http.Error(w,
 					"Error creating proxy request",
 					http.StatusInternalServerError)
+				return
 			}
+			cachedArtifact := conditionalGet(upstreamRequest, k, key, state)
 			response, err := relayRequest(upstreamRequest, httpClient)
 			if err != nil {
 				log.Printf("Failed to relay request to upstream: %s", err)
 				http.Error(w,
 					"Error creating proxy request",
 					http.StatusInternalServerError)
+				return
 			}
-			n, err := upstreamArtifact.Write(response.Body)
-			if n != len(response.Body) {
-				log.Printf("Failed to copy over http response body to artifact: %s", err)
-				http.Error(w,
-					"Error creating proxy request",
-					http.StatusInternalServerError)
+			defer response.Body.Close()
+
+			// Upstream Old: what we have is still current, record it again
+			if cachedArtifact != nil && response.StatusCode == http.StatusNotModified {
+				log.Printf("%s has not changed upstream, reusing %s", key, cachedArtifact.Hash)
+				revalidated := cachedArtifact.Revalidated(state.user, state.tag, recordedHeader(response.Header))
+				if err = k.TagArtifact(revalidated, state.tag, key, state.user); err != nil {
+					log.Printf("Failed to record %s again: %s", key, err)
+				}
+				if err = respondWithArtifact(w, r, revalidated); err != nil {
+					log.Printf("Failed to send cached artifact: %s", err)
+					panic(http.ErrAbortHandler)
+				}
+				return
 			}
 
-			err = formatUpstreamResponse(w, response)
+			// The body goes to the client and into btrfly in a single pass
+			writeUpstreamHeader(w, response)
+			upstreamArtifact := &cache.Artifact{
+				StatusCode: response.StatusCode,
+				Header:     recordedHeader(response.Header),
+				Metadata:   recordedMetadata(upstreamRequest, response, state),
+			}
+			err = k.AddArtifact(upstreamArtifact, io.TeeReader(response.Body, w), key, state.tag, state.user)
 			if err != nil {
-				log.Printf("Failed to format the response from upstream: %s", err)
-				http.Error(w,
-					"Error creating proxy request",
-					http.StatusInternalServerError)
+				// The status line is already out, all we can do is log it and
+				// cut the client off so it cannot take the body for complete
+				log.Printf("Failed to add artifact to btrfly: %s", err)
+				panic(http.ErrAbortHandler)
 			}
-			cachedArtifact, err := k.GetArtifact(full_url, buildTag, currUser)
-			if err == nil && upstreamArtifact.Equal(cachedArtifact) { // If artifact already exists, just tag it
-				// Tag the existing one
-				// TODO: fix all the nonstandard names!
-				k.TagArtifact(cachedArtifact, buildTag, full_url, currUser)
-			} else {
-				err = k.AddArtifact(upstreamArtifact, full_url, buildTag, currUser)
-				if err != nil {
-					log.Printf("Failed to add artifact to btrfly: %s", err)
+
+		case MODE_P:
+			if strictPlayback {
+				if err := verifyPlayback(k, state.tag, state.user); err != nil {
+					log.Printf("REFUSING TO PLAY BACK UNTRUSTED TAG %s: %s", state.tag, err)
 					http.Error(w,
-						"Error creating proxy request",
-						http.StatusInternalServerError)
+						fmt.Sprintf("Tag %s cannot be trusted: %s", state.tag, err),
+						http.StatusForbidden)
+					return
 				}
 			}
-
-		case MODE_P:
-			cachedArtifact, err := k.GetArtifact(full_url, buildTag, currUser)
+			cachedArtifact, err := k.GetArtifact(key, state.tag, state.user)
 			if err != nil {
 				log.Printf("Failed to retrieve the requested artifact from btrfly. "+
 					"Something went seriously wrong.: %s", err)
@@ -161,12 +215,17 @@ func proxy(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server) {
 					"Error creating proxy request",
 					http.StatusInternalServerError)
 			} else {
+				k.Played(state.tag, state.user)
 				err = respondWithArtifact(w, r, cachedArtifact)
-				if err != nil {
+				if errors.Is(err, cache.ErrCorrupt) {
+					log.Printf("REFUSING TO SERVE CORRUPT ARTIFACT %s for %s: %s", cachedArtifact.Hash, key, err)
+				} else if err != nil {
 					log.Printf("Failed to send cached artifact: %s", err)
-					http.Error(w,
-						"Error creating proxy request",
-						http.StatusInternalServerError)
+				}
+				if err != nil {
+					// The status line is already out. Cut the connection so the
+					// client cannot mistake a short or bad body for the real one.
+					panic(http.ErrAbortHandler)
 				}
 			}
 		case MODE_S:
@@ -176,6 +235,7 @@ func proxy(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server) {
 				http.Error(w,
 					"Error creating proxy request",
 					http.StatusInternalServerError)
+				return
 			}
 			response, err := relayRequest(upstreamRequest, httpClient)
 			if err != nil {
@@ -183,13 +243,12 @@ func proxy(wg *sync.WaitGroup, port uint, tlsEnabled bool) (s *http.Server) {
 				http.Error(w,
 					"Error creating proxy request",
 					http.StatusInternalServerError)
+				return
 			}
+			defer response.Body.Close()
 			err = formatUpstreamResponse(w, response)
 			if err != nil {
 				log.Printf("Failed to format the response from upstream: %s", err)
-				http.Error(w,
-					"Error creating proxy request",
-					http.StatusInternalServerError)
 			}
 
 		default:
@@ -213,11 +272,15 @@ func Login(ID string) (err error) {
 	if err != nil {
 		return fmt.Errorf("failed to convert ID %s to integer: %s", ID, err)
 	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	currUser = m
 	return nil
 }
 
 func Tag(tag string) (err error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
 	buildTag = tag
 	return nil
 }
@@ -230,10 +293,16 @@ func Mode(mode string) (err error) {
 	if m > 2 {
 		return fmt.Errorf("invalid error mode %d", m)
 	}
-	proxyMode = ProxyMode(m)
+	setMode(ProxyMode(m))
 	return nil
 }
 
+func setMode(mode ProxyMode) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	proxyMode = mode
+}
+
 func init_custom_transport() (httpClient *http.Client) {
 	var (
 		dnsResolverIP        = "8.8.8.8:53" // Google DNS resolver.
@@ -282,6 +351,14 @@ func generateUpstreamRequest(r *http.Request) (proxyReq *http.Request, err error
 }
 
 func formatUpstreamResponse(dest http.ResponseWriter, src tempResponse) (err error) {
+	writeUpstreamHeader(dest, src)
+
+	// Copy the body of the proxy response to the original response
+	_, err = io.Copy(dest, src.Body)
+	return err
+}
+
+func writeUpstreamHeader(dest http.ResponseWriter, src tempResponse) {
 	// Copy the headers from the proxy response to the original response
 	for name, values := range src.Header {
 		for _, value := range values {
@@ -291,24 +368,20 @@ func formatUpstreamResponse(dest http.ResponseWriter, src tempResponse) (err err
 
 	// Set the status code of the original response to the status code of the proxy response
 	dest.WriteHeader(src.StatusCode)
-
-	// Copy the body of the proxy response to the original response
-	// TODO: Icky icky icky fixme pwease
-	_, err = io.Copy(dest, bytes.NewBuffer(src.Body))
-	return err
 }
 
 type clientSender interface {
 	Do(r *http.Request) (*http.Response, error)
 }
 
+// relayRequest sends proxyReq upstream. The body of the returned response is
+// streamed straight from upstream and must be closed by the caller.
 func relayRequest(proxyReq *http.Request, httpClient clientSender) (response tempResponse, err error) {
 	// Send the proxy request using the custom transport
 	resp, err := httpClient.Do(proxyReq)
 	if err != nil {
 		return response, err
 	}
-	defer resp.Body.Close()
 	response.Header = http.Header{}
 	// Copy the headers from the proxy response to the original response
 	for name, values := range resp.Header {
@@ -319,21 +392,94 @@ func relayRequest(proxyReq *http.Request, httpClient clientSender) (response tem
 
 	// Set the status code of the original response to the status code of the proxy response
 	response.StatusCode = resp.StatusCode
-
-	// Copy the body of the proxy response to the original response
-	body, err := io.ReadAll(resp.Body)
-	response.Body = body
+	response.Body = resp.Body
+	if resp.Request != nil {
+		response.FinalURL = resp.Request.URL.String()
+	}
 	return response, err
 }
 
+// Hop-by-hop headers only describe a single connection, so they are neither
+// recorded nor played back.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func recordedHeader(header http.Header) http.Header {
+	recorded := header.Clone()
+	for _, name := range hopHeaders {
+		recorded.Del(name)
+	}
+	return recorded
+}
+
+// conditionalGet makes upstreamRequest conditional on the recording btrfly
+// already has for key, if it has one upstream can validate, and returns that
+// recording. Requests the client made conditional itself are left alone.
+func conditionalGet(upstreamRequest *http.Request, k cache.Handler, key string, state proxyState) (cached *cache.Artifact) {
+	if upstreamRequest.Method != http.MethodGet && upstreamRequest.Method != http.MethodHead {
+		return nil
+	}
+	if upstreamRequest.Header.Get("If-None-Match") != "" || upstreamRequest.Header.Get("If-Modified-Since") != "" {
+		return nil
+	}
+	cached, err := cache.Latest(k, key, state.tag, state.user)
+	if err != nil || (cached.StatusCode != 0 && cached.StatusCode != http.StatusOK) {
+		return nil
+	}
+	etag, lastModified := cached.Validators()
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	if etag != "" {
+		upstreamRequest.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		upstreamRequest.Header.Set("If-Modified-Since", lastModified)
+	}
+	return cached
+}
+
+// recordedMetadata describes the response to upstreamRequest for the record.
+func recordedMetadata(upstreamRequest *http.Request, response tempResponse, state proxyState) (meta *cache.Metadata) {
+	meta = cache.NewMetadata(response.Header)
+	meta.User = state.user
+	meta.Session = state.tag
+	meta.Scheme = upstreamRequest.URL.Scheme
+	meta.Host = upstreamRequest.URL.Host
+	meta.FinalURL = response.FinalURL
+	if meta.FinalURL == "" {
+		meta.FinalURL = upstreamRequest.URL.String()
+	}
+	return meta
+}
+
 func respondWithArtifact(w http.ResponseWriter, r *http.Request, artifact *cache.Artifact) (err error) {
-	w.Header().Add("Content-Length", fmt.Sprint(len(artifact.Data)))
+	for name, values := range recordedHeader(artifact.Header) {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	// Bodiless responses (HEAD, 304) keep the length upstream advertised
+	if artifact.Size > 0 || w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", fmt.Sprint(artifact.Size))
+	}
 
-	// Set the status code of the original response to the status code of the proxy response
-	w.WriteHeader(200)
+	// Replay the status code upstream gave us when we recorded
+	statusCode := artifact.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
 
-	// Copy the body of the proxy response to the original response
-	// TODO: Icky icky icky fixme pwease
-	_, err = io.Copy(w, bytes.NewBuffer(artifact.Data))
+	// Stream the body straight out of storage
+	_, err = artifact.WriteTo(w)
 	return err
 }
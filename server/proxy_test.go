@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"github.com/emmettmcdow/btrfly/server/cache"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
@@ -49,6 +52,20 @@ func doBtrflyRequest(method string, URL string, client *http.Client) (_ string,
 }
 
 func TestProxyRecordAndPlayback(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testProxyRecordAndPlayback(t, cache.CreateMemory())
+	})
+	t.Run("disk", func(t *testing.T) {
+		k, err := cache.CreateDisk(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create disk store: %s", err)
+		}
+		testProxyRecordAndPlayback(t, k)
+	})
+}
+
+func testProxyRecordAndPlayback(t *testing.T, k cache.Handler) {
+	k.AddUser(cache.CreateUser())
 
 	httpClient := http.DefaultClient
 	serverReady := make(chan func() (err error))
@@ -69,7 +86,7 @@ func TestProxyRecordAndPlayback(t *testing.T) {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
-	s := proxy(wg, port, false)
+	s := proxy(wg, port, false, k)
 	timeout, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	defer func() {
@@ -106,7 +123,7 @@ func TestProxyRecordAndPlayback(t *testing.T) {
 	}()
 
 	// Set to record
-	proxyMode = MODE_R
+	setMode(MODE_R)
 
 	t.Run("RECORD GET http://127.0.0.1:1234/root/a ORIGINAL", func(t *testing.T) {
 		body, statusCode, err := doBtrflyRequest("GET", "http://127.0.0.1:1234/root/a", httpClient)
@@ -135,8 +152,35 @@ func TestProxyRecordAndPlayback(t *testing.T) {
 		}
 	})
 
+	t.Run("RECORD GET http://127.0.0.1:1234/root/DNE NOT FOUND", func(t *testing.T) {
+		_, statusCode, err := doBtrflyRequest("GET", "http://127.0.0.1:1234/root/DNE", httpClient)
+		if err != nil {
+			t.Errorf("Failed to do http request: %s\n", err)
+		}
+		if statusCode != 404 {
+			t.Errorf("statusCode: got %d, want: 404", statusCode)
+		}
+	})
+
+	t.Run("RECORD METADATA", func(t *testing.T) {
+		state := currentState()
+		artifact, err := k.GetArtifact("GET 127.0.0.1:1234/root/a", state.tag, state.user)
+		if err != nil {
+			t.Fatalf("Failed to get the recording: %s", err)
+		}
+		meta := artifact.Metadata
+		if meta == nil {
+			t.Fatalf("Recorded without metadata")
+		}
+		if time.Since(meta.RecordedAt) > time.Minute || meta.Session != state.tag || meta.Scheme != "http" ||
+			meta.Host != "127.0.0.1:1234" || meta.FinalURL != "http://127.0.0.1:1234/root/a" ||
+			!strings.HasPrefix(meta.ContentType, "text/plain") {
+			t.Errorf("metadata: got %+v", meta)
+		}
+	})
+
 	// Set to playback
-	proxyMode = MODE_P
+	setMode(MODE_P)
 
 	// Update the filesystem
 	memoryFS["root/a"] = &fstest.MapFile{Data: []byte(aUpdated)}
@@ -179,12 +223,51 @@ func TestProxyRecordAndPlayback(t *testing.T) {
 		}
 	})
 
+	t.Run("PLAYBACK GET http://127.0.0.1:1234/root/DNE NOT FOUND", func(t *testing.T) {
+		memoryFS["root/DNE"] = &fstest.MapFile{Data: []byte("exists now")}
+		_, statusCode, err := doBtrflyRequest("GET", "http://127.0.0.1:1234/root/DNE", httpClient)
+		if err != nil {
+			t.Errorf("Failed to do http request: %s\n", err)
+		}
+		if statusCode != 404 {
+			t.Errorf("statusCode: got %d, want: 404", statusCode)
+		}
+	})
+
+	t.Run("PLAYBACK STRICT", func(t *testing.T) {
+		key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+		trustedKey, strictPlayback = key.Public().(ed25519.PublicKey), true
+		defer func() { trustedKey, strictPlayback = nil, false }()
+		state := currentState()
+		play := func(want int) {
+			body, statusCode, err := doBtrflyRequest("GET", "http://127.0.0.1:1234/root/a", httpClient)
+			if err != nil {
+				t.Errorf("Failed to do http request: %s\n", err)
+			}
+			if statusCode != want {
+				t.Errorf("statusCode: got %d, want: %d (%s)", statusCode, want, body)
+			}
+		}
+
+		play(http.StatusForbidden)
+		if _, err := cache.SignTag(k, state.tag, state.user, key); err != nil {
+			t.Fatalf("Failed to sign: %s", err)
+		}
+		play(http.StatusOK)
+		// Swap a body behind the attestation's back
+		b, err := k.GetArtifact("GET 127.0.0.1:1234/root/b", state.tag, state.user)
+		if err != nil {
+			t.Fatalf("Failed to get the recording: %s", err)
+		}
+		k.TagArtifact(b, state.tag, "GET 127.0.0.1:1234/root/a", state.user)
+		play(http.StatusForbidden)
+	})
 }
 
 func TestPassthroughProxy(t *testing.T) {
 
 	// Set to playback
-	proxyMode = MODE_S
+	setMode(MODE_S)
 
 	httpClient := http.DefaultClient
 	serverReady := make(chan func() (err error))
@@ -198,7 +281,7 @@ func TestPassthroughProxy(t *testing.T) {
 	// btrfly
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
-	s := proxy(wg, port, false)
+	s := proxy(wg, port, false, cache.CreateMemory())
 	timeout, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	defer func() {
@@ -259,6 +342,259 @@ func TestPassthroughProxy(t *testing.T) {
 	}
 }
 
+// doProxyRequest GETs path from host through the proxy.
+func doProxyRequest(host string, path string) (body string, statusCode int, err error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d%s", port, path), http.NoBody)
+	if err != nil {
+		return "", 0, err
+	}
+	// Doing the part of the btrfly client here - Redirecting to proxy
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return string(data), resp.StatusCode, err
+}
+
+// TestProxyConcurrentRecordAndPlayback has parallel clients go through the
+// proxy while the mode flips between record and playback. Run it with -race.
+func TestProxyConcurrentRecordAndPlayback(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testProxyConcurrentRecordAndPlayback(t, cache.CreateMemory())
+	})
+	t.Run("disk", func(t *testing.T) {
+		k, err := cache.CreateDisk(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create disk store: %s", err)
+		}
+		testProxyConcurrentRecordAndPlayback(t, k)
+	})
+}
+
+func testProxyConcurrentRecordAndPlayback(t *testing.T, k cache.Handler) {
+	const workers = 8
+	const paths = 16
+	const requests = 40
+	k.AddUser(cache.CreateUser())
+	defer setMode(MODE_S)
+	defer Tag(baseWant.tag)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "this is the %s file", r.URL.Path)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s := proxy(wg, port, false, k)
+	defer s.Close()
+
+	get := func(path string) (body string, statusCode int, err error) {
+		return doProxyRequest(host, path)
+	}
+
+	// Everything is recorded once so playback always has something to play
+	if err := Tag("stress"); err != nil {
+		t.Fatalf("Failed to set the tag: %s", err)
+	}
+	setMode(MODE_R)
+	for i := 0; i < paths; i++ {
+		if _, _, err := get(fmt.Sprintf("/root/%d", i)); err != nil {
+			t.Fatalf("Failed to record: %s", err)
+		}
+	}
+
+	done := make(chan struct{})
+	toggled := make(chan struct{})
+	go func() {
+		defer close(toggled)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			setMode([]ProxyMode{MODE_R, MODE_P}[i%2])
+			currentState()
+			k.ListArtifacts("stress", 0)
+			k.Stats()
+		}
+	}()
+	clients := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		clients.Add(1)
+		go func(w int) {
+			defer clients.Done()
+			for i := 0; i < requests; i++ {
+				path := fmt.Sprintf("/root/%d", (w+i)%paths)
+				body, statusCode, err := get(path)
+				if err != nil {
+					t.Errorf("Failed to do http request: %s", err)
+					continue
+				}
+				if want := fmt.Sprintf("this is the %s file", path); statusCode != 200 || body != want {
+					t.Errorf("%s: got %d %q, want 200 %q", path, statusCode, body, want)
+				}
+			}
+		}(w)
+	}
+	clients.Wait()
+	close(done)
+	<-toggled
+
+	artifacts, err := k.ListArtifacts("stress", 0)
+	if err != nil || len(artifacts) != paths {
+		t.Errorf("stress: got %d entries (%v), want %d", len(artifacts), err, paths)
+	}
+}
+
+// TestProxyTruncatedUpstream has upstream drop the connection halfway through
+// a recorded body, which the client has to notice too.
+func TestProxyTruncatedUpstream(t *testing.T) {
+	k := cache.CreateMemory()
+	k.AddUser(cache.CreateUser())
+	defer setMode(MODE_S)
+	defer Tag(baseWant.tag)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "the first half")
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s := proxy(wg, port, false, k)
+	defer s.Close()
+	if err := Tag("truncated"); err != nil {
+		t.Fatalf("Failed to set the tag: %s", err)
+	}
+	setMode(MODE_R)
+
+	body, statusCode, err := doProxyRequest(host, "/half")
+	if err == nil {
+		t.Errorf("got %d %q without an error, want the download to fail", statusCode, body)
+	}
+	if _, err = k.GetArtifact("GET "+host+"/half", "truncated", 0); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("truncated body: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestProxyRevalidation(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testProxyRevalidation(t, cache.CreateMemory())
+	})
+	t.Run("disk", func(t *testing.T) {
+		k, err := cache.CreateDisk(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create disk store: %s", err)
+		}
+		testProxyRevalidation(t, k)
+	})
+}
+
+func testProxyRevalidation(t *testing.T, k cache.Handler) {
+	k.AddUser(cache.CreateUser())
+	defer setMode(MODE_S)
+	defer Tag(baseWant.tag)
+
+	// /etag validates with If-None-Match, /modified with If-Modified-Since
+	// and /plain not at all
+	modified := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	version := "v1"
+	mu := &sync.Mutex{}
+	fullBodies := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("ETag", `"`+version+`"`)
+			if r.Header.Get("If-None-Match") == `"`+version+`"` {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/modified":
+			w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+			if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		fullBodies += 1
+		fmt.Fprintf(w, "%s of %s", version, r.URL.Path)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s := proxy(wg, port, false, k)
+	defer s.Close()
+	setMode(MODE_R)
+
+	steps := []struct {
+		name           string
+		tag            string
+		change         func()
+		path           string
+		wantBody       string
+		wantFullBodies int
+	}{
+		{"first etag", "mon", nil, "/etag", "v1 of /etag", 1},
+		{"first modified", "mon", nil, "/modified", "v1 of /modified", 2},
+		{"first plain", "mon", nil, "/plain", "v1 of /plain", 3},
+		{"same tag etag", "mon", nil, "/etag", "v1 of /etag", 3},
+		{"new tag etag", "tue", nil, "/etag", "v1 of /etag", 3},
+		{"new tag modified", "tue", nil, "/modified", "v1 of /modified", 3},
+		{"new tag plain", "tue", nil, "/plain", "v1 of /plain", 4},
+		{"etag changed", "wed", func() { version = "v2" }, "/etag", "v2 of /etag", 5},
+		{"modified changed", "wed", func() { modified = modified.AddDate(0, 0, 1) }, "/modified", "v2 of /modified", 6},
+	}
+	for _, step := range steps {
+		mu.Lock()
+		if step.change != nil {
+			step.change()
+		}
+		mu.Unlock()
+		if err := Tag(step.tag); err != nil {
+			t.Fatalf("Failed to set the tag: %s", err)
+		}
+		body, statusCode, err := doProxyRequest(host, step.path)
+		if err != nil {
+			t.Fatalf("%s: failed to do http request: %s", step.name, err)
+		}
+		if statusCode != 200 || body != step.wantBody {
+			t.Errorf("%s: got %d %q, want 200 %q", step.name, statusCode, body, step.wantBody)
+		}
+		mu.Lock()
+		if fullBodies != step.wantFullBodies {
+			t.Errorf("%s: upstream sent %d full bodies, want %d", step.name, fullBodies, step.wantFullBodies)
+		}
+		mu.Unlock()
+	}
+
+	revalidated, err := k.GetArtifact("GET "+host+"/etag", "tue", 0)
+	if err != nil {
+		t.Fatalf("Failed to get the revalidated entry: %s", err)
+	}
+	original, _ := k.GetArtifact("GET "+host+"/etag", "mon", 0)
+	if revalidated.Hash != original.Hash || revalidated.Metadata == nil || revalidated.Metadata.RevalidatedAt == nil ||
+		revalidated.Metadata.Session != "tue" {
+		t.Errorf("revalidated entry: got %+v, want mon's body revalidated in tue", revalidated.Metadata)
+	}
+	if revalidated.Header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("revalidated entry: got Cache-Control %q, want the one from the 304", revalidated.Header.Get("Cache-Control"))
+	}
+}
+
 // ************************************************************** Unit Tests |
 type DumbClient struct {
 	Err error
@@ -283,6 +619,79 @@ func (d DumbClient) Do(r *http.Request) (response *http.Response, err error) {
 	return response, d.Err
 }
 
+func TestRespondWithArtifact(t *testing.T) {
+	k := cache.CreateMemory()
+	k.AddUser(cache.CreateUser())
+
+	cases := []struct {
+		name       string
+		body       string
+		statusCode int
+		header     http.Header
+		wantStatus int
+		wantHeader http.Header
+	}{
+		{
+			"legacy artifact",
+			"plain",
+			0,
+			nil,
+			200,
+			http.Header{"Content-Length": {"5"}},
+		},
+		{
+			"full response",
+			`{"a": 1}`,
+			203,
+			http.Header{
+				"Content-Type":      {"application/json"},
+				"Etag":              {`"abc"`},
+				"Last-Modified":     {"Mon, 02 Jan 2006 15:04:05 GMT"},
+				"Connection":        {"close"},
+				"Transfer-Encoding": {"chunked"},
+			},
+			203,
+			http.Header{
+				"Content-Type":   {"application/json"},
+				"Content-Length": {"8"},
+				"Etag":           {`"abc"`},
+				"Last-Modified":  {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			},
+		},
+		{
+			"redirect",
+			"",
+			302,
+			http.Header{"Location": {"http://example.com/elsewhere"}},
+			302,
+			http.Header{"Location": {"http://example.com/elsewhere"}, "Content-Length": {"0"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			artifact := &cache.Artifact{StatusCode: tc.statusCode, Header: tc.header}
+			err := k.AddArtifact(artifact, strings.NewReader(tc.body), tc.name, "tag", 0)
+			if err != nil {
+				t.Fatalf("Failed to add artifact: %s", err)
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://example.com/", http.NoBody)
+			if err = respondWithArtifact(w, r, artifact); err != nil {
+				t.Errorf("Failed to respond with artifact: %s", err)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("statusCode: got %d, want %d", w.Code, tc.wantStatus)
+			}
+			if !reflect.DeepEqual(w.Header(), tc.wantHeader) {
+				t.Errorf("header: got \n%s\nwant \n%s\n", prettyHeader(w.Header()), prettyHeader(tc.wantHeader))
+			}
+			if w.Body.String() != tc.body {
+				t.Errorf("body: got %s, want %s", w.Body.String(), tc.body)
+			}
+		})
+	}
+}
+
 // TODO: Anonymize the case structs - more idiomatic
 type relayRequestCase struct {
 	name        string
@@ -306,7 +715,7 @@ func TestRelayRequest(t *testing.T) {
 	stdRequest.Header = stdHeader
 
 	successResponse := tempResponse{StatusCode: 200, Header: stdHeader}
-	successResponse.Body = []byte(stdText)
+	successResponse.Body = io.NopCloser(strings.NewReader(stdText))
 	stdBody.Reset(stdText)
 
 	fakeClient = DumbClient{Err: nil}
@@ -326,8 +735,14 @@ func TestRelayRequest(t *testing.T) {
 					t.Errorf("err: got %v, want %v", err, tc.expectedErr)
 				}
 			} else {
-				if !reflect.DeepEqual(got.Body, tc.want.Body) {
-					t.Errorf("request.Body: got %s, want %s", got.Body, tc.want.Body)
+				gotBody, err := io.ReadAll(got.Body)
+				if err != nil {
+					t.Errorf("Failed to read response body: %s", err)
+				}
+				got.Body.Close()
+				wantBody, _ := io.ReadAll(tc.want.Body)
+				if !reflect.DeepEqual(gotBody, wantBody) {
+					t.Errorf("request.Body: got %s, want %s", gotBody, wantBody)
 				}
 
 				if got.StatusCode != tc.want.StatusCode {
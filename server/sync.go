@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emmettmcdow/btrfly/server/cache"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Syncing pulls tags from the controller of another btrfly server. The
+// source lists its tags on /tags, describes a tag on /sync/manifest and hands
+// out single bodies on /sync/blob, and only the bodies this server has no
+// copy of are fetched.
+
+// syncPeers are the only controllers /sync pulls from, so a request to the
+// controller cannot make it fetch arbitrary URLs. It is set from -sync-peers
+// and -follow before the controller starts.
+var syncPeers []string
+
+// setupSyncPeers allows the comma separated controllers in list and follow.
+func setupSyncPeers(list string, follow string) {
+	for _, peer := range append(strings.Split(list, ","), follow) {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			syncPeers = append(syncPeers, syncSource(peer))
+		}
+	}
+}
+
+// syncPeer reports whether source is one of syncPeers.
+func syncPeer(source string) bool {
+	for _, peer := range syncPeers {
+		if syncSource(source) == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// syncSource is the base URL of the controller at source, which may leave out
+// the scheme.
+func syncSource(source string) string {
+	if !strings.Contains(source, "://") {
+		source = "http://" + source
+	}
+	return strings.TrimSuffix(source, "/")
+}
+
+// syncPatterns splits a comma separated list of tag patterns, as understood
+// by path.Match, checking every one of them.
+func syncPatterns(list string) (patterns []string, err error) {
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad tag pattern %s: %s", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no tag patterns")
+	}
+	return patterns, nil
+}
+
+// syncTags pulls every tag of source matching one of patterns into k, along
+// with the tags they are layered on.
+func syncTags(k cache.Handler, source string, patterns []string, userID uint64, httpClient clientSender) (synced []cache.SyncStats, err error) {
+	source = syncSource(source)
+	tags := []string{}
+	if err = getRemoteJSON(httpClient, source+"/tags", nil, &tags); err != nil {
+		return nil, err
+	}
+
+	synced = []cache.SyncStats{}
+	visited := make(map[string]bool)
+	var pull func(tag string) error
+	pull = func(tag string) (err error) {
+		if visited[tag] {
+			return nil
+		}
+		visited[tag] = true
+		manifest := cache.BundleManifest{}
+		err = getRemoteJSON(httpClient, source+"/sync/manifest", http.Header{"Tag": {tag}}, &manifest)
+		if err != nil {
+			return err
+		}
+		// Parents first, the tag can only be layered on tags that exist
+		for _, parent := range manifest.Parents {
+			if err = pull(parent); err != nil {
+				return err
+			}
+		}
+		stats, err := cache.SyncTag(k, manifest, tag, userID, func(entry cache.BundleEntry) (io.ReadCloser, error) {
+			resp, err := getRemote(httpClient, source+"/sync/blob", http.Header{"Tag": {tag}, "Key": {entry.Key}})
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to sync %s: %w", tag, err)
+		}
+		synced = append(synced, stats)
+		return nil
+	}
+	for _, tag := range tags {
+		if matchesAny(tag, patterns) {
+			if err = pull(tag); err != nil {
+				return synced, err
+			}
+		}
+	}
+	return synced, nil
+}
+
+func matchesAny(tag string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// followTags syncs the tags matching patterns from source every interval,
+// forever.
+func followTags(k cache.Handler, source string, patterns []string, interval time.Duration) {
+	httpClient := &http.Client{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		synced, err := syncTags(k, source, patterns, currentUser(), httpClient)
+		logSynced(source, synced)
+		if err != nil {
+			log.Printf("Following %s failed: %s", source, err)
+		}
+	}
+}
+
+// logSynced logs every tag that changed.
+func logSynced(source string, synced []cache.SyncStats) {
+	for _, stats := range synced {
+		if stats.Reused > 0 || stats.Pulled > 0 || stats.Removed > 0 {
+			log.Printf("Synced %s from %s: %d entries, %d reused, %d pulled (%d bytes), %d removed",
+				stats.Tag, source, stats.Entries, stats.Reused, stats.Pulled, stats.PulledSize, stats.Removed)
+		}
+	}
+}
+
+// getRemote sends a GET to another controller. A 404 is reported as
+// cache.ErrNotFound, any other failure with the body it came with.
+func getRemote(httpClient clientSender, URL string, header http.Header) (resp *http.Response, err error) {
+	req, err := http.NewRequest(http.MethodGet, URL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %s", URL, err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %s: %w", URL, strings.TrimSpace(string(msg)), cache.ErrNotFound)
+	}
+	return nil, fmt.Errorf("%s answered %d: %s", URL, resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+func getRemoteJSON(httpClient clientSender, URL string, header http.Header, v interface{}) (err error) {
+	resp, err := getRemote(httpClient, URL, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %s", URL, err)
+	}
+	return nil
+}